@@ -0,0 +1,196 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/server"
+)
+
+// ErrNoToken is reported for attempts to serve the API on a non-loopback address without a token.
+var ErrNoToken = errors.New("a token is required to serve on a non-loopback address")
+
+// New creates an [API] to inspect and close the tunnels of the registry.
+func New(r *server.Registry, ops ...Option) *API {
+	a := API{registry: r}
+	for _, op := range ops {
+		op(&a)
+	}
+	return &a
+}
+
+// WithToken makes the API require requests to present the token as a bearer token.
+func WithToken(token string) Option {
+	return func(a *API) {
+		a.token = token
+	}
+}
+
+type Option func(*API)
+
+// API exposes live tunnels of proxy servers over HTTP.
+type API struct {
+	registry *server.Registry
+	token    string
+
+	// listenHost is the host of the address passed to Listen, which requests may be addressed to
+	listenHost string
+}
+
+// Handler serves the API endpoints:
+//
+//	GET /tunnels         lists the active tunnels, including forwarded HTTP requests
+//	DELETE /tunnels/{id} closes the tunnel with the ID
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tunnels", a.listTunnels)
+	mux.HandleFunc("DELETE /tunnels/{id}", a.closeTunnel)
+
+	if a.token == "" {
+		return a.requireLocalHost(mux)
+	}
+	return a.requireToken(mux)
+}
+
+// requireLocalHost rejects requests addressed to hosts other than loopback ones or the listen address,
+// so that web pages cannot reach an API without a token by rebinding their domain names to a loopback address.
+func (a *API) requireLocalHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.isLocalHost(r.Host) {
+			http.Error(w, "host not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) isLocalHost(hostPort string) bool {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = strings.Trim(hostPort, "[]")
+	}
+
+	if strings.EqualFold(host, "localhost") || (a.listenHost != "" && strings.EqualFold(host, a.listenHost)) {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+func (a *API) requireToken(next http.Handler) http.Handler {
+	want := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Listen binds to the address to serve the API on.
+//
+// Without a token, only loopback addresses are allowed, as anyone able to connect could otherwise inspect and close tunnels.
+func (a *API) Listen(ctx context.Context, address string) (net.Listener, error) {
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %v: %w", address, err)
+	}
+
+	if a.token == "" && !l.Addr().(*net.TCPAddr).IP.IsLoopback() {
+		l.Close()
+		return nil, fmt.Errorf("listen on %v: %w", address, ErrNoToken)
+	}
+
+	a.listenHost, _, _ = net.SplitHostPort(address)
+	return l, nil
+}
+
+// Serve serves the API on the listener until the context is canceled.
+func (a *API) Serve(ctx context.Context, l net.Listener) error {
+	server := http.Server{Handler: a.Handler()}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Serve(l)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return server.Close()
+	case err := <-errChan:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	}
+}
+
+type tunnelList struct {
+	Tunnels []tunnelInfo `json:"tunnels"`
+}
+
+type tunnelInfo struct {
+	ID          uint64     `json:"id"`
+	Proto       addr.Proto `json:"proto"`
+	Client      string     `json:"client"`
+	Destination string     `json:"destination"`
+	Route       string     `json:"route,omitempty"`
+	Upstream    string     `json:"upstream,omitempty"`
+
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+
+	Opened time.Time `json:"opened"`
+	Age    string    `json:"age"`
+}
+
+func (a *API) listTunnels(w http.ResponseWriter, r *http.Request) {
+	list := tunnelList{Tunnels: []tunnelInfo{}}
+	for _, t := range a.registry.Tunnels() {
+		list.Tunnels = append(list.Tunnels, tunnelInfo{
+			ID:          t.ID,
+			Proto:       t.Proto,
+			Client:      t.Client,
+			Destination: t.Destination,
+			Route:       t.Route,
+			Upstream:    t.Upstream,
+
+			BytesSent:     t.BytesSent,
+			BytesReceived: t.BytesReceived,
+
+			Opened: t.Opened,
+			Age:    time.Since(t.Opened).Round(time.Millisecond).String(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+func (a *API) closeTunnel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid tunnel ID", http.StatusBadRequest)
+		return
+	}
+
+	if !a.registry.CloseTunnel(id) {
+		http.Error(w, "tunnel not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,217 @@
+package admin_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/admin"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/mocks"
+	"github.com/cerfical/socks2http/internal/proxy/server"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestAPI(t *testing.T) {
+	suite.Run(t, new(APITest))
+}
+
+type APITest struct {
+	suite.Suite
+}
+
+type tunnelList struct {
+	Tunnels []struct {
+		ID          uint64 `json:"id"`
+		Proto       string `json:"proto"`
+		Destination string `json:"destination"`
+		Age         string `json:"age"`
+	} `json:"tunnels"`
+}
+
+func (t *APITest) TestTunnels() {
+	t.Run("lists no tunnels if there are none", func() {
+		resp := t.do(server.NewRegistry(), http.MethodGet, "/tunnels")
+		t.Equal(http.StatusOK, resp.Code)
+		t.JSONEq(`{"tunnels": []}`, resp.Body.String())
+	})
+
+	t.Run("lists active tunnels", func() {
+		registry := server.NewRegistry()
+		dstHost := addr.NewAddr("example.com", 80)
+		t.openTunnel(registry, dstHost)
+
+		resp := t.do(registry, http.MethodGet, "/tunnels")
+		t.Require().Equal(http.StatusOK, resp.Code)
+
+		var list tunnelList
+		t.Require().NoError(json.NewDecoder(resp.Body).Decode(&list))
+		t.Require().Len(list.Tunnels, 1)
+		t.Equal("HTTP", list.Tunnels[0].Proto)
+		t.Equal(dstHost.String(), list.Tunnels[0].Destination)
+		t.NotEmpty(list.Tunnels[0].Age)
+	})
+
+	t.Run("closes a tunnel by ID", func() {
+		registry := server.NewRegistry()
+		t.openTunnel(registry, addr.NewAddr("example.com", 80))
+		id := registry.Tunnels()[0].ID
+
+		resp := t.do(registry, http.MethodDelete, "/tunnels/"+strconv.FormatUint(id, 10))
+		t.Equal(http.StatusNoContent, resp.Code)
+
+		t.Eventually(func() bool {
+			return len(registry.Tunnels()) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("reports unknown tunnels", func() {
+		resp := t.do(server.NewRegistry(), http.MethodDelete, "/tunnels/1")
+		t.Equal(http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("rejects malformed tunnel IDs", func() {
+		resp := t.do(server.NewRegistry(), http.MethodDelete, "/tunnels/abc")
+		t.Equal(http.StatusBadRequest, resp.Code)
+	})
+}
+
+func (t *APITest) TestToken() {
+	t.Run("rejects requests without the token", func() {
+		resp := t.doAuth(admin.WithToken("secret"), "")
+		t.Equal(http.StatusUnauthorized, resp.Code)
+	})
+
+	t.Run("rejects requests with a wrong token", func() {
+		resp := t.doAuth(admin.WithToken("secret"), "Bearer guess")
+		t.Equal(http.StatusUnauthorized, resp.Code)
+	})
+
+	t.Run("accepts requests with the token", func() {
+		resp := t.doAuth(admin.WithToken("secret"), "Bearer secret")
+		t.Equal(http.StatusOK, resp.Code)
+	})
+}
+
+func (t *APITest) TestHost() {
+	hosts := map[string]struct {
+		host    string
+		allowed bool
+	}{
+		"localhost":     {"localhost:9090", true},
+		"loopback IPv4": {"127.0.0.1:9090", true},
+		"loopback IPv6": {"[::1]:9090", true},
+		"other names":   {"evil.example.com:9090", false},
+		"other IPs":     {"10.0.0.1", false},
+	}
+
+	for name, test := range hosts {
+		t.Run("checks requests addressed to "+name+" without a token", func() {
+			req := httptest.NewRequest(http.MethodGet, "/tunnels", nil)
+			req.Host = test.host
+
+			rec := httptest.NewRecorder()
+			admin.New(server.NewRegistry()).Handler().ServeHTTP(rec, req)
+			t.Equal(test.allowed, rec.Code == http.StatusOK, rec.Code)
+		})
+	}
+
+	t.Run("accepts any host with a token", func() {
+		req := httptest.NewRequest(http.MethodGet, "/tunnels", nil)
+		req.Host = "admin.example.com"
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rec := httptest.NewRecorder()
+		admin.New(server.NewRegistry(), admin.WithToken("secret")).Handler().ServeHTTP(rec, req)
+		t.Equal(http.StatusOK, rec.Code)
+	})
+}
+
+func (t *APITest) TestListen() {
+	t.Run("allows loopback addresses without a token", func() {
+		l, err := admin.New(server.NewRegistry()).Listen(context.Background(), "127.0.0.1:0")
+		t.Require().NoError(err)
+		l.Close()
+	})
+
+	t.Run("refuses non-loopback addresses without a token", func() {
+		_, err := admin.New(server.NewRegistry()).Listen(context.Background(), ":0")
+		t.ErrorIs(err, admin.ErrNoToken)
+	})
+
+	t.Run("allows non-loopback addresses with a token", func() {
+		l, err := admin.New(server.NewRegistry(), admin.WithToken("secret")).Listen(context.Background(), ":0")
+		t.Require().NoError(err)
+		l.Close()
+	})
+}
+
+func (t *APITest) doAuth(op admin.Option, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/tunnels", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	rec := httptest.NewRecorder()
+	admin.New(server.NewRegistry(), op).Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func (t *APITest) do(registry *server.Registry, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Host = "localhost:9090"
+
+	rec := httptest.NewRecorder()
+	admin.New(registry).Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+// openTunnel opens a tunnel through an HTTP server with the registry, and waits for it to be registered.
+func (t *APITest) openTunnel(registry *server.Registry, dstHost *addr.Addr) {
+	dstConn, dstProxyConn := net.Pipe()
+	t.T().Cleanup(func() { dstConn.Close() })
+
+	dial := mocks.NewDialer(t.T())
+	dial.EXPECT().
+		Dial(mock.Anything, dstHost).
+		Return(dstProxyConn, nil)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	t.Require().NoError(err)
+
+	server := server.New(
+		server.WithDialer(dial),
+		server.WithRegistry(registry),
+	)
+
+	serveErr := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		serveErr <- server.Serve(ctx, addr.ProtoHTTP, l)
+	}()
+	t.T().Cleanup(func() {
+		cancel()
+		t.NoError(<-serveErr)
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	t.Require().NoError(err)
+	t.T().Cleanup(func() { conn.Close() })
+
+	req := httptest.NewRequest(http.MethodConnect, dstHost.String(), nil)
+	t.Require().NoError(req.WriteProxy(conn))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	t.Require().NoError(err)
+	t.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	t.Eventually(func() bool {
+		return len(registry.Tunnels()) == 1
+	}, time.Second, 10*time.Millisecond)
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -8,9 +9,14 @@ import (
 	"time"
 
 	"github.com/cerfical/socks2http/internal/log"
+	"github.com/cerfical/socks2http/internal/proxy"
 	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/auth"
 	"github.com/cerfical/socks2http/internal/proxy/router"
+	"github.com/cerfical/socks2http/internal/proxy/server"
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/cast"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -19,18 +25,12 @@ var (
 	defServerURL  = addr.NewURL(addr.ProtoHTTP, "localhost", 80)
 	defProxyProto = addr.ProtoHTTP
 	defLogLevel   = log.LevelVerbose
+
+	defDrainTimeout = 30 * time.Second
 )
 
 func Load(args []string) *Config {
-	progName := getProgramName(args)
-
-	flags := pflag.NewFlagSet(progName, pflag.ContinueOnError)
-	flags.Usage = func() {
-		fmt.Printf("Usage:\n")
-		fmt.Printf("  %v [options]\n\n", progName)
-		fmt.Printf("Options:\n")
-		flags.PrintDefaults()
-	}
+	flags := newFlagSet(args)
 	if err := parseFlags(flags, args); err != nil {
 		printErrorAndExit(flags, err)
 	}
@@ -42,6 +42,78 @@ func Load(args []string) *Config {
 	return rawConfig.ToConfig()
 }
 
+// Reload loads the configuration again, reporting errors instead of exiting.
+func Reload(args []string) (*Config, error) {
+	flags := newFlagSet(args)
+	if err := parseFlags(flags, args); err != nil {
+		return nil, err
+	}
+
+	rawConfig, err := parseRawConfig(flags)
+	if err != nil {
+		return nil, err
+	}
+	return rawConfig.ToConfig(), nil
+}
+
+// WatchFile calls onChange whenever the configuration file is modified, until the context is canceled.
+func WatchFile(ctx context.Context, path string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("create watcher: %w", err)
+	}
+
+	// Watch the directory, as editors and mounted volumes tend to replace the file rather than write to it
+	file := filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("watch %v: %w", path, err)
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		realFile, _ := filepath.EvalSymlinks(file)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				// A symlinked file also changes when the link is redirected
+				prevRealFile := realFile
+				realFile, _ = filepath.EvalSymlinks(file)
+
+				written := filepath.Clean(e.Name) == file && e.Op&(fsnotify.Write|fsnotify.Create) != 0
+				if written || realFile != prevRealFile {
+					onChange()
+				}
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func newFlagSet(args []string) *pflag.FlagSet {
+	progName := getProgramName(args)
+
+	flags := pflag.NewFlagSet(progName, pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Printf("Usage:\n")
+		fmt.Printf("  %v [options]\n\n", progName)
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
 func printErrorAndExit(f *pflag.FlagSet, err error) {
 	fmt.Printf("Error: %v\n\n", err)
 	f.Usage()
@@ -52,7 +124,7 @@ func parseRawConfig(f *pflag.FlagSet) (*rawConfig, error) {
 	v := viper.New()
 
 	// Bind command-line flags to their corresponding values from config file
-	configNames := []string{"server", "proxy", "log.level", "timeout"}
+	configNames := []string{"server", "proxy", "log.level", "timeout.dial", "timeout.handshake", "timeout.idle", "timeout.drain", "auth.file", "pac.file", "health.probe", "health.interval", "metrics.listen", "admin.listen", "admin.token", "limit.conns", "limit.conns-per-ip", "limit.rate", "limit.rate-per-ip", "bandwidth.upload", "bandwidth.download", "watch"}
 	for _, name := range configNames {
 		kebabCasedName := strings.ReplaceAll(name, ".", "-")
 		if err := v.BindPFlag(name, f.Lookup(kebabCasedName)); err != nil {
@@ -68,9 +140,16 @@ func parseRawConfig(f *pflag.FlagSet) (*rawConfig, error) {
 		}
 	}
 
+	warnings, err := applyLegacyTimeout(v, f)
+	if err != nil {
+		return nil, fmt.Errorf("parse configuration: %w", err)
+	}
+
 	options := []viper.DecoderConfigOption{
 		viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
 			mapstructure.TextUnmarshallerHookFunc(),
+			// Allow a single value where a list is expected
+			mapstructure.StringToSliceHookFunc(","),
 			mapstructure.StringToTimeDurationHookFunc(),
 		)),
 
@@ -83,22 +162,97 @@ func parseRawConfig(f *pflag.FlagSet) (*rawConfig, error) {
 	if err := v.UnmarshalExact(&config, options...); err != nil {
 		return nil, fmt.Errorf("parse configuration: %w", err)
 	}
+	config.file = v.ConfigFileUsed()
+	config.warnings = warnings
 	return &config, nil
 }
 
+// applyLegacyTimeout makes a single timeout, set with the deprecated -t flag or a scalar timeout option,
+// the default for the dial, handshake and idle timeouts.
+func applyLegacyTimeout(v *viper.Viper, f *pflag.FlagSet) ([]string, error) {
+	var (
+		timeout  time.Duration
+		warnings []string
+	)
+
+	// The flag is not bound, so the value can only come from the configuration file
+	switch value := v.Get("timeout"); value.(type) {
+	case nil, map[string]any:
+	default:
+		d, err := cast.ToDurationE(value)
+		if err != nil {
+			return nil, fmt.Errorf("'timeout': %w", err)
+		}
+		timeout = d
+		warnings = append(warnings, "Option 'timeout' with a single value is deprecated, use 'timeout.dial', 'timeout.handshake' and 'timeout.idle' instead")
+	}
+
+	// Flags take precedence over the configuration file
+	if f.Changed("timeout") {
+		d, err := f.GetDuration("timeout")
+		if err != nil {
+			return nil, err
+		}
+		timeout = d
+	} else if warnings == nil {
+		return nil, nil
+	}
+
+	// A scalar in the configuration file hides the defaults of the flags
+	drain, err := f.GetDuration("timeout-drain")
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]any{"dial": timeout, "handshake": timeout, "idle": timeout, "drain": drain}
+	for name := range settings {
+		if key := "timeout." + name; v.IsSet(key) {
+			settings[name] = v.Get(key)
+		}
+	}
+	v.Set("timeout", settings)
+	return warnings, nil
+}
+
 func parseFlags(f *pflag.FlagSet, args []string) error {
 	// Flags shared with options from a configuration file
-	serverURL := proxyURLValue(*defServerURL)
-	f.VarP(&serverURL, "server", "s", "``address for proxy server to listen on")
-	f.VarP(&proxyURLValue{}, "proxy", "p", "``proxy URL to connect via proxy client")
+	serverURLs := proxyURLListValue{urls: []addr.URL{*defServerURL}, server: true}
+	f.VarP(&serverURLs, "server", "s", "``address for proxy server to listen on, can be repeated")
+	f.VarP(&proxyURLListValue{}, "proxy", "p", "``proxy URL to connect via proxy client, can be repeated to form a chain")
 
 	logLevel := logLevelValue(defLogLevel)
 	f.VarP(&logLevel, "log-level", "l", "``severity level of logging messages")
 
-	f.DurationP("timeout", "t", 0, "``wait duration for I/O operations")
+	f.Duration("timeout-dial", 0, "``wait duration for connecting to a destination or an upstream proxy")
+	f.Duration("timeout-handshake", 0, "``wait duration for clients to send a request")
+	f.Duration("timeout-idle", 0, "``wait duration for data on a tunnel before closing it")
+	f.Duration("timeout-drain", defDrainTimeout, "``wait duration for active tunnels to close on shutdown")
+
+	f.DurationP("timeout", "t", 0, "``wait duration for dialing, handshakes and idle tunnels, unless set separately")
+	if err := f.MarkDeprecated("timeout", "use --timeout-dial, --timeout-handshake and --timeout-idle instead"); err != nil {
+		panic(fmt.Errorf("deprecate flag: %w", err))
+	}
+
+	f.String("auth-file", "", "``htpasswd-style file with users allowed to access the proxy server")
+	f.String("pac-file", "", "``proxy auto-config file to decide on proxies for unrouted destinations")
+
+	f.String("health-probe", "", "``address to open test tunnels to for checking health of upstream proxies")
+	f.Duration("health-interval", 0, "``wait duration between health checks of upstream proxies")
+
+	f.Int("limit-conns", 0, "``maximum number of concurrent client connections")
+	f.Int("limit-conns-per-ip", 0, "``maximum number of concurrent connections from a single client IP")
+	f.Float64("limit-rate", 0, "``maximum number of new client connections per second")
+	f.Float64("limit-rate-per-ip", 0, "``maximum number of new connections per second from a single client IP")
+
+	f.Int("bandwidth-upload", 0, "``maximum number of bytes per second sent by all clients together")
+	f.Int("bandwidth-download", 0, "``maximum number of bytes per second received by all clients together")
+
+	f.String("metrics-listen", "", "``address to serve Prometheus metrics on")
+	f.String("admin-listen", "", "``address to serve the admin API for inspecting and closing tunnels on")
+	f.String("admin-token", "", "``bearer token required by the admin API, which is mandatory for non-loopback addresses")
 
 	help := f.BoolP("help", "h", false, "``display help message")
 	f.StringP("config-file", "c", "", "``configuration file")
+	f.BoolP("watch", "w", false, "``reload routes when the configuration file changes")
 
 	if err := f.Parse(args[1:]); err != nil {
 		return fmt.Errorf("parse flags: %w", err)
@@ -120,57 +274,239 @@ func getProgramName(args []string) string {
 }
 
 type Config struct {
-	Server addr.URL
+	// File is the configuration file the options were loaded from, if any.
+	File  string
+	Watch bool
+
+	// Warnings describe deprecated options in use, to be reported to the user.
+	Warnings []string
+
+	Servers []addr.URL
 
-	Proxy  addr.URL
+	Proxy  []addr.URL
 	Routes []router.Route
 
 	Log struct {
 		Level log.Level
 	}
 
-	Timeout time.Duration
+	Auth struct {
+		Users []auth.Credentials
+		File  string
+	}
+
+	PAC struct {
+		File string
+	}
+
+	HealthCheck router.HealthCheck
+
+	Limits     server.Limits
+	Throttling server.Throttling
+
+	Metrics struct {
+		Listen string
+	}
+
+	Admin struct {
+		Listen string
+		Token  string
+	}
+
+	Timeout struct {
+		Dial      time.Duration
+		Handshake time.Duration
+		Idle      time.Duration
+		Drain     time.Duration
+	}
 }
 
 type rawConfig struct {
-	Server proxyURLValue `mapstructure:"server"`
+	Servers []serverURLValue `mapstructure:"server"`
 
-	Proxy  proxyURLValue `mapstructure:"proxy"`
+	Proxy  []proxyURLValue `mapstructure:"proxy"`
 	Routes []struct {
-		Hosts []string      `mapstructure:"hosts"`
-		Proxy proxyURLValue `mapstructure:"proxy"`
+		Hosts     []string          `mapstructure:"hosts"`
+		Proxy     []proxyURLValue   `mapstructure:"proxy"`
+		Upstreams [][]proxyURLValue `mapstructure:"upstreams"`
+		Strategy  router.Strategy   `mapstructure:"strategy"`
+		Action    router.Action     `mapstructure:"action"`
+		Bandwidth rawBandwidth      `mapstructure:"bandwidth"`
+
+		// Handshakes happen before a route is selected, so only the other timeouts can be overridden
+		Timeout struct {
+			Dial time.Duration `mapstructure:"dial"`
+			Idle time.Duration `mapstructure:"idle"`
+		} `mapstructure:"timeout"`
 	} `mapstructure:"routes"`
 
 	Log struct {
 		Level logLevelValue `mapstructure:"level"`
 	} `mapstructure:"log"`
 
-	Timeout time.Duration `mapstructure:"timeout"`
+	Auth struct {
+		Users []struct {
+			Username string `mapstructure:"username"`
+			Password string `mapstructure:"password"`
+		} `mapstructure:"users"`
+		File string `mapstructure:"file"`
+	} `mapstructure:"auth"`
+
+	PAC struct {
+		File string `mapstructure:"file"`
+	} `mapstructure:"pac"`
+
+	Health struct {
+		Probe          addr.Addr     `mapstructure:"probe"`
+		Interval       time.Duration `mapstructure:"interval"`
+		Timeout        time.Duration `mapstructure:"timeout"`
+		Rise           int           `mapstructure:"rise"`
+		Fall           int           `mapstructure:"fall"`
+		FallbackDirect bool          `mapstructure:"fallback-direct"`
+	} `mapstructure:"health"`
+
+	Limit struct {
+		Conns      int     `mapstructure:"conns"`
+		ConnsPerIP int     `mapstructure:"conns-per-ip"`
+		Rate       float64 `mapstructure:"rate"`
+		RatePerIP  float64 `mapstructure:"rate-per-ip"`
+	} `mapstructure:"limit"`
+
+	Bandwidth struct {
+		rawBandwidth `mapstructure:",squash"`
+		PerIP        rawBandwidth `mapstructure:"per-ip"`
+		PerUser      rawBandwidth `mapstructure:"per-user"`
+	} `mapstructure:"bandwidth"`
+
+	Metrics struct {
+		Listen string `mapstructure:"listen"`
+	} `mapstructure:"metrics"`
+
+	Admin struct {
+		Listen string `mapstructure:"listen"`
+		Token  string `mapstructure:"token"`
+	} `mapstructure:"admin"`
+
+	Timeout struct {
+		Dial      time.Duration `mapstructure:"dial"`
+		Handshake time.Duration `mapstructure:"handshake"`
+		Idle      time.Duration `mapstructure:"idle"`
+		Drain     time.Duration `mapstructure:"drain"`
+	} `mapstructure:"timeout"`
+
+	Watch bool `mapstructure:"watch"`
+
+	file     string
+	warnings []string
 }
 
 func (c *rawConfig) ToConfig() *Config {
 	var config Config
 
-	config.Server = addr.URL(c.Server)
-	config.Proxy = addr.URL(c.Proxy)
+	for _, v := range c.Servers {
+		config.Servers = append(config.Servers, addr.URL(v))
+	}
+	config.Proxy = toURLs(c.Proxy)
 	config.Log.Level = log.Level(c.Log.Level)
-	config.Timeout = c.Timeout
+	config.Timeout.Dial = c.Timeout.Dial
+	config.Timeout.Handshake = c.Timeout.Handshake
+	config.Timeout.Idle = c.Timeout.Idle
+	config.Timeout.Drain = c.Timeout.Drain
+	config.File = c.file
+	config.Warnings = c.warnings
+	config.Watch = c.Watch
+	config.Auth.File = c.Auth.File
+	config.PAC.File = c.PAC.File
+	config.Metrics.Listen = c.Metrics.Listen
+	config.Admin.Listen = c.Admin.Listen
+	config.Admin.Token = c.Admin.Token
+	config.Limits = server.Limits{
+		MaxConns:      c.Limit.Conns,
+		MaxConnsPerIP: c.Limit.ConnsPerIP,
+		Rate:          c.Limit.Rate,
+		RatePerIP:     c.Limit.RatePerIP,
+	}
+	config.Throttling = server.Throttling{
+		Global:  c.Bandwidth.toBandwidth(),
+		PerIP:   c.Bandwidth.PerIP.toBandwidth(),
+		PerUser: c.Bandwidth.PerUser.toBandwidth(),
+	}
+
+	// Health checks are only enabled with a probe address
+	if h := c.Health; h.Probe != (addr.Addr{}) {
+		config.HealthCheck = router.HealthCheck{
+			Probe:          &h.Probe,
+			Interval:       h.Interval,
+			Timeout:        h.Timeout,
+			Rise:           h.Rise,
+			Fall:           h.Fall,
+			FallbackDirect: h.FallbackDirect,
+		}
+	}
+
+	for _, u := range c.Auth.Users {
+		config.Auth.Users = append(config.Auth.Users, auth.Credentials{
+			Username: u.Username,
+			Password: u.Password,
+		})
+	}
 
 	for _, r := range c.Routes {
 		route := router.Route{
-			Hosts: r.Hosts,
-			Proxy: addr.URL(r.Proxy),
+			Hosts:    r.Hosts,
+			Proxy:    toURLs(r.Proxy),
+			Strategy: r.Strategy,
+			Action:   r.Action,
+
+			DialTimeout: r.Timeout.Dial,
+			IdleTimeout: r.Timeout.Idle,
+
+			Bandwidth: r.Bandwidth.toBandwidth(),
+		}
+		for _, u := range r.Upstreams {
+			route.Upstreams = append(route.Upstreams, toURLs(u))
 		}
 		config.Routes = append(config.Routes, route)
 	}
 
+	if patterns := router.ExactHostPatterns(config.Routes); len(patterns) != 0 {
+		config.Warnings = append(config.Warnings, fmt.Sprintf(
+			"Host patterns no longer match hosts containing them, so '%v' only match the exact hosts, use patterns like '.example.com' or '/example/' for others",
+			strings.Join(patterns, "', '"),
+		))
+	}
+
 	return &config
 }
 
+type rawBandwidth struct {
+	Upload        int `mapstructure:"upload"`
+	Download      int `mapstructure:"download"`
+	UploadBurst   int `mapstructure:"upload-burst"`
+	DownloadBurst int `mapstructure:"download-burst"`
+}
+
+func (b *rawBandwidth) toBandwidth() proxy.Bandwidth {
+	return proxy.Bandwidth{
+		Upload:        b.Upload,
+		Download:      b.Download,
+		UploadBurst:   b.UploadBurst,
+		DownloadBurst: b.DownloadBurst,
+	}
+}
+
+func toURLs(values []proxyURLValue) []addr.URL {
+	var urls []addr.URL
+	for _, v := range values {
+		urls = append(urls, addr.URL(v))
+	}
+	return urls
+}
+
 type proxyURLValue addr.URL
 
 func (v *proxyURLValue) Set(s string) error {
-	u, err := addr.ParseURL(s, defProxyProto)
+	u, err := parseProxyURL(s)
 	if err != nil {
 		return err
 	}
@@ -178,18 +514,87 @@ func (v *proxyURLValue) Set(s string) error {
 	return nil
 }
 
+// parseProxyURL parses the URL of an upstream proxy, which, unlike servers, cannot detect the protocol to use.
+func parseProxyURL(s string) (*addr.URL, error) {
+	u, err := addr.ParseURL(s, defProxyProto)
+	if err != nil {
+		return nil, err
+	}
+	if u.Proto == addr.ProtoAuto {
+		return nil, fmt.Errorf("protocol %v is only supported by servers", u.Proto)
+	}
+	return u, nil
+}
+
 func (v *proxyURLValue) UnmarshalText(text []byte) error {
 	return v.Set(string(text))
 }
 
 func (v *proxyURLValue) String() string {
-	return (*addr.URL)(v).String()
+	// Flag values are parsed again by viper, so keep the credentials intact
+	return (*addr.URL)(v).StringWithPassword()
 }
 
 func (v *proxyURLValue) Type() string {
 	return ""
 }
 
+type serverURLValue addr.URL
+
+func (v *serverURLValue) UnmarshalText(text []byte) error {
+	u, err := addr.ParseURL(string(text), defProxyProto)
+	if err != nil {
+		return err
+	}
+	*v = serverURLValue(*u)
+	return nil
+}
+
+// proxyURLListValue collects URLs from a repeated flag, with the first use replacing the default value.
+type proxyURLListValue struct {
+	urls    []addr.URL
+	changed bool
+
+	// server allows the URLs of servers, which can detect the protocol
+	server bool
+}
+
+func (v *proxyURLListValue) Set(s string) error {
+	if !v.changed {
+		v.urls = nil
+		v.changed = true
+	}
+
+	parse := parseProxyURL
+	if v.server {
+		parse = func(s string) (*addr.URL, error) {
+			return addr.ParseURL(s, defProxyProto)
+		}
+	}
+
+	for _, rawURL := range strings.Split(s, ",") {
+		u, err := parse(rawURL)
+		if err != nil {
+			return err
+		}
+		v.urls = append(v.urls, *u)
+	}
+	return nil
+}
+
+func (v *proxyURLListValue) String() string {
+	urls := make([]string, len(v.urls))
+	for i := range v.urls {
+		urls[i] = v.urls[i].StringWithPassword()
+	}
+	return "[" + strings.Join(urls, ",") + "]"
+}
+
+func (v *proxyURLListValue) Type() string {
+	// Make viper treat the value as a list
+	return "stringSlice"
+}
+
 type logLevelValue log.Level
 
 func (v *logLevelValue) Set(s string) error {
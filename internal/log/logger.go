@@ -4,6 +4,7 @@ import (
 	"io"
 	"os"
 	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -18,7 +19,7 @@ func New(ops ...Option) *Logger {
 		WithLevel(LevelInfo),
 	}
 
-	l := Logger{zerolog.New(nil).
+	l := Logger{log: zerolog.New(nil).
 		With().Timestamp().Logger(),
 	}
 	for _, op := range slices.Concat(defaults, ops) {
@@ -29,7 +30,7 @@ func New(ops ...Option) *Logger {
 
 func WithLevel(level Level) Option {
 	return func(l *Logger) {
-		l.log = l.log.Level(makeZerologLevel(level))
+		l.SetLevel(level)
 	}
 }
 
@@ -56,7 +57,13 @@ func isTerminal(w io.Writer) bool {
 type Option func(*Logger)
 
 type Logger struct {
-	log zerolog.Logger
+	log   zerolog.Logger
+	level atomic.Int32
+}
+
+// SetLevel changes the level of the logger, which is safe to do while it is in use.
+func (l *Logger) SetLevel(level Level) {
+	l.level.Store(int32(makeZerologLevel(level)))
 }
 
 func (l *Logger) Error(msg string, fields ...any) {
@@ -68,7 +75,12 @@ func (l *Logger) Info(msg string, fields ...any) {
 }
 
 func (l *Logger) logEntry(level Level, msg string, fields []any) {
-	entry := l.log.WithLevel(makeZerologLevel(level))
+	zerologLevel := makeZerologLevel(level)
+	if zerologLevel < zerolog.Level(l.level.Load()) {
+		return
+	}
+
+	entry := l.log.WithLevel(zerologLevel)
 	entry.Fields(fields).
 		Msg(msg)
 }
@@ -43,6 +43,18 @@ func (t *LoggerTest) TestLog() {
 		got := encodeLog(log.LevelSilent, log.LevelInfo)
 		t.Equal("", got)
 	})
+
+	t.Run("level changes apply to subsequent messages", func() {
+		var buf bytes.Buffer
+		l := log.New(log.WithLevel(log.LevelInfo), log.WithWriter(&buf))
+
+		l.SetLevel(log.LevelError)
+		l.Info("hidden message")
+		l.Error("shown message")
+
+		t.NotContains(buf.String(), "hidden message")
+		t.Contains(buf.String(), "shown message")
+	})
 }
 
 func encodeLog(logLevel, msgLevel log.Level) string {
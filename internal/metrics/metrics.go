@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "socks2http"
+
+// New creates [Metrics] registered with a registry of their own, along with the Go runtime and process metrics.
+func New() *Metrics {
+	m := Metrics{
+		registry: prometheus.NewRegistry(),
+
+		connsAccepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_accepted_total",
+			Help:      "Client connections accepted, by listener address and protocol.",
+		}, []string{"listener", "proto"}),
+
+		handshakeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handshake_failures_total",
+			Help:      "Clients that failed to make a request, by protocol and reason.",
+		}, []string{"proto", "reason"}),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Replies sent to client requests, by protocol and SOCKS or HTTP status.",
+		}, []string{"proto", "status"}),
+
+		tunnelsActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "tunnels_active",
+			Help:      "Tunnels currently open, by protocol.",
+		}, []string{"proto"}),
+
+		tunnelsClosed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tunnels_closed_total",
+			Help:      "Tunnels closed, by protocol and close reason.",
+		}, []string{"proto", "reason"}),
+
+		tunnelBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tunnel_bytes_total",
+			Help:      "Bytes transferred through tunnels and forwarded HTTP requests, by protocol and direction as seen by clients.",
+		}, []string{"proto", "direction"}),
+
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "dial_duration_seconds",
+			Help:      "Time spent connecting to destinations, by route, upstream and result.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "upstream", "result"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.connsAccepted,
+		m.handshakeFailures,
+		m.requests,
+		m.tunnelsActive,
+		m.tunnelsClosed,
+		m.tunnelBytes,
+		m.dialDuration,
+	)
+	return &m
+}
+
+// Metrics implements [proxy.Metrics] with Prometheus collectors.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	connsAccepted     *prometheus.CounterVec
+	handshakeFailures *prometheus.CounterVec
+	requests          *prometheus.CounterVec
+	tunnelsActive     *prometheus.GaugeVec
+	tunnelsClosed     *prometheus.CounterVec
+	tunnelBytes       *prometheus.CounterVec
+	dialDuration      *prometheus.HistogramVec
+}
+
+func (m *Metrics) ConnAccepted(listener string, proto addr.Proto) {
+	m.connsAccepted.WithLabelValues(listener, proto.String()).Inc()
+}
+
+func (m *Metrics) HandshakeFailed(proto addr.Proto, reason string) {
+	m.handshakeFailures.WithLabelValues(proto.String(), reason).Inc()
+}
+
+func (m *Metrics) RequestServed(proto addr.Proto, status string) {
+	m.requests.WithLabelValues(proto.String(), status).Inc()
+}
+
+func (m *Metrics) TunnelOpened(proto addr.Proto) {
+	m.tunnelsActive.WithLabelValues(proto.String()).Inc()
+}
+
+func (m *Metrics) TunnelClosed(proto addr.Proto, stats *proxy.TunnelStats) {
+	m.tunnelsActive.WithLabelValues(proto.String()).Dec()
+	m.tunnelsClosed.WithLabelValues(proto.String(), stats.CloseReason.String()).Inc()
+}
+
+func (m *Metrics) TunnelTransferred(proto addr.Proto, sent, received int64) {
+	if sent > 0 {
+		m.tunnelBytes.WithLabelValues(proto.String(), "sent").Add(float64(sent))
+	}
+	if received > 0 {
+		m.tunnelBytes.WithLabelValues(proto.String(), "received").Add(float64(received))
+	}
+}
+
+func (m *Metrics) DialDone(route, upstream string, d time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.dialDuration.WithLabelValues(route, upstream, result).Observe(d.Seconds())
+}
+
+// Handler serves the collected metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Serve exposes the metrics at /metrics on the listener until the context is canceled.
+func (m *Metrics) Serve(ctx context.Context, l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	server := http.Server{Handler: mux}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Serve(l)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return server.Close()
+	case err := <-errChan:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	}
+}
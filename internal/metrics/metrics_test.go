@@ -0,0 +1,98 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/metrics"
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestMetrics(t *testing.T) {
+	suite.Run(t, new(MetricsTest))
+}
+
+type MetricsTest struct {
+	suite.Suite
+}
+
+func (t *MetricsTest) TestHandler() {
+	t.Run("exposes collected metrics in text format", func() {
+		m := metrics.New()
+		m.ConnAccepted("127.0.0.1:1080", addr.ProtoSOCKS)
+		m.HandshakeFailed(addr.ProtoHTTP, "auth")
+		m.RequestServed(addr.ProtoHTTP, "200")
+		m.TunnelOpened(addr.ProtoSOCKS5)
+		m.TunnelOpened(addr.ProtoSOCKS5)
+		m.TunnelTransferred(addr.ProtoSOCKS5, 7, 0)
+		m.TunnelTransferred(addr.ProtoSOCKS5, 0, 13)
+		m.TunnelClosed(addr.ProtoSOCKS5, &proxy.TunnelStats{
+			BytesSent:     7,
+			BytesReceived: 13,
+			CloseReason:   proxy.CloseReasonIdle,
+		})
+		m.DialDone("route 1", "DIRECT", 50*time.Millisecond, nil)
+		m.DialDone("route 1", "DIRECT", time.Second, errors.New("refused"))
+
+		got := t.scrape(m)
+
+		t.Contains(got, `socks2http_connections_accepted_total{listener="127.0.0.1:1080",proto="SOCKS"} 1`)
+		t.Contains(got, `socks2http_handshake_failures_total{proto="HTTP",reason="auth"} 1`)
+		t.Contains(got, `socks2http_requests_total{proto="HTTP",status="200"} 1`)
+		t.Contains(got, `socks2http_tunnels_active{proto="SOCKS5"} 1`)
+		t.Contains(got, `socks2http_tunnels_closed_total{proto="SOCKS5",reason="idle-timeout"} 1`)
+		t.Contains(got, `socks2http_tunnel_bytes_total{direction="sent",proto="SOCKS5"} 7`)
+		t.Contains(got, `socks2http_tunnel_bytes_total{direction="received",proto="SOCKS5"} 13`)
+		t.Contains(got, `socks2http_dial_duration_seconds_count{result="ok",route="route 1",upstream="DIRECT"} 1`)
+		t.Contains(got, `socks2http_dial_duration_seconds_count{result="error",route="route 1",upstream="DIRECT"} 1`)
+	})
+
+	t.Run("exposes runtime metrics", func() {
+		got := t.scrape(metrics.New())
+		t.Contains(got, "go_goroutines")
+	})
+}
+
+func (t *MetricsTest) TestServe() {
+	t.Run("serves metrics until the context is canceled", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		t.Require().NoError(err)
+		address := l.Addr().String()
+
+		serveErr := make(chan error, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			serveErr <- metrics.New().Serve(ctx, l)
+		}()
+
+		t.Eventually(func() bool {
+			resp, err := http.Get("http://" + address + "/metrics")
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			return resp.StatusCode == http.StatusOK
+		}, time.Second, 10*time.Millisecond)
+
+		cancel()
+		t.NoError(<-serveErr)
+	})
+}
+
+func (t *MetricsTest) scrape(m *metrics.Metrics) string {
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	t.Require().Equal(http.StatusOK, rec.Code)
+
+	body, err := io.ReadAll(rec.Body)
+	t.Require().NoError(err)
+	return string(body)
+}
@@ -14,11 +14,14 @@ const (
 	ProtoSOCKS5h
 
 	ProtoHTTP
+
+	// ProtoAuto detects the protocol of each incoming connection, which only makes sense for servers.
+	ProtoAuto
 )
 
 const (
 	protoMin = ProtoSOCKS
-	protoMax = ProtoHTTP
+	protoMax = ProtoAuto
 )
 
 var protos = []string{
@@ -29,6 +32,8 @@ var protos = []string{
 	ProtoSOCKS5h: "SOCKS5h",
 
 	ProtoHTTP: "HTTP",
+
+	ProtoAuto: "AUTO",
 }
 
 func ParseProto(proto string) (Proto, error) {
@@ -4,16 +4,18 @@ import (
 	"cmp"
 	"errors"
 	"fmt"
+	stdurl "net/url"
 	"regexp"
 	"strings"
 )
 
 var (
 	urlRgx = regexp.MustCompile(fmt.Sprintf(
-		`\A(?:%[1]v:(?://%[2]v)?(?::%[3]v)?|(?:%[2]v)?(?::%[3]v)?)\z`,
-		`(?<SCHEME>[^:]+)`,   // Protocol scheme.
-		`(?<HOSTNAME>[^:]+)`, // Hostname.
-		`(?<PORT>[^:]+)`,     // Port number.
+		`\A(?:%[1]v:(?://(?:%[4]v@)?%[2]v)?(?::%[3]v)?|(?:%[2]v)?(?::%[3]v)?)\z`,
+		`(?<SCHEME>[^:]+)`,                            // Protocol scheme.
+		`(?<HOSTNAME>[^:@]+)`,                         // Hostname.
+		`(?<PORT>[^:]+)`,                              // Port number.
+		`(?<USERNAME>[^:@]*)(?::(?<PASSWORD>[^@]*))?`, // User credentials.
 	))
 	urlDefProto = ProtoHTTP
 )
@@ -36,6 +38,16 @@ func ParseURL(url string, defProto Proto) (*URL, error) {
 		return nil, err
 	}
 
+	username, err := stdurl.PathUnescape(rawURL.Username)
+	if err != nil {
+		return nil, fmt.Errorf("parse username: %w", err)
+	}
+
+	password, err := stdurl.PathUnescape(rawURL.Password)
+	if err != nil {
+		return nil, fmt.Errorf("parse password: %w", err)
+	}
+
 	scheme := strings.ToLower(cmp.Or(rawURL.Scheme, defProto.String()))
 	host := strings.ToLower(rawURL.Host)
 
@@ -53,7 +65,11 @@ func ParseURL(url string, defProto Proto) (*URL, error) {
 		port = p
 	}
 
-	return NewURL(proto, host, port), nil
+	u := NewURL(proto, host, port)
+	u.Username = username
+	u.Password = password
+
+	return u, nil
 }
 
 func parseRawURL(url string) (*rawURL, error) {
@@ -69,15 +85,17 @@ func parseRawURL(url string) (*rawURL, error) {
 	}
 
 	return &rawURL{
-		Scheme: submatches["SCHEME"],
-		Host:   submatches["HOSTNAME"],
-		Port:   submatches["PORT"],
+		Scheme:   submatches["SCHEME"],
+		Username: submatches["USERNAME"],
+		Password: submatches["PASSWORD"],
+		Host:     submatches["HOSTNAME"],
+		Port:     submatches["PORT"],
 	}, nil
 }
 
 func defaultPortForProto(p Proto) uint16 {
 	switch p {
-	case ProtoSOCKS, ProtoSOCKS4, ProtoSOCKS4a, ProtoSOCKS5, ProtoSOCKS5h:
+	case ProtoSOCKS, ProtoSOCKS4, ProtoSOCKS4a, ProtoSOCKS5, ProtoSOCKS5h, ProtoAuto:
 		return 1080
 	case ProtoHTTP:
 		return 80
@@ -89,6 +107,9 @@ func defaultPortForProto(p Proto) uint16 {
 type URL struct {
 	Proto Proto
 
+	Username string
+	Password string
+
 	Host string
 	Port uint16
 }
@@ -98,27 +119,50 @@ func (u *URL) Addr() *Addr {
 }
 
 func (u *URL) IsZero() bool {
-	return u.Proto == 0 && u.Host == "" && u.Port == 0
+	return u.Proto == 0 && u.Host == "" && u.Port == 0 && !u.HasCredentials()
 }
 
+func (u *URL) HasCredentials() bool {
+	return u.Username != "" || u.Password != ""
+}
+
+// String returns the URL as text, replacing the password, if any, with a placeholder to keep it out of logs.
 func (u *URL) String() string {
+	return u.format("xxxxx")
+}
+
+// StringWithPassword returns the URL as text, including the password.
+func (u *URL) StringWithPassword() string {
+	return u.format(u.Password)
+}
+
+func (u *URL) format(password string) string {
 	if u.IsZero() {
 		return ""
 	}
 
 	scheme := fmt.Sprintf("%v:", u.Proto)
-	host := u.Host
+	host := strings.ToLower(u.Host)
 	port := fmt.Sprintf(":%v", u.Port)
 
+	if u.HasCredentials() {
+		userInfo := stdurl.User(u.Username)
+		if u.Password != "" {
+			userInfo = stdurl.UserPassword(u.Username, password)
+		}
+		host = fmt.Sprintf("%v@%v", userInfo, host)
+	}
+
 	if host != "" {
 		host = fmt.Sprintf("//%v", host)
 	}
 
-	return strings.ToLower(scheme) + strings.ToLower(host) + port
+	return strings.ToLower(scheme) + host + port
 }
 
+// MarshalText keeps the password, so that the URL can be parsed back, and must not be used for logging.
 func (u *URL) MarshalText() ([]byte, error) {
-	return []byte(u.String()), nil
+	return []byte(u.StringWithPassword()), nil
 }
 
 func (u *URL) UnmarshalText(text []byte) error {
@@ -131,7 +175,9 @@ func (u *URL) UnmarshalText(text []byte) error {
 }
 
 type rawURL struct {
-	Scheme string
-	Host   string
-	Port   string
+	Scheme   string
+	Username string
+	Password string
+	Host     string
+	Port     string
 }
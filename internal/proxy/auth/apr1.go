@@ -0,0 +1,67 @@
+package auth
+
+import "crypto/md5"
+
+const (
+	apr1Magic = "$apr1$"
+	apr1Chars = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// apr1Hash implements the Apache variant of the MD5-based crypt algorithm used by htpasswd.
+func apr1Hash(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(password + salt + password))
+
+	ctx := []byte(password + apr1Magic + salt)
+	for n := len(password); n > 0; n -= 16 {
+		ctx = append(ctx, alt[:min(n, 16)]...)
+	}
+	for n := len(password); n != 0; n >>= 1 {
+		if n&1 != 0 {
+			ctx = append(ctx, 0)
+		} else {
+			ctx = append(ctx, password[0])
+		}
+	}
+	sum := md5.Sum(ctx)
+
+	// Slow down brute-force attacks by rehashing the result multiple times
+	for i := range 1000 {
+		var round []byte
+		if i&1 != 0 {
+			round = append(round, password...)
+		} else {
+			round = append(round, sum[:]...)
+		}
+		if i%3 != 0 {
+			round = append(round, salt...)
+		}
+		if i%7 != 0 {
+			round = append(round, password...)
+		}
+		if i&1 != 0 {
+			round = append(round, sum[:]...)
+		} else {
+			round = append(round, password...)
+		}
+		sum = md5.Sum(round)
+	}
+
+	hash := []byte(apr1Magic + salt + "$")
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		v := uint(sum[g[0]])<<16 | uint(sum[g[1]])<<8 | uint(sum[g[2]])
+		hash = apr1Encode(hash, v, 4)
+	}
+	return string(apr1Encode(hash, uint(sum[11]), 2))
+}
+
+func apr1Encode(b []byte, v uint, n int) []byte {
+	for range n {
+		b = append(b, apr1Chars[v&0x3f])
+		v >>= 6
+	}
+	return b
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// NewStore creates a new [Store] with the specified users.
+func NewStore(creds ...Credentials) *Store {
+	s := Store{users: make(map[string]password)}
+	for _, c := range creds {
+		s.Add(c.Username, c.Password)
+	}
+	return &s
+}
+
+// Credentials identify a single user.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Store keeps a list of users allowed to access the proxy.
+type Store struct {
+	mu    sync.RWMutex
+	users map[string]password
+}
+
+// password is either a plain text password or a hash as it appears in htpasswd files.
+type password struct {
+	format passwordFormat
+	value  string
+}
+
+type passwordFormat int
+
+const (
+	formatPlain passwordFormat = iota
+	formatBcrypt
+	formatAPR1
+	formatSHA1
+)
+
+// Add adds a user with a plain text password, replacing the existing user with the same name.
+func (s *Store) Add(username, pass string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[username] = password{formatPlain, pass}
+}
+
+// Replace replaces all users with the users of another store, so that servers using the store see the change at once.
+func (s *Store) Replace(other *Store) {
+	other.mu.RLock()
+	users := maps.Clone(other.users)
+	other.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+}
+
+// LoadFile loads users from an htpasswd-style file.
+func (s *Store) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := s.Load(f); err != nil {
+		return fmt.Errorf("load %v: %w", path, err)
+	}
+	return nil
+}
+
+// Load loads users from htpasswd-style input.
+//
+// Each non-empty line that is not a comment contains a username and a password hash separated by a colon.
+// Passwords must be hashed with bcrypt, Apache MD5 or SHA-1.
+// If the input is malformed, no users are added.
+func (s *Store) Load(r io.Reader) error {
+	users := make(map[string]password)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return fmt.Errorf("line %v: expected a username and a password separated by a colon", lineNum)
+		}
+
+		format, ok := hashFormat(hash)
+		if !ok {
+			return fmt.Errorf("line %v: unsupported password hash format for user %q", lineNum, username)
+		}
+		users[username] = password{format, hash}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	maps.Copy(s.users, users)
+	return nil
+}
+
+// Len returns the number of known users.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users)
+}
+
+// Verify checks that the user exists and the password is correct.
+func (s *Store) Verify(username, pass string) bool {
+	s.mu.RLock()
+	p, ok := s.users[username]
+	s.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	return p.verify(pass)
+}
+
+// hashFormat recognizes the format of a password hash, with plain text passwords not being recognized.
+func hashFormat(hash string) (passwordFormat, bool) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return formatBcrypt, true
+	case strings.HasPrefix(hash, apr1Magic):
+		return formatAPR1, true
+	case strings.HasPrefix(hash, "{SHA}"):
+		return formatSHA1, true
+	default:
+		return 0, false
+	}
+}
+
+func (p *password) verify(pass string) bool {
+	switch p.format {
+	case formatBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(p.value), []byte(pass)) == nil
+	case formatAPR1:
+		salt, _, _ := strings.Cut(strings.TrimPrefix(p.value, apr1Magic), "$")
+		return secureCompare(p.value, apr1Hash(pass, salt))
+	case formatSHA1:
+		sum := sha1.Sum([]byte(pass))
+		return secureCompare(p.value, "{SHA}"+base64.StdEncoding.EncodeToString(sum[:]))
+	default:
+		return secureCompare(p.value, pass)
+	}
+}
+
+func secureCompare(s1, s2 string) bool {
+	return subtle.ConstantTimeCompare([]byte(s1), []byte(s2)) == 1
+}
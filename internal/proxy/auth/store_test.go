@@ -0,0 +1,132 @@
+package auth_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cerfical/socks2http/internal/proxy/auth"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestStore(t *testing.T) {
+	suite.Run(t, new(StoreTest))
+}
+
+type StoreTest struct {
+	suite.Suite
+}
+
+func (t *StoreTest) TestVerify() {
+	t.Run("accepts valid credentials", func() {
+		store := auth.NewStore(auth.Credentials{Username: "root", Password: "secret"})
+		t.True(store.Verify("root", "secret"))
+	})
+
+	t.Run("rejects invalid password", func() {
+		store := auth.NewStore(auth.Credentials{Username: "root", Password: "secret"})
+		t.False(store.Verify("root", "Secret"))
+	})
+
+	t.Run("rejects unknown user", func() {
+		store := auth.NewStore(auth.Credentials{Username: "root", Password: "secret"})
+		t.False(store.Verify("admin", "secret"))
+	})
+
+	t.Run("treats passwords added in plain text as such", func() {
+		hash := "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+		store := auth.NewStore(auth.Credentials{Username: "root", Password: hash})
+
+		t.True(store.Verify("root", hash))
+		t.False(store.Verify("root", "secret"))
+	})
+}
+
+func (t *StoreTest) TestLoad() {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	t.Require().NoError(err)
+
+	tests := map[string]struct {
+		hash     string
+		password string
+	}{
+		"bcrypt":           {string(bcryptHash), "secret"},
+		"Apache MD5":       {"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "secret"},
+		"short-salted MD5": {"$apr1$Xy$Cb3UtmCrc5h7N4NNYs3Tx/", "secret2"},
+		"SHA-1":            {"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret"},
+	}
+
+	for name, test := range tests {
+		t.Run(fmt.Sprintf("supports %v passwords", name), func() {
+			store := auth.NewStore()
+			t.Require().NoError(store.Load(strings.NewReader("root:" + test.hash)))
+
+			t.True(store.Verify("root", test.password))
+			t.False(store.Verify("root", "wrong"))
+		})
+	}
+
+	unsupported := map[string]string{
+		"plain text":      "secret",
+		"DES":             "rqXexS6ZhobKA",
+		"SHA-256":         "$5$rounds=5000$salt$Gbr4XSHn3E1VgBbCEYY7OsAJe8QiGNU8H9dOQeqqGwB",
+		"SHA-512":         "$6$salt$IxDD3jeSOb5eB1CX5LBsqZFVkJdido3OUILO5Ifz5iwMuTS4XMS130MTSuDDl3aCI6WouIL9AjRbLCelDCy.g.",
+		"bcrypt with $2x": "$2x$10$abcdefghijklmnopqrstuu5Jb3hM8Xb6Xo9ZkRZp8GZkZ5m0uR4yC",
+	}
+
+	for name, hash := range unsupported {
+		t.Run(fmt.Sprintf("rejects %v passwords", name), func() {
+			store := auth.NewStore()
+			t.Require().Error(store.Load(strings.NewReader("root:" + hash)))
+		})
+	}
+
+	t.Run("skips comments and empty lines", func() {
+		store := auth.NewStore()
+		t.Require().NoError(store.Load(strings.NewReader("# comment\n\nroot:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")))
+
+		t.Equal(1, store.Len())
+	})
+
+	t.Run("rejects malformed lines", func() {
+		store := auth.NewStore()
+		t.Require().Error(store.Load(strings.NewReader("root")))
+	})
+
+	t.Run("adds no users from malformed input", func() {
+		store := auth.NewStore()
+		t.Require().Error(store.Load(strings.NewReader("root:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nadmin")))
+
+		t.Equal(0, store.Len())
+	})
+}
+
+func (t *StoreTest) TestReplace() {
+	t.Run("replaces all users", func() {
+		store := auth.NewStore(auth.Credentials{Username: "root", Password: "secret"})
+		store.Replace(auth.NewStore(auth.Credentials{Username: "admin", Password: "secret"}))
+
+		t.False(store.Verify("root", "secret"))
+		t.True(store.Verify("admin", "secret"))
+	})
+}
+
+func (t *StoreTest) TestLoadFile() {
+	t.Run("loads users from file", func() {
+		path := filepath.Join(t.T().TempDir(), "htpasswd")
+		t.Require().NoError(os.WriteFile(path, []byte("root:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0o600))
+
+		store := auth.NewStore()
+		t.Require().NoError(store.LoadFile(path))
+
+		t.True(store.Verify("root", "secret"))
+	})
+
+	t.Run("reports missing file", func() {
+		store := auth.NewStore()
+		t.Require().Error(store.LoadFile(filepath.Join(t.T().TempDir(), "missing")))
+	})
+}
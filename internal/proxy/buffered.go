@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+)
+
+// WithBufferedReader makes reads from the connection go through a reader that has some of its data already buffered.
+func WithBufferedReader(conn net.Conn, r *bufio.Reader) net.Conn {
+	return &bufferedConn{conn, r}
+}
+
+// bufferedConn has no NetConn method, as reading from the underlying connection directly would skip the buffered data.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
@@ -2,18 +2,24 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"slices"
+	"time"
 
 	"github.com/cerfical/socks2http/internal/proxy"
 	"github.com/cerfical/socks2http/internal/proxy/addr"
 	"github.com/cerfical/socks2http/internal/proxy/socks"
 )
 
+// ErrConnRejected is returned when the proxy refuses to connect to the destination.
+var ErrConnRejected = errors.New("connection rejected")
+
 func New(ops ...Option) *Client {
 	defaults := []Option{
 		WithDialer(proxy.DirectDialer),
+		WithPacketDialer(proxy.DirectPacketDialer),
 	}
 
 	var c Client
@@ -25,7 +31,19 @@ func New(ops ...Option) *Client {
 
 func WithProxyURL(u *addr.URL) Option {
 	return func(c *Client) {
-		c.proxyURL = *u
+		c.proxyChain = nil
+		if !u.IsZero() {
+			c.proxyChain = []addr.URL{*u}
+		}
+	}
+}
+
+// WithProxyChain makes the client connect through each of the proxies in turn, with the last one connecting to destination.
+func WithProxyChain(chain []addr.URL) Option {
+	return func(c *Client) {
+		c.proxyChain = slices.DeleteFunc(slices.Clone(chain), func(u addr.URL) bool {
+			return u.IsZero()
+		})
 	}
 }
 
@@ -35,45 +53,223 @@ func WithDialer(d proxy.Dialer) Option {
 	}
 }
 
+func WithPacketDialer(d proxy.PacketDialer) Option {
+	return func(c *Client) {
+		c.packetDialer = d
+	}
+}
+
 type Option func(*Client)
 
 type Client struct {
-	proxyURL addr.URL
-	dialer   proxy.Dialer
+	proxyChain   []addr.URL
+	dialer       proxy.Dialer
+	packetDialer proxy.PacketDialer
 }
 
 func (c *Client) Dial(ctx context.Context, dstAddr *addr.Addr) (net.Conn, error) {
 	// Connect to destination directly if no proxy is used
-	if c.proxyURL.IsZero() {
+	if len(c.proxyChain) == 0 {
 		return c.dialer.Dial(ctx, dstAddr)
 	}
 
-	// Connect to the proxy
-	proxyConn, err := c.dialer.Dial(ctx, c.proxyURL.Addr())
+	proxyConn, err := c.dialChain(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("dial proxy: %w", err)
+		return nil, err
 	}
 
-	// Connect the proxy to destination
-	if err := c.connect(proxyConn, dstAddr); err != nil {
+	// Connect the last proxy to destination
+	if err := c.connect(proxyConn, c.lastHop(), dstAddr); err != nil {
 		proxyConn.Close()
+		return nil, c.hopError(len(c.proxyChain)-1, err)
+	}
+	proxyConn.SetDeadline(time.Time{})
+	return proxyConn, nil
+}
+
+// DialPacket opens a packet connection, which is relayed through the proxies if they support UDP.
+//
+// With a chain of proxies, datagrams pass through the relays of each of them in turn.
+func (c *Client) DialPacket(ctx context.Context) (proxy.PacketConn, error) {
+	// Send datagrams directly if no proxy is used
+	if len(c.proxyChain) == 0 {
+		return c.packetDialer.DialPacket(ctx)
+	}
+
+	for i := range c.proxyChain {
+		if proto := c.proxyChain[i].Proto; proto != addr.ProtoSOCKS5 && proto != addr.ProtoSOCKS5h {
+			return nil, c.hopError(i, fmt.Errorf("UDP is not supported by protocol: %v", proto))
+		}
+	}
+
+	transport, err := c.packetDialer.DialPacket(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("open packet connection: %w", err)
+	}
+
+	// Datagrams to each relay are sent through the relays of the previous proxies
+	for i := range c.proxyChain {
+		conn, err := c.associate(ctx, i, transport)
+		if err != nil {
+			transport.Close()
+			return nil, err
+		}
+		transport = conn
+	}
+	return transport, nil
+}
+
+// associate asks the i-th proxy in the chain to relay datagrams, which are exchanged with the relay via transport.
+func (c *Client) associate(ctx context.Context, i int, transport proxy.PacketConn) (proxy.PacketConn, error) {
+	proxyConn, err := c.dialHops(ctx, i)
+	if err != nil {
 		return nil, err
 	}
+
+	proxyURL := &c.proxyChain[i]
+	if i > 0 {
+		// The relay address may be reported relative to the proxy, rather than to the first one in the chain
+		proxyConn = &hopConn{proxyConn, proxyURL.Addr()}
+	}
+
+	socksCli := SOCKSClient{
+		Version:      socks.V5,
+		ResolveNames: proxyURL.Proto == addr.ProtoSOCKS5,
+		Username:     proxyURL.Username,
+		Password:     proxyURL.Password,
+	}
+
+	conn, err := socksCli.Associate(proxyConn, transport)
+	if err != nil {
+		proxyConn.Close()
+		return nil, c.hopError(i, err)
+	}
+	proxyConn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Bind asks the last proxy in the chain to accept a connection from peerAddr, which is only supported by SOCKS proxies.
+func (c *Client) Bind(ctx context.Context, peerAddr *addr.Addr) (*Binding, error) {
+	if len(c.proxyChain) == 0 {
+		return nil, errors.New("BIND requires a proxy")
+	}
+
+	var socksCli SOCKSClient
+	switch proxyURL := c.lastHop(); proxyURL.Proto {
+	case addr.ProtoSOCKS4, addr.ProtoSOCKS4a:
+		socksCli = SOCKSClient{
+			Version:      socks.V4,
+			ResolveNames: proxyURL.Proto == addr.ProtoSOCKS4,
+			Username:     proxyURL.Username,
+		}
+	case addr.ProtoSOCKS5, addr.ProtoSOCKS5h:
+		socksCli = SOCKSClient{
+			Version:      socks.V5,
+			ResolveNames: proxyURL.Proto == addr.ProtoSOCKS5,
+			Username:     proxyURL.Username,
+			Password:     proxyURL.Password,
+		}
+	default:
+		return nil, fmt.Errorf("BIND is not supported by protocol: %v", proxyURL.Proto)
+	}
+
+	proxyConn, err := c.dialChain(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := socksCli.Bind(proxyConn, peerAddr)
+	if err != nil {
+		proxyConn.Close()
+		return nil, c.hopError(len(c.proxyChain)-1, err)
+	}
+	proxyConn.SetDeadline(time.Time{})
+	return b, nil
+}
+
+// dialChain opens a connection to the last proxy in the chain, with each proxy connecting to the next one.
+func (c *Client) dialChain(ctx context.Context) (net.Conn, error) {
+	return c.dialHops(ctx, len(c.proxyChain)-1)
+}
+
+// dialHops opens a connection to the n-th proxy in the chain, through the proxies before it.
+func (c *Client) dialHops(ctx context.Context, n int) (net.Conn, error) {
+	proxyConn, err := c.dialer.Dial(ctx, c.proxyChain[0].Addr())
+	if err != nil {
+		return nil, c.hopError(0, fmt.Errorf("dial proxy: %w", err))
+	}
+	setHandshakeDeadline(ctx, proxyConn)
+
+	for i := 1; i <= n; i++ {
+		if err := c.connect(proxyConn, &c.proxyChain[i-1], c.proxyChain[i].Addr()); err != nil {
+			proxyConn.Close()
+			return nil, c.hopError(i-1, err)
+		}
+	}
 	return proxyConn, nil
 }
 
-func (c *Client) connect(proxyConn net.Conn, dstAddr *addr.Addr) error {
-	switch proto := c.proxyURL.Proto; proto {
+func (c *Client) connect(proxyConn net.Conn, proxyURL *addr.URL, dstAddr *addr.Addr) error {
+	switch proto := proxyURL.Proto; proto {
 	case addr.ProtoSOCKS4, addr.ProtoSOCKS4a:
-		socksCli := SOCKSClient{socks.V4, proto == addr.ProtoSOCKS4}
+		socksCli := SOCKSClient{
+			Version:      socks.V4,
+			ResolveNames: proto == addr.ProtoSOCKS4,
+			Username:     proxyURL.Username,
+		}
 		return socksCli.Connect(proxyConn, dstAddr)
 	case addr.ProtoSOCKS5, addr.ProtoSOCKS5h:
-		socksCli := SOCKSClient{socks.V5, proto == addr.ProtoSOCKS5}
+		socksCli := SOCKSClient{
+			Version:      socks.V5,
+			ResolveNames: proto == addr.ProtoSOCKS5,
+			Username:     proxyURL.Username,
+			Password:     proxyURL.Password,
+		}
 		return socksCli.Connect(proxyConn, dstAddr)
 	case addr.ProtoHTTP:
-		httpCli := HTTPClient{}
+		httpCli := HTTPClient{
+			Username: proxyURL.Username,
+			Password: proxyURL.Password,
+		}
 		return httpCli.Connect(proxyConn, dstAddr)
 	default:
 		return fmt.Errorf("unsupported protocol: %v", proto)
 	}
 }
+
+// setHandshakeDeadline keeps unresponsive proxies from stalling handshakes past the context deadline.
+func setHandshakeDeadline(ctx context.Context, proxyConn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		proxyConn.SetDeadline(deadline)
+	}
+}
+
+func (c *Client) lastHop() *addr.URL {
+	return &c.proxyChain[len(c.proxyChain)-1]
+}
+
+func (c *Client) hopError(i int, err error) error {
+	// Keep the error messages unchanged when only a single proxy is used
+	if len(c.proxyChain) == 1 {
+		return err
+	}
+	return fmt.Errorf("proxy hop %d (%v): %w", i+1, &c.proxyChain[i], err)
+}
+
+// hopConn is a connection to a proxy in the middle of a chain, which reports the address of that proxy as the remote one.
+type hopConn struct {
+	net.Conn
+	hopAddr *addr.Addr
+}
+
+func (c *hopConn) RemoteAddr() net.Addr {
+	return hopAddr{c.hopAddr}
+}
+
+type hopAddr struct {
+	*addr.Addr
+}
+
+func (hopAddr) Network() string {
+	return "tcp"
+}
@@ -2,15 +2,20 @@ package client_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/base64"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/cerfical/socks2http/internal/proxy"
 	"github.com/cerfical/socks2http/internal/proxy/addr"
 	"github.com/cerfical/socks2http/internal/proxy/client"
 	"github.com/cerfical/socks2http/internal/proxy/mocks"
+	"github.com/cerfical/socks2http/internal/proxy/server"
 	"github.com/cerfical/socks2http/internal/proxy/socks"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
@@ -58,6 +63,63 @@ func (t *ClientTest) TestDial_HTTP() {
 	})
 }
 
+func (t *ClientTest) TestDial_HTTPAuth() {
+	dstAddr := addr.NewAddr("localhost", 8080)
+	proxyURL := &addr.URL{
+		Proto:    addr.ProtoHTTP,
+		Username: "root",
+		Password: "secret",
+		Host:     "localhost",
+		Port:     1111,
+	}
+
+	t.Run("sends credentials to proxy", func() {
+		proxyConn, dialErr := t.startDial(proxyURL, dstAddr)
+
+		req, err := http.ReadRequest(bufio.NewReader(proxyConn))
+		t.Require().NoError(err)
+
+		creds := base64.StdEncoding.EncodeToString([]byte("root:secret"))
+		t.Equal("Basic "+creds, req.Header.Get("Proxy-Authorization"))
+
+		resp := httptest.NewRecorder()
+		resp.WriteHeader(http.StatusOK)
+		t.Require().NoError(resp.Result().Write(proxyConn))
+
+		t.NoError(<-dialErr)
+	})
+
+	t.Run("reports 407-Proxy-Authentication-Required", func() {
+		proxyConn, dialErr := t.startDial(proxyURL, dstAddr)
+
+		_, err := http.ReadRequest(bufio.NewReader(proxyConn))
+		t.Require().NoError(err)
+
+		resp := httptest.NewRecorder()
+		resp.WriteHeader(http.StatusProxyAuthRequired)
+		t.Require().NoError(resp.Result().Write(proxyConn))
+
+		err = <-dialErr
+		t.ErrorIs(err, client.ErrProxyAuthRequired)
+		t.NotErrorIs(err, client.ErrConnRejected)
+	})
+
+	t.Run("reports other statuses as rejected connection", func() {
+		proxyConn, dialErr := t.startDial(proxyURL, dstAddr)
+
+		_, err := http.ReadRequest(bufio.NewReader(proxyConn))
+		t.Require().NoError(err)
+
+		resp := httptest.NewRecorder()
+		resp.WriteHeader(http.StatusForbidden)
+		t.Require().NoError(resp.Result().Write(proxyConn))
+
+		err = <-dialErr
+		t.ErrorIs(err, client.ErrConnRejected)
+		t.NotErrorIs(err, client.ErrProxyAuthRequired)
+	})
+}
+
 func (t *ClientTest) TestDial_SOCKS4() {
 	t.Run("makes a CONNECT request to proxy", func() {
 		proxyConn := t.dialProxy(addr.ProtoSOCKS4, addr.NewAddr("localhost", 8080))
@@ -161,22 +223,432 @@ func (t *ClientTest) TestDial_SOCKS5() {
 	})
 }
 
-func (t *ClientTest) dialProxy(p addr.Proto, dstHost *addr.Addr) (proxyConn net.Conn) {
+func (t *ClientTest) TestDial_SOCKS5Auth() {
+	dstAddr := addr.NewAddr("localhost", 8080)
+	proxyURL := &addr.URL{
+		Proto:    addr.ProtoSOCKS5h,
+		Username: "root",
+		Password: "secret",
+		Host:     "localhost",
+		Port:     1111,
+	}
+
+	t.Run("authenticates to proxy with username and password", func() {
+		proxyConn, dialErr := t.startDial(proxyURL, dstAddr)
+		proxyRead := bufio.NewReader(proxyConn)
+
+		greet, err := socks.ReadGreeting(proxyRead)
+		t.Require().NoError(err)
+		t.Contains(greet.Auth, socks.AuthPassword)
+
+		greetRep := socks.GreetingReply{Version: socks.V5, Auth: socks.AuthPassword}
+		t.Require().NoError(greetRep.Write(proxyConn))
+
+		creds, err := socks.ReadPasswordAuth(proxyRead)
+		t.Require().NoError(err)
+		t.Equal("root", creds.Username)
+		t.Equal("secret", creds.Password)
+
+		authRep := socks.PasswordAuthReply{Success: true}
+		t.Require().NoError(authRep.Write(proxyConn))
+
+		_, err = socks.ReadRequest(proxyRead)
+		t.Require().NoError(err)
+
+		rep := socks.Reply{Version: socks.V5, Status: socks.StatusGranted}
+		t.Require().NoError(rep.Write(proxyConn))
+
+		t.NoError(<-dialErr)
+	})
+
+	t.Run("reports rejected credentials", func() {
+		proxyConn, dialErr := t.startDial(proxyURL, dstAddr)
+		proxyRead := bufio.NewReader(proxyConn)
+
+		_, err := socks.ReadGreeting(proxyRead)
+		t.Require().NoError(err)
+
+		greetRep := socks.GreetingReply{Version: socks.V5, Auth: socks.AuthPassword}
+		t.Require().NoError(greetRep.Write(proxyConn))
+
+		_, err = socks.ReadPasswordAuth(proxyRead)
+		t.Require().NoError(err)
+
+		authRep := socks.PasswordAuthReply{Success: false}
+		t.Require().NoError(authRep.Write(proxyConn))
+
+		t.ErrorIs(<-dialErr, client.ErrAuthRejected)
+	})
+
+	t.Run("reports no acceptable auth method", func() {
+		proxyConn, dialErr := t.startDial(proxyURL, dstAddr)
+
+		_, err := socks.ReadGreeting(bufio.NewReader(proxyConn))
+		t.Require().NoError(err)
+
+		greetRep := socks.GreetingReply{Version: socks.V5, Auth: socks.AuthNotAcceptable}
+		t.Require().NoError(greetRep.Write(proxyConn))
+
+		t.ErrorIs(<-dialErr, client.ErrNoAcceptableAuth)
+	})
+}
+
+func (t *ClientTest) TestDial_Chain() {
+	dstAddr := addr.NewAddr("localhost", 8080)
+	chain := []addr.URL{
+		*addr.NewURL(addr.ProtoHTTP, "corp", 3128),
+		*addr.NewURL(addr.ProtoSOCKS5h, "bastion", 1080),
+	}
+
+	t.Run("connects to destination through each proxy in turn", func() {
+		proxyConn, dialErr := t.startChainDial(chain, dstAddr)
+		proxyRead := bufio.NewReader(proxyConn)
+
+		// The first proxy is asked to connect to the second one
+		req, err := http.ReadRequest(proxyRead)
+		t.Require().NoError(err)
+		t.Equal(http.MethodConnect, req.Method)
+		t.Equal(chain[1].Addr().String(), req.Host)
+
+		resp := httptest.NewRecorder()
+		resp.WriteHeader(http.StatusOK)
+		t.Require().NoError(resp.Result().Write(proxyConn))
+
+		// The second proxy is asked to connect to destination
+		t.socks5Authenticate(proxyConn)
+
+		socksReq, err := socks.ReadRequest(proxyRead)
+		t.Require().NoError(err)
+		t.Equal(dstAddr, &socksReq.DstAddr)
+
+		rep := socks.Reply{
+			Version: socks.V5,
+			Status:  socks.StatusGranted,
+		}
+		t.Require().NoError(rep.Write(proxyConn))
+
+		t.NoError(<-dialErr)
+	})
+
+	t.Run("reports which proxy in the chain failed", func() {
+		proxyConn, dialErr := t.startChainDial(chain, dstAddr)
+
+		_, err := http.ReadRequest(bufio.NewReader(proxyConn))
+		t.Require().NoError(err)
+
+		resp := httptest.NewRecorder()
+		resp.WriteHeader(http.StatusForbidden)
+		t.Require().NoError(resp.Result().Write(proxyConn))
+
+		err = <-dialErr
+		t.ErrorIs(err, client.ErrConnRejected)
+		t.ErrorContains(err, "hop 1")
+	})
+
+	t.Run("rejects UDP through proxy chains with proxies without UDP support", func() {
+		client := client.New(
+			client.WithProxyChain(chain),
+			client.WithDialer(mocks.NewDialer(t.T())),
+		)
+
+		_, err := client.DialPacket(context.Background())
+		t.Error(err)
+	})
+}
+
+func (t *ClientTest) TestDialPacket() {
+	t.Run("exchanges datagrams through SOCKS5 UDP relay", func() {
+		relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		t.Require().NoError(err)
+		defer relayConn.Close()
+
+		relayAddr := addr.NewAddr("127.0.0.1", uint16(relayConn.LocalAddr().(*net.UDPAddr).Port))
+		proxyURL := addr.NewURL(addr.ProtoSOCKS5h, "localhost", 1111)
+
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+
+		dialer := mocks.NewDialer(t.T())
+		dialer.EXPECT().
+			Dial(mock.Anything, proxyURL.Addr()).
+			Return(clientConn, nil)
+
+		client := client.New(
+			client.WithProxyURL(proxyURL),
+			client.WithDialer(dialer),
+		)
+
+		connChan := make(chan proxy.PacketConn, 1)
+		go func() {
+			conn, err := client.DialPacket(context.Background())
+			t.NoError(err)
+			connChan <- conn
+		}()
+
+		t.socks5Authenticate(serverConn)
+
+		req, err := socks.ReadRequest(bufio.NewReader(serverConn))
+		t.Require().NoError(err)
+		t.Equal(socks.CommandAssociate, req.Command)
+
+		rep := socks.Reply{
+			Version:  socks.V5,
+			Status:   socks.StatusGranted,
+			BindAddr: *relayAddr,
+		}
+		t.Require().NoError(rep.Write(serverConn))
+
+		conn := <-connChan
+		t.Require().NotNil(conn)
+		defer conn.Close()
+
+		// Send a datagram to the destination through the relay
+		dstAddr := addr.NewAddr("example.com", 53)
+		_, err = conn.WriteTo([]byte("ping"), dstAddr)
+		t.Require().NoError(err)
+
+		buf := make([]byte, 1024)
+		n, from, err := relayConn.ReadFrom(buf)
+		t.Require().NoError(err)
+
+		got, err := socks.ReadDatagram(bufio.NewReader(bytes.NewReader(buf[:n])))
+		t.Require().NoError(err)
+		t.Equal(dstAddr, &got.DstAddr)
+		t.Equal("ping", string(got.Data))
+
+		// Send a reply from the destination through the relay
+		var reply bytes.Buffer
+		replyDatagram := socks.Datagram{
+			DstAddr: *addr.NewAddr("1.2.3.4", 53),
+			Data:    []byte("pong"),
+		}
+		t.Require().NoError(replyDatagram.Write(&reply))
+
+		_, err = relayConn.WriteTo(reply.Bytes(), from)
+		t.Require().NoError(err)
+
+		n, srcAddr, err := conn.ReadFrom(buf)
+		t.Require().NoError(err)
+
+		t.Equal("pong", string(buf[:n]))
+		t.Equal(addr.NewAddr("1.2.3.4", 53), srcAddr)
+	})
+
+	t.Run("exchanges datagrams through a chain of SOCKS5 UDP relays", func() {
+		echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		t.Require().NoError(err)
+		defer echoConn.Close()
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				n, from, err := echoConn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				_, _ = echoConn.WriteTo(buf[:n], from)
+			}
+		}()
+
+		client := client.New(client.WithProxyChain([]addr.URL{
+			*t.startSOCKSServer(),
+			*t.startSOCKSServer(),
+		}))
+
+		conn, err := client.DialPacket(context.Background())
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		echoAddr := addr.NewAddr("127.0.0.1", uint16(echoConn.LocalAddr().(*net.UDPAddr).Port))
+		_, err = conn.WriteTo([]byte("ping"), echoAddr)
+		t.Require().NoError(err)
+
+		buf := make([]byte, 1024)
+		n, srcAddr, err := conn.ReadFrom(buf)
+		t.Require().NoError(err)
+
+		t.Equal("ping", string(buf[:n]))
+		t.Equal(echoAddr, srcAddr)
+	})
+
+	t.Run("rejects proxies without UDP support", func() {
+		client := client.New(
+			client.WithProxyURL(addr.NewURL(addr.ProtoHTTP, "localhost", 1111)),
+			client.WithDialer(mocks.NewDialer(t.T())),
+		)
+
+		_, err := client.DialPacket(context.Background())
+		t.Error(err)
+	})
+}
+
+// startSOCKSServer starts a SOCKS5 server connecting to destinations directly.
+func (t *ClientTest) startSOCKSServer() *addr.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Require().NoError(err)
+
+	serveErr := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		serveErr <- server.New().Serve(ctx, addr.ProtoSOCKS5, l)
+	}()
+	t.T().Cleanup(func() {
+		cancel()
+		t.NoError(<-serveErr)
+	})
+
+	return addr.NewURL(addr.ProtoSOCKS5h, "127.0.0.1", uint16(l.Addr().(*net.TCPAddr).Port))
+}
+
+func (t *ClientTest) TestBind() {
+	protos := map[string]addr.Proto{
+		"SOCKS4a": addr.ProtoSOCKS4a,
+		"SOCKS5h": addr.ProtoSOCKS5h,
+	}
+
+	for name, proto := range protos {
+		t.Run(name+" accepts a connection from peer through proxy", func() {
+			peerAddr := addr.NewAddr("127.0.0.1", 2222)
+			serverConn, bindChan := t.startBind(proto, peerAddr)
+			serverRead := bufio.NewReader(serverConn)
+
+			if proto == addr.ProtoSOCKS5h {
+				t.socks5Authenticate(serverConn)
+			}
+
+			req, err := socks.ReadRequest(serverRead)
+			t.Require().NoError(err)
+			t.Equal(socks.CommandBind, req.Command)
+			t.Equal(peerAddr, &req.DstAddr)
+
+			bindAddr := addr.NewAddr("127.0.0.1", 3333)
+			t.Require().NoError(writeReply(serverConn, req.Version, socks.StatusGranted, bindAddr))
+
+			b := <-bindChan
+			t.Require().NotNil(b)
+			t.Equal(bindAddr, b.Addr())
+
+			writeErr := make(chan error, 1)
+			go func() {
+				if err := writeReply(serverConn, req.Version, socks.StatusGranted, peerAddr); err != nil {
+					writeErr <- err
+					return
+				}
+				_, err := serverConn.Write([]byte("hello"))
+				writeErr <- err
+			}()
+
+			peerConn, gotPeer, err := b.Accept()
+			t.Require().NoError(err)
+			t.Equal(peerAddr, gotPeer)
+
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(peerConn, buf)
+			t.Require().NoError(err)
+			t.Equal("hello", string(buf))
+			t.NoError(<-writeErr)
+		})
+
+		t.Run(name+" reports a rejected peer connection", func() {
+			serverConn, bindChan := t.startBind(proto, addr.NewAddr("127.0.0.1", 2222))
+			serverRead := bufio.NewReader(serverConn)
+
+			if proto == addr.ProtoSOCKS5h {
+				t.socks5Authenticate(serverConn)
+			}
+
+			req, err := socks.ReadRequest(serverRead)
+			t.Require().NoError(err)
+			t.Require().NoError(writeReply(serverConn, req.Version, socks.StatusGranted, addr.NewAddr("127.0.0.1", 3333)))
+
+			b := <-bindChan
+			t.Require().NotNil(b)
+
+			writeErr := make(chan error, 1)
+			go func() {
+				writeErr <- writeReply(serverConn, req.Version, socks.StatusConnectionNotAllowed, addr.NewAddr("10.0.0.1", 4444))
+			}()
+
+			_, _, err = b.Accept()
+			t.ErrorIs(err, client.ErrConnRejected)
+			t.NoError(<-writeErr)
+		})
+	}
+
+	t.Run("rejects proxies without BIND support", func() {
+		client := client.New(
+			client.WithProxyURL(addr.NewURL(addr.ProtoHTTP, "localhost", 1111)),
+			client.WithDialer(mocks.NewDialer(t.T())),
+		)
+
+		_, err := client.Bind(context.Background(), addr.NewAddr("127.0.0.1", 2222))
+		t.Error(err)
+	})
+}
+
+func (t *ClientTest) startBind(p addr.Proto, peerAddr *addr.Addr) (proxyConn net.Conn, binding <-chan *client.Binding) {
+	proxyURL := addr.NewURL(p, "localhost", 1111)
+
 	clientConn, serverConn := net.Pipe()
 	t.T().Cleanup(func() {
 		clientConn.Close()
 		serverConn.Close()
 	})
 
-	proxyAddr := addr.NewAddr("localhost", 1111)
+	dialer := mocks.NewDialer(t.T())
+	dialer.EXPECT().
+		Dial(mock.Anything, proxyURL.Addr()).
+		Return(clientConn, nil)
+
+	bindChan := make(chan *client.Binding, 1)
+	client := client.New(
+		client.WithProxyURL(proxyURL),
+		client.WithDialer(dialer),
+	)
+
+	go func() {
+		b, err := client.Bind(context.Background(), peerAddr)
+		t.NoError(err)
+		bindChan <- b
+	}()
+
+	return serverConn, bindChan
+}
+
+func writeReply(c net.Conn, v socks.Version, status socks.Status, bindAddr *addr.Addr) error {
+	rep := socks.Reply{
+		Version:  v,
+		Status:   status,
+		BindAddr: *bindAddr,
+	}
+	return rep.Write(c)
+}
+
+func (t *ClientTest) dialProxy(p addr.Proto, dstHost *addr.Addr) (proxyConn net.Conn) {
+	proxyConn, dialErr := t.startDial(addr.NewURL(p, "localhost", 1111), dstHost)
+	t.T().Cleanup(func() {
+		t.Require().NoError(<-dialErr)
+	})
+	return proxyConn
+}
+
+func (t *ClientTest) startDial(proxyURL *addr.URL, dstHost *addr.Addr) (proxyConn net.Conn, dialErr <-chan error) {
+	return t.startChainDial([]addr.URL{*proxyURL}, dstHost)
+}
+
+func (t *ClientTest) startChainDial(chain []addr.URL, dstHost *addr.Addr) (proxyConn net.Conn, dialErr <-chan error) {
+	clientConn, serverConn := net.Pipe()
+	t.T().Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
 
 	dialer := mocks.NewDialer(t.T())
 	dialer.EXPECT().
-		Dial(mock.Anything, proxyAddr).
+		Dial(mock.Anything, chain[0].Addr()).
 		Return(clientConn, nil)
 
 	client := client.New(
-		client.WithProxyURL(addr.NewURL(p, proxyAddr.Host, proxyAddr.Port)),
+		client.WithProxyChain(chain),
 		client.WithDialer(dialer),
 	)
 
@@ -186,11 +658,7 @@ func (t *ClientTest) dialProxy(p addr.Proto, dstHost *addr.Addr) (proxyConn net.
 		errChan <- err
 	}()
 
-	t.T().Cleanup(func() {
-		t.Require().NoError(<-errChan)
-	})
-
-	return serverConn
+	return serverConn, errChan
 }
 
 func (t *ClientTest) socks5Authenticate(c net.Conn) {
@@ -2,6 +2,8 @@ package client
 
 import (
 	"bufio"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -9,7 +11,14 @@ import (
 	"github.com/cerfical/socks2http/internal/proxy/addr"
 )
 
-type HTTPClient struct{}
+// ErrProxyAuthRequired is returned when the proxy requires credentials or does not accept the provided ones.
+var ErrProxyAuthRequired = errors.New("proxy authentication required")
+
+type HTTPClient struct {
+	// Username and Password are used to authenticate to the proxy, if set.
+	Username string
+	Password string
+}
 
 func (c *HTTPClient) Connect(proxyConn net.Conn, dstAddr *addr.Addr) error {
 	connReq, err := http.NewRequest(http.MethodConnect, "", nil)
@@ -18,6 +27,11 @@ func (c *HTTPClient) Connect(proxyConn net.Conn, dstAddr *addr.Addr) error {
 	}
 	connReq.Host = dstAddr.String()
 
+	if c.Username != "" || c.Password != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+		connReq.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
 	if err := connReq.WriteProxy(proxyConn); err != nil {
 		return fmt.Errorf("write request: %w", err)
 	}
@@ -28,9 +42,12 @@ func (c *HTTPClient) Connect(proxyConn net.Conn, dstAddr *addr.Addr) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		code, msg := resp.StatusCode, http.StatusText(resp.StatusCode)
-		return fmt.Errorf("connection rejected: %v %v", code, msg)
+	switch code := resp.StatusCode; code {
+	case http.StatusOK:
+		return nil
+	case http.StatusProxyAuthRequired:
+		return ErrProxyAuthRequired
+	default:
+		return fmt.Errorf("%w: %v %v", ErrConnRejected, code, http.StatusText(code))
 	}
-	return nil
 }
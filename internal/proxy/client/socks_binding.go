@@ -0,0 +1,46 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/socks"
+)
+
+// Binding represents a pending SOCKS BIND request, waiting for the peer to connect to the proxy.
+type Binding struct {
+	proxyConn net.Conn
+	proxyRead *bufio.Reader
+	bindAddr  addr.Addr
+}
+
+// Addr returns the address on the proxy the peer is expected to connect to.
+func (b *Binding) Addr() *addr.Addr {
+	return &b.bindAddr
+}
+
+// Accept waits for the peer to connect and returns a connection to it along with its address.
+func (b *Binding) Accept() (net.Conn, *addr.Addr, error) {
+	reply, err := socks.ReadReply(b.proxyRead)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read reply: %w", err)
+	}
+	if reply.Status != socks.StatusGranted {
+		return nil, nil, fmt.Errorf("%w: %v", ErrConnRejected, reply.Status)
+	}
+
+	peerConn := b.proxyConn
+	if b.proxyRead.Buffered() > 0 {
+		// The peer may have already sent some data
+		peerConn = proxy.WithBufferedReader(peerConn, b.proxyRead)
+	}
+	return peerConn, &reply.BindAddr, nil
+}
+
+// Close cancels the binding, if the peer has not connected yet.
+func (b *Binding) Close() error {
+	return b.proxyConn.Close()
+}
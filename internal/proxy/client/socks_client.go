@@ -2,52 +2,127 @@ package client
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net"
 
+	"github.com/cerfical/socks2http/internal/proxy"
 	"github.com/cerfical/socks2http/internal/proxy/addr"
 	"github.com/cerfical/socks2http/internal/proxy/socks"
 )
 
+var (
+	// ErrAuthRejected is returned when the proxy does not accept the provided credentials.
+	ErrAuthRejected = errors.New("authentication rejected")
+
+	// ErrNoAcceptableAuth is returned when the proxy supports none of the offered auth methods.
+	ErrNoAcceptableAuth = errors.New("no acceptable auth method")
+)
+
 type SOCKSClient struct {
 	Version      socks.Version
 	ResolveNames bool
+
+	// Username and Password are used to authenticate to the proxy, if set.
+	Username string
+	Password string
 }
 
 func (c *SOCKSClient) Connect(proxyConn net.Conn, dstAddr *addr.Addr) error {
 	if c.ResolveNames {
-		ip, err := net.ResolveIPAddr("ip", dstAddr.Host)
+		ip, err := resolveAddr(dstAddr)
 		if err != nil {
 			return fmt.Errorf("resolve destination: %w", err)
 		}
-		dstAddr = addr.NewAddr(ip.String(), dstAddr.Port)
+		dstAddr = ip
+	}
+
+	_, err := c.request(proxyConn, bufio.NewReader(proxyConn), socks.CommandConnect, dstAddr)
+	return err
+}
+
+// Associate asks the proxy to relay UDP datagrams, which are then exchanged with the relay via transport.
+//
+// The association lasts until the proxy closes proxyConn.
+// Both proxyConn and transport are closed when the returned connection is closed.
+func (c *SOCKSClient) Associate(proxyConn net.Conn, transport proxy.PacketConn) (proxy.PacketConn, error) {
+	if c.Version != socks.V5 {
+		return nil, fmt.Errorf("UDP is not supported by %v", c.Version)
+	}
+
+	// The address datagrams will be sent from is not known in advance
+	reply, err := c.request(proxyConn, bufio.NewReader(proxyConn), socks.CommandAssociate, addr.NewAddr("0.0.0.0", 0))
+	if err != nil {
+		return nil, err
+	}
+
+	relayAddr, err := proxyBindAddr(proxyConn, &reply.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	return newSOCKSPacketConn(proxyConn, transport, relayAddr, c.ResolveNames), nil
+}
+
+// Bind asks the proxy to accept a single incoming connection from peerAddr.
+//
+// The peer is expected to connect to the address reported by the returned [Binding].
+func (c *SOCKSClient) Bind(proxyConn net.Conn, peerAddr *addr.Addr) (*Binding, error) {
+	if c.ResolveNames {
+		ip, err := resolveAddr(peerAddr)
+		if err != nil {
+			return nil, fmt.Errorf("resolve peer: %w", err)
+		}
+		peerAddr = ip
+	}
+
+	proxyRead := bufio.NewReader(proxyConn)
+	reply, err := c.request(proxyConn, proxyRead, socks.CommandBind, peerAddr)
+	if err != nil {
+		return nil, err
 	}
 
-	bufr := bufio.NewReader(proxyConn)
+	bindAddr, err := proxyBindAddr(proxyConn, &reply.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Binding{
+		proxyConn: proxyConn,
+		proxyRead: proxyRead,
+		bindAddr:  *bindAddr,
+	}, nil
+}
+
+func (c *SOCKSClient) request(proxyConn net.Conn, proxyRead *bufio.Reader, cmd socks.Command, dstAddr *addr.Addr) (*socks.Reply, error) {
 	if c.Version == socks.V5 {
-		if err := c.auth(proxyConn, bufr); err != nil {
-			return err
+		if err := c.auth(proxyConn, proxyRead); err != nil {
+			return nil, err
 		}
 	}
 
-	connReq := socks.Request{
+	req := socks.Request{
 		Version: c.Version,
-		Command: socks.CommandConnect,
+		Command: cmd,
 		DstAddr: *dstAddr,
 	}
-	if err := connReq.Write(proxyConn); err != nil {
-		return fmt.Errorf("write request: %w", err)
+	if c.Version == socks.V4 {
+		// SOCKS4 only supports a user ID
+		req.Username = c.Username
 	}
 
-	reply, err := socks.ReadReply(bufr)
+	if err := req.Write(proxyConn); err != nil {
+		return nil, fmt.Errorf("write request: %w", err)
+	}
+
+	reply, err := socks.ReadReply(proxyRead)
 	if err != nil {
-		return fmt.Errorf("read reply: %w", err)
+		return nil, fmt.Errorf("read reply: %w", err)
 	}
 	if reply.Status != socks.StatusGranted {
-		return fmt.Errorf("connection rejected: %v", reply.Status)
+		return nil, fmt.Errorf("%w: %v", ErrConnRejected, reply.Status)
 	}
 
-	return nil
+	return reply, nil
 }
 
 func (c *SOCKSClient) auth(proxyConn net.Conn, proxyRead *bufio.Reader) error {
@@ -55,6 +130,10 @@ func (c *SOCKSClient) auth(proxyConn net.Conn, proxyRead *bufio.Reader) error {
 		Version: c.Version,
 		Auth:    []socks.Auth{socks.AuthNone},
 	}
+	if c.hasCredentials() {
+		greet.Auth = append(greet.Auth, socks.AuthPassword)
+	}
+
 	if err := greet.Write(proxyConn); err != nil {
 		return fmt.Errorf("write greeting: %w", err)
 	}
@@ -67,9 +146,59 @@ func (c *SOCKSClient) auth(proxyConn net.Conn, proxyRead *bufio.Reader) error {
 	switch greetRep.Auth {
 	case socks.AuthNone:
 		return nil
+	case socks.AuthPassword:
+		if !c.hasCredentials() {
+			return fmt.Errorf("unexpected auth method: %v", greetRep.Auth)
+		}
+		return c.passwordAuth(proxyConn, proxyRead)
 	case socks.AuthNotAcceptable:
-		return fmt.Errorf("no acceptable auth method was selected")
+		return ErrNoAcceptableAuth
 	default:
 		return fmt.Errorf("unsupported auth method: %v", greetRep.Auth)
 	}
 }
+
+func (c *SOCKSClient) passwordAuth(proxyConn net.Conn, proxyRead *bufio.Reader) error {
+	creds := socks.PasswordAuth{
+		Username: c.Username,
+		Password: c.Password,
+	}
+	if err := creds.Write(proxyConn); err != nil {
+		return fmt.Errorf("write auth request: %w", err)
+	}
+
+	authRep, err := socks.ReadPasswordAuthReply(proxyRead)
+	if err != nil {
+		return fmt.Errorf("read auth reply: %w", err)
+	}
+
+	if !authRep.Success {
+		return ErrAuthRejected
+	}
+	return nil
+}
+
+func (c *SOCKSClient) hasCredentials() bool {
+	return c.Username != "" || c.Password != ""
+}
+
+// proxyBindAddr replaces an unspecified host in an address reported by the proxy with the host of the proxy itself.
+func proxyBindAddr(proxyConn net.Conn, a *addr.Addr) (*addr.Addr, error) {
+	bindAddr := *a
+	if ip := net.ParseIP(bindAddr.Host); bindAddr.Host == "" || ip != nil && ip.IsUnspecified() {
+		proxyHost, _, err := net.SplitHostPort(proxyConn.RemoteAddr().String())
+		if err != nil {
+			return nil, fmt.Errorf("parse proxy address: %w", err)
+		}
+		bindAddr.Host = proxyHost
+	}
+	return &bindAddr, nil
+}
+
+func resolveAddr(a *addr.Addr) (*addr.Addr, error) {
+	ip, err := net.ResolveIPAddr("ip", a.Host)
+	if err != nil {
+		return nil, err
+	}
+	return addr.NewAddr(ip.String(), a.Port), nil
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/socks"
+)
+
+// maxDatagramHeaderSize is the size of a SOCKS5 UDP header with the longest possible hostname.
+const maxDatagramHeaderSize = 3 + 1 + 1 + 255 + 2
+
+func newSOCKSPacketConn(controlConn net.Conn, transport proxy.PacketConn, relayAddr *addr.Addr, resolveNames bool) *socksPacketConn {
+	c := socksPacketConn{
+		controlConn:  controlConn,
+		transport:    transport,
+		relayAddr:    *relayAddr,
+		resolveNames: resolveNames,
+	}
+
+	// The proxy terminates the association by closing the control connection
+	go func() {
+		_, _ = io.Copy(io.Discard, controlConn)
+		transport.Close()
+	}()
+
+	return &c
+}
+
+// socksPacketConn exchanges datagrams with destinations through a SOCKS5 UDP relay.
+type socksPacketConn struct {
+	controlConn net.Conn
+	transport   proxy.PacketConn
+	relayAddr   addr.Addr
+
+	resolveNames bool
+}
+
+func (c *socksPacketConn) ReadFrom(p []byte) (int, *addr.Addr, error) {
+	buf := make([]byte, len(p)+maxDatagramHeaderSize)
+	for {
+		n, srcAddr, err := c.transport.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if !c.fromRelay(srcAddr) {
+			continue
+		}
+
+		datagram, err := socks.ReadDatagram(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || datagram.Fragment != 0 {
+			// Drop malformed datagrams and fragments, since fragmentation is not supported
+			continue
+		}
+
+		return copy(p, datagram.Data), &datagram.DstAddr, nil
+	}
+}
+
+func (c *socksPacketConn) WriteTo(p []byte, dstAddr *addr.Addr) (int, error) {
+	if c.resolveNames {
+		ip, err := resolveAddr(dstAddr)
+		if err != nil {
+			return 0, fmt.Errorf("resolve destination: %w", err)
+		}
+		dstAddr = ip
+	}
+
+	datagram := socks.Datagram{
+		DstAddr: *dstAddr,
+		Data:    p,
+	}
+	if err := datagram.Write(&packetWriter{c.transport, &c.relayAddr}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socksPacketConn) Close() error {
+	return errors.Join(
+		c.controlConn.Close(),
+		c.transport.Close(),
+	)
+}
+
+func (c *socksPacketConn) fromRelay(srcAddr *addr.Addr) bool {
+	// Only IP addresses can be compared reliably
+	if net.ParseIP(c.relayAddr.Host) == nil {
+		return true
+	}
+	return *srcAddr == c.relayAddr
+}
+
+// packetWriter sends each write as a single datagram to the specified address.
+type packetWriter struct {
+	conn proxy.PacketConn
+	addr *addr.Addr
+}
+
+func (w *packetWriter) Write(p []byte) (int, error) {
+	return w.conn.WriteTo(p, w.addr)
+}
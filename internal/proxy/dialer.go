@@ -2,11 +2,15 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"net"
 
 	"github.com/cerfical/socks2http/internal/proxy/addr"
 )
 
+// ErrRejected is returned by dialers that refuse to connect to a destination by policy.
+var ErrRejected = errors.New("connection rejected by policy")
+
 var DirectDialer Dialer = DialerFunc(func(ctx context.Context, a *addr.Addr) (net.Conn, error) {
 	var d net.Dialer
 	return d.DialContext(ctx, "tcp", a.String())
@@ -16,6 +20,22 @@ type Dialer interface {
 	Dial(context.Context, *addr.Addr) (net.Conn, error)
 }
 
+// Checker is implemented by dialers that decide by policy whether destinations can be reached.
+type Checker interface {
+	// Check reports whether the destination can be reached, without connecting to it.
+	Check(*addr.Addr) error
+}
+
+// CheckDestination applies the policy of the dialer to traffic that does not go through it, such as incoming connections.
+//
+// Dialers that do not implement [Checker] allow any destination.
+func CheckDestination(d Dialer, dstAddr *addr.Addr) error {
+	if c, ok := d.(Checker); ok {
+		return c.Check(dstAddr)
+	}
+	return nil
+}
+
 type DialerFunc func(context.Context, *addr.Addr) (net.Conn, error)
 
 func (f DialerFunc) Dial(ctx context.Context, h *addr.Addr) (net.Conn, error) {
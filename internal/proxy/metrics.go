@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+)
+
+var DiscardMetrics Metrics = discardMetrics{}
+
+// Metrics collects statistics about served clients and connections made on their behalf.
+type Metrics interface {
+	// ConnAccepted counts a client connection accepted on the listener address.
+	ConnAccepted(listener string, proto addr.Proto)
+
+	// HandshakeFailed counts a client that failed to make a request, for a reason such as "timeout" or "auth".
+	HandshakeFailed(proto addr.Proto, reason string)
+
+	// RequestServed counts a reply sent to a client request, with the status as reported to the client.
+	RequestServed(proto addr.Proto, status string)
+
+	TunnelOpened(proto addr.Proto)
+	TunnelClosed(proto addr.Proto, stats *TunnelStats)
+
+	// TunnelTransferred counts bytes transferred through an open tunnel or a forwarded HTTP request, with the direction as seen by the client.
+	TunnelTransferred(proto addr.Proto, sent, received int64)
+
+	// DialDone observes an attempt to connect to a destination through an upstream of a route.
+	DialDone(route, upstream string, d time.Duration, err error)
+}
+
+type discardMetrics struct{}
+
+func (discardMetrics) ConnAccepted(string, addr.Proto) {}
+
+func (discardMetrics) HandshakeFailed(addr.Proto, string) {}
+
+func (discardMetrics) RequestServed(addr.Proto, string) {}
+
+func (discardMetrics) TunnelOpened(addr.Proto) {}
+
+func (discardMetrics) TunnelClosed(addr.Proto, *TunnelStats) {}
+
+func (discardMetrics) TunnelTransferred(addr.Proto, int64, int64) {}
+
+func (discardMetrics) DialDone(string, string, time.Duration, error) {}
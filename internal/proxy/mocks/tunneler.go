@@ -4,9 +4,12 @@ package mocks
 
 import (
 	context "context"
-	net "net"
 
 	mock "github.com/stretchr/testify/mock"
+
+	net "net"
+
+	proxy "github.com/cerfical/socks2http/internal/proxy"
 )
 
 // Tunneler is an autogenerated mock type for the Tunneler type
@@ -23,21 +26,31 @@ func (_m *Tunneler) EXPECT() *Tunneler_Expecter {
 }
 
 // Tunnel provides a mock function with given fields: ctx, srcConn, dstConn
-func (_m *Tunneler) Tunnel(ctx context.Context, srcConn net.Conn, dstConn net.Conn) error {
+func (_m *Tunneler) Tunnel(ctx context.Context, srcConn net.Conn, dstConn net.Conn) (proxy.TunnelStats, error) {
 	ret := _m.Called(ctx, srcConn, dstConn)
 
 	if len(ret) == 0 {
 		panic("no return value specified for Tunnel")
 	}
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(context.Context, net.Conn, net.Conn) error); ok {
+	var r0 proxy.TunnelStats
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, net.Conn, net.Conn) (proxy.TunnelStats, error)); ok {
+		return rf(ctx, srcConn, dstConn)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, net.Conn, net.Conn) proxy.TunnelStats); ok {
 		r0 = rf(ctx, srcConn, dstConn)
 	} else {
-		r0 = ret.Error(0)
+		r0 = ret.Get(0).(proxy.TunnelStats)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, net.Conn, net.Conn) error); ok {
+		r1 = rf(ctx, srcConn, dstConn)
+	} else {
+		r1 = ret.Error(1)
 	}
 
-	return r0
+	return r0, r1
 }
 
 // Tunneler_Tunnel_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Tunnel'
@@ -60,12 +73,12 @@ func (_c *Tunneler_Tunnel_Call) Run(run func(ctx context.Context, srcConn net.Co
 	return _c
 }
 
-func (_c *Tunneler_Tunnel_Call) Return(_a0 error) *Tunneler_Tunnel_Call {
-	_c.Call.Return(_a0)
+func (_c *Tunneler_Tunnel_Call) Return(_a0 proxy.TunnelStats, _a1 error) *Tunneler_Tunnel_Call {
+	_c.Call.Return(_a0, _a1)
 	return _c
 }
 
-func (_c *Tunneler_Tunnel_Call) RunAndReturn(run func(context.Context, net.Conn, net.Conn) error) *Tunneler_Tunnel_Call {
+func (_c *Tunneler_Tunnel_Call) RunAndReturn(run func(context.Context, net.Conn, net.Conn) (proxy.TunnelStats, error)) *Tunneler_Tunnel_Call {
 	_c.Call.Return(run)
 	return _c
 }
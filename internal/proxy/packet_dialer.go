@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+)
+
+var DirectPacketDialer PacketDialer = PacketDialerFunc(func(ctx context.Context) (PacketConn, error) {
+	var lc net.ListenConfig
+	conn, err := lc.ListenPacket(ctx, "udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return &udpPacketConn{conn.(*net.UDPConn)}, nil
+})
+
+// PacketConn exchanges datagrams with arbitrary destinations.
+type PacketConn interface {
+	ReadFrom(p []byte) (n int, srcAddr *addr.Addr, err error)
+	WriteTo(p []byte, dstAddr *addr.Addr) (n int, err error)
+	Close() error
+}
+
+type PacketDialer interface {
+	DialPacket(context.Context) (PacketConn, error)
+}
+
+type PacketDialerFunc func(context.Context) (PacketConn, error)
+
+func (f PacketDialerFunc) DialPacket(ctx context.Context) (PacketConn, error) {
+	return f(ctx)
+}
+
+type udpPacketConn struct {
+	conn *net.UDPConn
+}
+
+func (c *udpPacketConn) ReadFrom(p []byte) (int, *addr.Addr, error) {
+	n, srcAddr, err := c.conn.ReadFromUDPAddrPort(p)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, addr.NewAddr(srcAddr.Addr().Unmap().String(), srcAddr.Port()), nil
+}
+
+func (c *udpPacketConn) WriteTo(p []byte, dstAddr *addr.Addr) (int, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", dstAddr.String())
+	if err != nil {
+		return 0, err
+	}
+	return c.conn.WriteToUDP(p, udpAddr)
+}
+
+func (c *udpPacketConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,50 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestPacketDialer(t *testing.T) {
+	suite.Run(t, new(PacketDialerTest))
+}
+
+type PacketDialerTest struct {
+	suite.Suite
+}
+
+func (t *PacketDialerTest) TestDirectPacketDialer() {
+	t.Run("exchanges datagrams with destination", func() {
+		dstConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		t.Require().NoError(err)
+		defer dstConn.Close()
+
+		dstAddr := addr.NewAddr("127.0.0.1", uint16(dstConn.LocalAddr().(*net.UDPAddr).Port))
+
+		conn, err := proxy.DirectPacketDialer.DialPacket(context.Background())
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		_, err = conn.WriteTo([]byte("ping"), dstAddr)
+		t.Require().NoError(err)
+
+		buf := make([]byte, 16)
+		n, from, err := dstConn.ReadFrom(buf)
+		t.Require().NoError(err)
+		t.Equal("ping", string(buf[:n]))
+
+		_, err = dstConn.WriteTo([]byte("pong"), from)
+		t.Require().NoError(err)
+
+		n, srcAddr, err := conn.ReadFrom(buf)
+		t.Require().NoError(err)
+
+		t.Equal("pong", string(buf[:n]))
+		t.Equal(dstAddr, srcAddr)
+	})
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import "net"
+
+// WithRoute attaches a description of how the connection was made, which can be found later with [RouteOf].
+func WithRoute(conn net.Conn, route, upstream string) net.Conn {
+	return &routedConn{conn, route, upstream}
+}
+
+// RouteOf finds the route and the upstream the connection was made through, if they are known.
+func RouteOf(conn net.Conn) (route, upstream string, ok bool) {
+	for {
+		switch c := conn.(type) {
+		case *routedConn:
+			return c.route, c.upstream, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return "", "", false
+		}
+	}
+}
+
+type routedConn struct {
+	net.Conn
+	route    string
+	upstream string
+}
+
+func (c *routedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func (c *routedConn) NetConn() net.Conn {
+	return c.Conn
+}
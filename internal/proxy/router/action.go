@@ -0,0 +1,51 @@
+package router
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+const (
+	// ActionProxy connects through the route's proxy chain, or directly if the chain is empty.
+	ActionProxy Action = iota
+	// ActionDirect connects to destination directly.
+	ActionDirect
+	// ActionReject refuses to connect to destination.
+	ActionReject
+)
+
+var actions = []string{
+	ActionProxy:  "proxy",
+	ActionDirect: "direct",
+	ActionReject: "reject",
+}
+
+type Action int
+
+func (a Action) String() string {
+	text, err := a.MarshalText()
+	if err != nil {
+		return ""
+	}
+	return string(text)
+}
+
+func (a Action) MarshalText() ([]byte, error) {
+	if a < ActionProxy || a > ActionReject {
+		return nil, errors.New("unknown route action")
+	}
+	return []byte(actions[a]), nil
+}
+
+func (a *Action) UnmarshalText(text []byte) error {
+	i := slices.IndexFunc(actions, func(s string) bool {
+		return strings.EqualFold(s, string(text))
+	})
+	if i == -1 {
+		return errors.New("unknown route action")
+	}
+
+	*a = Action(i)
+	return nil
+}
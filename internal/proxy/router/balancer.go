@@ -0,0 +1,155 @@
+package router
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+)
+
+const (
+	// StrategyFailover tries upstreams in the order they are listed.
+	StrategyFailover Strategy = iota
+	// StrategyRoundRobin starts with the next upstream on each connection.
+	StrategyRoundRobin
+	// StrategyRandom tries upstreams in random order.
+	StrategyRandom
+	// StrategyLeastConn starts with the upstream having the fewest active connections.
+	StrategyLeastConn
+)
+
+var strategies = []string{
+	StrategyFailover:   "failover",
+	StrategyRoundRobin: "round-robin",
+	StrategyRandom:     "random",
+	StrategyLeastConn:  "least-conn",
+}
+
+// Strategy defines the order in which upstreams of a route are tried.
+type Strategy int
+
+func (s Strategy) String() string {
+	text, err := s.MarshalText()
+	if err != nil {
+		return ""
+	}
+	return string(text)
+}
+
+func (s Strategy) MarshalText() ([]byte, error) {
+	if s < StrategyFailover || s > StrategyLeastConn {
+		return nil, errors.New("unknown balancing strategy")
+	}
+	return []byte(strategies[s]), nil
+}
+
+func (s *Strategy) UnmarshalText(text []byte) error {
+	i := slices.IndexFunc(strategies, func(str string) bool {
+		return strings.EqualFold(str, string(text))
+	})
+	if i == -1 {
+		return errors.New("unknown balancing strategy")
+	}
+
+	*s = Strategy(i)
+	return nil
+}
+
+func newBalancer(name string, r *Route) *balancer {
+	upstreams := r.Upstreams
+	if len(upstreams) == 0 {
+		upstreams = [][]addr.URL{r.Proxy}
+	}
+
+	return &balancer{
+		name:      name,
+		strategy:  r.Strategy,
+		upstreams: upstreams,
+		active:    make([]atomic.Int64, len(upstreams)),
+		health:    make([]upstreamHealth, len(upstreams)),
+		throttle:  proxy.NewThrottle(&r.Bandwidth),
+	}
+}
+
+// balancer keeps track of upstreams of a single route.
+type balancer struct {
+	// name identifies the route in metrics
+	name string
+
+	strategy  Strategy
+	upstreams [][]addr.URL
+
+	next   atomic.Uint64
+	active []atomic.Int64
+	health []upstreamHealth
+
+	// throttle is shared by all tunnels opened by the route
+	throttle *proxy.Throttle
+}
+
+// order returns indices of upstreams in the order they should be tried.
+func (b *balancer) order() []int {
+	n := len(b.upstreams)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+
+	switch b.strategy {
+	case StrategyRoundRobin:
+		start := int((b.next.Add(1) - 1) % uint64(n))
+		order = append(order[start:], order[:start]...)
+	case StrategyRandom:
+		rand.Shuffle(n, func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+	case StrategyLeastConn:
+		// Keep the listed order among equally loaded upstreams
+		slices.SortStableFunc(order, func(i, j int) int {
+			return int(b.active[i].Load() - b.active[j].Load())
+		})
+	}
+
+	// Skip upstreams that failed their health checks
+	return slices.DeleteFunc(order, func(i int) bool {
+		return b.health[i].down.Load()
+	})
+}
+
+// track counts the connection as active on the upstream until it is closed.
+func (b *balancer) track(i int, conn net.Conn) net.Conn {
+	if b.strategy != StrategyLeastConn {
+		return conn
+	}
+
+	b.active[i].Add(1)
+	return &trackedConn{
+		Conn: conn,
+		done: func() { b.active[i].Add(-1) },
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+	done func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.done)
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
+
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,159 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/client"
+)
+
+// ErrNoHealthyUpstream is returned when all upstreams of a route have failed their health checks.
+var ErrNoHealthyUpstream = errors.New("no healthy upstream")
+
+const (
+	defHealthInterval = 30 * time.Second
+	defHealthTimeout  = 5 * time.Second
+	defHealthRise     = 2
+	defHealthFall     = 3
+)
+
+// HealthCheck configures active health checking of upstream proxies.
+type HealthCheck struct {
+	// Probe is the destination to open test tunnels to.
+	Probe *addr.Addr
+
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// Rise and Fall are the numbers of consecutive successful and failed probes needed to change the upstream state.
+	Rise int
+	Fall int
+
+	// FallbackDirect makes routes connect directly when none of their upstreams are healthy, instead of failing.
+	FallbackDirect bool
+}
+
+func (h *HealthCheck) withDefaults() HealthCheck {
+	hc := *h
+	if hc.Interval <= 0 {
+		hc.Interval = defHealthInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defHealthTimeout
+	}
+	if hc.Rise <= 0 {
+		hc.Rise = defHealthRise
+	}
+	if hc.Fall <= 0 {
+		hc.Fall = defHealthFall
+	}
+	return hc
+}
+
+// upstreamHealth tracks the state of a single upstream, with upstreams considered healthy until proven otherwise.
+type upstreamHealth struct {
+	down atomic.Bool
+
+	// Probes of the same upstream may overlap when health checks are run concurrently
+	mu            sync.Mutex
+	passes, fails int
+}
+
+// RunHealthChecks periodically probes all upstreams until the context is canceled.
+func (r *Router) RunHealthChecks(ctx context.Context) {
+	if r.healthCheck.Probe == nil {
+		return
+	}
+
+	ticker := time.NewTicker(r.healthCheck.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.CheckHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckHealth probes all upstreams once and updates their state.
+//
+// It is safe to call concurrently with other health checks.
+func (r *Router) CheckHealth(ctx context.Context) {
+	if r.healthCheck.Probe == nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, b := range r.allBalancers() {
+		for i := range b.upstreams {
+			// Direct connections have nothing to check
+			if len(b.upstreams[i]) == 0 {
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.probe(ctx, b, i)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func (r *Router) allBalancers() []*balancer {
+	var balancers []*balancer
+	for i := range r.routes {
+		if r.routes[i].Action == ActionProxy {
+			balancers = append(balancers, r.balancers[i])
+		}
+	}
+	if r.defaultRoute.Action == ActionProxy {
+		balancers = append(balancers, r.defaultBalancer)
+	}
+	return balancers
+}
+
+func (r *Router) probe(ctx context.Context, b *balancer, i int) {
+	probeCtx, cancel := context.WithTimeout(ctx, r.healthCheck.Timeout)
+	defer cancel()
+
+	chain := b.upstreams[i]
+	client := client.New(
+		client.WithDialer(r.dialer),
+		client.WithProxyChain(chain),
+	)
+
+	conn, err := client.Dial(probeCtx, r.healthCheck.Probe)
+	if err == nil {
+		conn.Close()
+	}
+
+	// Probes interrupted by stopping the health checks tell nothing about the upstream
+	if ctx.Err() != nil {
+		return
+	}
+
+	h := &b.health[i]
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err != nil {
+		h.passes, h.fails = 0, h.fails+1
+		if h.fails == r.healthCheck.Fall && !h.down.Swap(true) {
+			r.log.Error("Upstream is down", "upstream", chainName(chain), "error", err)
+		}
+	} else {
+		h.passes, h.fails = h.passes+1, 0
+		if h.passes == r.healthCheck.Rise && h.down.Swap(false) {
+			r.log.Info("Upstream is up", "upstream", chainName(chain))
+		}
+	}
+}
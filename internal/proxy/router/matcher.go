@@ -0,0 +1,225 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+)
+
+// hostMatcher finds the first route with a host pattern matching an address.
+//
+// Supported patterns are:
+//   - example.com, 10.0.0.1 or fd00::1 for exact matches
+//   - *.example.com for subdomains of a domain
+//   - .example.com for a domain and all of its subdomains
+//   - /^example\.(com|org)$/ for regular expressions, which ignore case
+//   - 10.0.0.0/8 or fd00::/8 for IP address ranges
+//   - * for any host
+//
+// Any pattern can be followed by a port number, e.g. example.com:443, [fd00::/8]:443 or /example/:80.
+type hostMatcher struct {
+	// Name-based patterns are indexed to make lookups independent of the number of routes
+	exact      map[string][]portRule
+	domains    map[string][]portRule
+	subdomains map[string][]portRule
+
+	regexps  []regexpRule
+	prefixes []prefixRule
+	any      []portRule
+}
+
+type portRule struct {
+	route   int
+	pattern string
+	port    uint16
+}
+
+func (r portRule) matches(port uint16) bool {
+	return r.port == 0 || r.port == port
+}
+
+type regexpRule struct {
+	portRule
+	re *regexp.Regexp
+}
+
+type prefixRule struct {
+	portRule
+	prefix netip.Prefix
+}
+
+func newHostMatcher(routes []Route) (*hostMatcher, error) {
+	m := hostMatcher{
+		exact:      make(map[string][]portRule),
+		domains:    make(map[string][]portRule),
+		subdomains: make(map[string][]portRule),
+	}
+
+	for i := range routes {
+		for _, pattern := range routes[i].Hosts {
+			if err := m.add(i, pattern); err != nil {
+				return nil, fmt.Errorf("route %d: host pattern %q: %w", i+1, pattern, err)
+			}
+		}
+	}
+	return &m, nil
+}
+
+func (m *hostMatcher) add(route int, pattern string) error {
+	host, port, err := splitPatternPort(pattern)
+	if err != nil {
+		return err
+	}
+	rule := portRule{route, pattern, port}
+
+	switch {
+	case host == "*":
+		m.any = append(m.any, rule)
+	case strings.HasPrefix(host, "/"):
+		if len(host) < 2 || !strings.HasSuffix(host, "/") {
+			return errors.New("unterminated regular expression")
+		}
+		// Host names are case-insensitive, and are matched in lower case
+		re, err := regexp.Compile("(?i)" + host[1:len(host)-1])
+		if err != nil {
+			return err
+		}
+		m.regexps = append(m.regexps, regexpRule{rule, re})
+	case strings.Contains(host, "/"):
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return err
+		}
+		m.prefixes = append(m.prefixes, prefixRule{rule, prefix.Masked()})
+	case strings.HasPrefix(host, "*."):
+		name := normalizeHost(host[2:])
+		m.subdomains[name] = append(m.subdomains[name], rule)
+	case strings.HasPrefix(host, "."):
+		name := normalizeHost(host[1:])
+		m.domains[name] = append(m.domains[name], rule)
+	case host == "":
+		return errors.New("empty host")
+	default:
+		name := normalizeHost(host)
+		m.exact[name] = append(m.exact[name], rule)
+	}
+	return nil
+}
+
+// ExactHostPatterns lists the host patterns of the routes that match a single host exactly, in route order.
+//
+// Such patterns used to match any host containing them, so users are warned about them.
+func ExactHostPatterns(routes []Route) []string {
+	var patterns []string
+	for i := range routes {
+		for _, pattern := range routes[i].Hosts {
+			m, err := newHostMatcher([]Route{{Hosts: []string{pattern}}})
+			if err == nil && len(m.exact) != 0 {
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	return patterns
+}
+
+// match returns the index of the first route matching the address along with the matched pattern, or false if there is none.
+func (m *hostMatcher) match(a *addr.Addr) (int, string, bool) {
+	best, bestPattern := -1, ""
+	pick := func(r portRule) bool {
+		if !r.matches(a.Port) {
+			return false
+		}
+		if best == -1 || r.route < best {
+			best, bestPattern = r.route, r.pattern
+		}
+		return true
+	}
+	pickFirst := func(rules []portRule) {
+		// Rules are stored in route order, so only the first match is of interest
+		for _, r := range rules {
+			if pick(r) {
+				break
+			}
+		}
+	}
+
+	host := normalizeHost(a.Host)
+	pickFirst(m.exact[host])
+	pickFirst(m.any)
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		for _, r := range m.prefixes {
+			if r.prefix.Contains(ip) {
+				pick(r.portRule)
+			}
+		}
+	} else {
+		// Walk up the domain tree, e.g. a.example.com, example.com, com
+		pickFirst(m.domains[host])
+		for parent := host; ; {
+			i := strings.IndexByte(parent, '.')
+			if i == -1 {
+				break
+			}
+			parent = parent[i+1:]
+			pickFirst(m.domains[parent])
+			pickFirst(m.subdomains[parent])
+		}
+	}
+
+	for _, r := range m.regexps {
+		if r.re.MatchString(host) {
+			pick(r.portRule)
+		}
+	}
+
+	if best == -1 {
+		return 0, "", false
+	}
+	return best, bestPattern, true
+}
+
+// splitPatternPort separates an optional port number from a host pattern.
+func splitPatternPort(pattern string) (string, uint16, error) {
+	host, port := pattern, ""
+	switch {
+	case strings.HasPrefix(pattern, "["):
+		// Bracketed IPv6 address or range
+		end := strings.IndexByte(pattern, ']')
+		if end == -1 {
+			return "", 0, errors.New("missing closing bracket")
+		}
+		host, port = pattern[1:end], pattern[end+1:]
+	case strings.HasPrefix(pattern, "/"):
+		// The regular expression itself may contain colons
+		end := strings.LastIndexByte(pattern, '/')
+		host, port = pattern[:end+1], pattern[end+1:]
+	case strings.Count(pattern, ":") == 1:
+		i := strings.IndexByte(pattern, ':')
+		host, port = pattern[:i], pattern[i:]
+	}
+
+	if port == "" {
+		return host, 0, nil
+	}
+	if !strings.HasPrefix(port, ":") {
+		return "", 0, fmt.Errorf("unexpected %q after host", port)
+	}
+
+	portNum, err := addr.ParsePort(port[1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("parse port: %w", err)
+	}
+	return host, portNum, nil
+}
+
+func normalizeHost(host string) string {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap().String()
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,394 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/dop251/goja"
+)
+
+// pacEvalTimeout limits the time a PAC script can spend on a single lookup.
+const pacEvalTimeout = 5 * time.Second
+
+// LoadPACFile loads a proxy auto-config script from a file.
+func LoadPACFile(path string) (*PAC, error) {
+	script, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePAC(string(script))
+}
+
+// pacUtilsProgram defines the standard PAC helper functions, compiled once for all scripts.
+var pacUtilsProgram = goja.MustCompile("pac_utils.js", pacUtils, false)
+
+// ParsePAC compiles a proxy auto-config script, which must define a FindProxyForURL(url, host) function.
+func ParsePAC(script string) (*PAC, error) {
+	program, err := goja.Compile("proxy.pac", script, false)
+	if err != nil {
+		return nil, fmt.Errorf("compile PAC script: %w", err)
+	}
+
+	p := PAC{program: program}
+
+	// Run the script right away, so that errors in it are reported early
+	vm, err := p.newVM()
+	if err != nil {
+		return nil, err
+	}
+	p.vms.Put(vm)
+	return &p, nil
+}
+
+// PAC decides how to reach a destination by running a proxy auto-config script.
+//
+// Lookups can block on DNS, so each one is run in its own JavaScript runtime, taken from a pool.
+type PAC struct {
+	program *goja.Program
+	vms     sync.Pool
+}
+
+// pacVM is a JavaScript runtime with the PAC script loaded, which is not safe for concurrent use.
+type pacVM struct {
+	vm        *goja.Runtime
+	findProxy goja.Callable
+
+	// expired tells whether the last call has run out of time
+	expired bool
+}
+
+func (p *PAC) newVM() (*pacVM, error) {
+	vm := goja.New()
+
+	// Functions that need access to the host system are implemented natively
+	natives := map[string]any{
+		"dnsResolve":   pacDNSResolve(vm),
+		"myIpAddress":  pacMyIPAddress,
+		"isResolvable": pacIsResolvable,
+		"isInNet":      pacIsInNet,
+		"alert":        func(string) {},
+	}
+	for name, fn := range natives {
+		if err := vm.Set(name, fn); err != nil {
+			return nil, fmt.Errorf("define %v: %w", name, err)
+		}
+	}
+
+	if _, err := vm.RunProgram(pacUtilsProgram); err != nil {
+		return nil, fmt.Errorf("load PAC helpers: %w", err)
+	}
+	if _, err := vm.RunProgram(p.program); err != nil {
+		return nil, fmt.Errorf("run PAC script: %w", err)
+	}
+
+	findProxy, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, errors.New("FindProxyForURL is not defined")
+	}
+	return &pacVM{vm: vm, findProxy: findProxy}, nil
+}
+
+// FindProxy returns the proxies to try in order for the destination, with a zero URL meaning a direct connection.
+func (p *PAC) FindProxy(dstAddr *addr.Addr) ([]addr.URL, error) {
+	vm, ok := p.vms.Get().(*pacVM)
+	if !ok {
+		var err error
+		if vm, err = p.newVM(); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := vm.call(pacURL(dstAddr), dstAddr.Host)
+
+	// Runtimes that timed out may still get interrupted, so they are not reused
+	if !vm.expired {
+		p.vms.Put(vm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("call FindProxyForURL: %w", err)
+	}
+	return parsePACResult(res)
+}
+
+// call runs FindProxyForURL, treating a missing result as an empty one, which means a direct connection.
+func (v *pacVM) call(url, host string) (string, error) {
+	timer := time.AfterFunc(pacEvalTimeout, func() {
+		v.vm.Interrupt("PAC evaluation timed out")
+	})
+	res, err := v.findProxy(goja.Undefined(), v.vm.ToValue(url), v.vm.ToValue(host))
+	v.expired = !timer.Stop()
+
+	if err != nil {
+		return "", err
+	}
+	if goja.IsNull(res) || goja.IsUndefined(res) {
+		return "", nil
+	}
+	return res.String(), nil
+}
+
+// parsePACResult converts a string like "PROXY a:3128; SOCKS5 b:1080; DIRECT" into a list of proxy URLs.
+func parsePACResult(res string) ([]addr.URL, error) {
+	var urls []addr.URL
+	for _, entry := range strings.Split(res, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var proto addr.Proto
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			urls = append(urls, addr.URL{})
+			continue
+		case "PROXY", "HTTP":
+			proto = addr.ProtoHTTP
+		case "SOCKS", "SOCKS4":
+			proto = addr.ProtoSOCKS4a
+		case "SOCKS5":
+			proto = addr.ProtoSOCKS5h
+		default:
+			// Skip proxy types that are not supported, e.g. HTTPS or QUIC
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed PAC entry %q", entry)
+		}
+		proxyAddr, err := addr.ParseAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("parse PAC entry %q: %w", entry, err)
+		}
+		urls = append(urls, *addr.NewURL(proto, proxyAddr.Host, proxyAddr.Port))
+	}
+
+	// An empty result means a direct connection
+	if strings.TrimSpace(res) == "" {
+		return []addr.URL{{}}, nil
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no supported proxies in %q", res)
+	}
+	return urls, nil
+}
+
+func pacURL(a *addr.Addr) string {
+	host := a.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	switch a.Port {
+	case 443:
+		return "https://" + host + "/"
+	case 80:
+		return "http://" + host + "/"
+	default:
+		return "http://" + a.String() + "/"
+	}
+}
+
+func pacDNSResolve(vm *goja.Runtime) func(string) goja.Value {
+	return func(host string) goja.Value {
+		ip, err := resolveIPv4(host)
+		if err != nil {
+			return goja.Null()
+		}
+		return vm.ToValue(ip.String())
+	}
+}
+
+func pacIsResolvable(host string) bool {
+	_, err := resolveIPv4(host)
+	return err == nil
+}
+
+func pacIsInNet(host, pattern, mask string) bool {
+	ip, err := resolveIPv4(host)
+	if err != nil {
+		return false
+	}
+
+	patternIP, maskIP := net.ParseIP(pattern).To4(), net.ParseIP(mask).To4()
+	if patternIP == nil || maskIP == nil {
+		return false
+	}
+	return ip.Mask(net.IPMask(maskIP)).Equal(patternIP.Mask(net.IPMask(maskIP)))
+}
+
+func pacMyIPAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				return ipNet.IP.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+func resolveIPv4(host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
+		}
+		return nil, errors.New("not an IPv4 address")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pacEvalTimeout)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0].To4(), nil
+}
+
+// pacUtils implements the standard PAC helper functions that need no access to the host system.
+const pacUtils = `
+function isPlainHostName(host) {
+	return host.indexOf('.') < 0;
+}
+
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length &&
+		host.substring(host.length - domain.length) === domain;
+}
+
+function localHostOrDomainIs(host, hostdom) {
+	return host === hostdom || hostdom.lastIndexOf(host + '.', 0) === 0;
+}
+
+function dnsDomainLevels(host) {
+	return host.split('.').length - 1;
+}
+
+function convert_addr(ipchars) {
+	var bytes = ipchars.split('.');
+	return (((bytes[0] & 0xff) << 24) |
+		((bytes[1] & 0xff) << 16) |
+		((bytes[2] & 0xff) << 8) |
+		(bytes[3] & 0xff)) >>> 0;
+}
+
+function shExpMatch(str, shexp) {
+	var re = shexp
+		.replace(/[.+^${}()|[\]\\]/g, '\\$&')
+		.replace(/\*/g, '.*')
+		.replace(/\?/g, '.');
+	return new RegExp('^' + re + '$').test(str);
+}
+
+var _pacWeekdays = ['SUN', 'MON', 'TUE', 'WED', 'THU', 'FRI', 'SAT'];
+var _pacMonths = ['JAN', 'FEB', 'MAR', 'APR', 'MAY', 'JUN', 'JUL', 'AUG', 'SEP', 'OCT', 'NOV', 'DEC'];
+
+function _pacArgs(args) {
+	args = Array.prototype.slice.call(args);
+	var gmt = args.length > 0 && args[args.length - 1] === 'GMT';
+	if (gmt) {
+		args.pop();
+	}
+	return { args: args, gmt: gmt, now: new Date() };
+}
+
+function _pacInRange(start, end, value) {
+	// Ranges may wrap around, e.g. from Friday to Monday
+	return start <= end ? start <= value && value <= end : value >= start || value <= end;
+}
+
+function weekdayRange() {
+	var a = _pacArgs(arguments);
+	var today = a.gmt ? a.now.getUTCDay() : a.now.getDay();
+	var wd1 = _pacWeekdays.indexOf(a.args[0]);
+	var wd2 = a.args.length > 1 ? _pacWeekdays.indexOf(a.args[1]) : wd1;
+	if (wd1 < 0 || wd2 < 0) {
+		return false;
+	}
+	return _pacInRange(wd1, wd2, today);
+}
+
+function dateRange() {
+	var a = _pacArgs(arguments);
+	var now = {
+		day: a.gmt ? a.now.getUTCDate() : a.now.getDate(),
+		month: a.gmt ? a.now.getUTCMonth() : a.now.getMonth(),
+		year: a.gmt ? a.now.getUTCFullYear() : a.now.getFullYear()
+	};
+
+	function parse(values) {
+		var d = {};
+		for (var i = 0; i < values.length; i++) {
+			var v = values[i];
+			var month = _pacMonths.indexOf(v);
+			if (month >= 0) {
+				d.month = month;
+			} else if (typeof v === 'number' && v > 31) {
+				d.year = v;
+			} else if (typeof v === 'number') {
+				d.day = v;
+			} else {
+				return null;
+			}
+		}
+		return d;
+	}
+
+	function key(d, like) {
+		var k = 0;
+		if (like.year !== undefined) {
+			k += d.year * 10000;
+		}
+		if (like.month !== undefined) {
+			k += d.month * 100;
+		}
+		if (like.day !== undefined) {
+			k += d.day;
+		}
+		return k;
+	}
+
+	var args = a.args;
+	if (args.length === 0 || args.length % 2 !== 0 && args.length !== 1) {
+		return false;
+	}
+
+	var half = args.length === 1 ? 1 : args.length / 2;
+	var start = parse(args.slice(0, half));
+	var end = args.length === 1 ? start : parse(args.slice(half));
+	if (start === null || end === null) {
+		return false;
+	}
+	return _pacInRange(key(start, start), key(end, start), key(now, start));
+}
+
+function timeRange() {
+	var a = _pacArgs(arguments);
+	var args = a.args;
+	var h = a.gmt ? a.now.getUTCHours() : a.now.getHours();
+	var m = a.gmt ? a.now.getUTCMinutes() : a.now.getMinutes();
+	var s = a.gmt ? a.now.getUTCSeconds() : a.now.getSeconds();
+	var now = h * 3600 + m * 60 + s;
+
+	switch (args.length) {
+	case 1:
+		return h === args[0];
+	case 2:
+		return _pacInRange(args[0] * 3600, args[1] * 3600 - 1, now);
+	case 4:
+		return _pacInRange(args[0] * 3600 + args[1] * 60, args[2] * 3600 + args[3] * 60 - 1, now);
+	case 6:
+		return _pacInRange(args[0] * 3600 + args[1] * 60 + args[2], args[3] * 3600 + args[4] * 60 + args[5], now);
+	default:
+		return false;
+	}
+}
+`
@@ -0,0 +1,179 @@
+package router_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/router"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestPAC(t *testing.T) {
+	suite.Run(t, new(PACTest))
+}
+
+type PACTest struct {
+	suite.Suite
+}
+
+const testPAC = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host)) {
+		return "DIRECT";
+	}
+	if (dnsDomainIs(host, ".corp.example.com")) {
+		return "PROXY corp:3128";
+	}
+	if (shExpMatch(host, "*.dev.example.??")) {
+		return "SOCKS5 dev:1080";
+	}
+	if (isInNet(host, "10.0.0.0", "255.0.0.0")) {
+		return "SOCKS bastion:1080";
+	}
+	if (localHostOrDomainIs(host, "www.example.com") && dnsDomainLevels(host) == 2) {
+		return null;
+	}
+	if (url.substring(0, 6) == "https:") {
+		return "HTTPS secure:443; PROXY secure:3128";
+	}
+	return "PROXY a:3128; SOCKS5 b:1080; DIRECT";
+}
+`
+
+func (t *PACTest) TestFindProxy() {
+	tests := map[string]struct {
+		dst  *addr.Addr
+		want []addr.URL
+	}{
+		"plain host names": {
+			dst:  addr.NewAddr("intranet", 80),
+			want: []addr.URL{{}},
+		},
+
+		"dnsDomainIs": {
+			dst:  addr.NewAddr("wiki.corp.example.com", 80),
+			want: []addr.URL{*addr.NewURL(addr.ProtoHTTP, "corp", 3128)},
+		},
+
+		"shExpMatch": {
+			dst:  addr.NewAddr("api.dev.example.io", 80),
+			want: []addr.URL{*addr.NewURL(addr.ProtoSOCKS5h, "dev", 1080)},
+		},
+
+		"isInNet": {
+			dst:  addr.NewAddr("10.1.2.3", 22),
+			want: []addr.URL{*addr.NewURL(addr.ProtoSOCKS4a, "bastion", 1080)},
+		},
+
+		"null result": {
+			dst:  addr.NewAddr("www.example.com", 80),
+			want: []addr.URL{{}},
+		},
+
+		"https URLs skipping unsupported proxy types": {
+			dst:  addr.NewAddr("example.org", 443),
+			want: []addr.URL{*addr.NewURL(addr.ProtoHTTP, "secure", 3128)},
+		},
+
+		"multiple candidates in order": {
+			dst: addr.NewAddr("example.org", 80),
+			want: []addr.URL{
+				*addr.NewURL(addr.ProtoHTTP, "a", 3128),
+				*addr.NewURL(addr.ProtoSOCKS5h, "b", 1080),
+				{},
+			},
+		},
+	}
+
+	pac, err := router.ParsePAC(testPAC)
+	t.Require().NoError(err)
+
+	for name, test := range tests {
+		t.Run(name, func() {
+			got, err := pac.FindProxy(test.dst)
+			t.Require().NoError(err)
+
+			t.Equal(test.want, got)
+		})
+	}
+
+	t.Run("supports time-based conditions", func() {
+		pac, err := router.ParsePAC(`
+function FindProxyForURL(url, host) {
+	if (weekdayRange("SUN", "SAT") && dateRange("JAN", "DEC") && timeRange(0, 24) && !weekdayRange("XYZ")) {
+		return "DIRECT";
+	}
+	return "PROXY a:3128";
+}
+`)
+		t.Require().NoError(err)
+
+		got, err := pac.FindProxy(addr.NewAddr("example.com", 80))
+		t.Require().NoError(err)
+		t.Equal([]addr.URL{{}}, got)
+	})
+
+	t.Run("does not make lookups wait for each other", func() {
+		pac, err := router.ParsePAC(`
+function FindProxyForURL(url, host) {
+	if (host === "slow.example.com") {
+		var start = Date.now();
+		while (Date.now() - start < 1000) {}
+	}
+	return "DIRECT";
+}
+`)
+		t.Require().NoError(err)
+
+		slowDone := make(chan struct{})
+		go func() {
+			defer close(slowDone)
+			_, _ = pac.FindProxy(addr.NewAddr("slow.example.com", 80))
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		_, err = pac.FindProxy(addr.NewAddr("fast.example.com", 80))
+		t.Require().NoError(err)
+		select {
+		case <-slowDone:
+			t.Fail("lookup waited for another one to finish")
+		default:
+		}
+		<-slowDone
+	})
+
+	t.Run("reports malformed results", func() {
+		pac, err := router.ParsePAC(`function FindProxyForURL(url, host) { return "PROXY"; }`)
+		t.Require().NoError(err)
+
+		_, err = pac.FindProxy(addr.NewAddr("example.com", 80))
+		t.Error(err)
+	})
+}
+
+func (t *PACTest) TestParse() {
+	t.Run("rejects scripts without FindProxyForURL", func() {
+		_, err := router.ParsePAC(`function findProxy(url, host) { return "DIRECT"; }`)
+		t.Error(err)
+	})
+
+	t.Run("rejects scripts with syntax errors", func() {
+		_, err := router.ParsePAC(`function FindProxyForURL(url, host) {`)
+		t.Error(err)
+	})
+
+	t.Run("loads scripts from files", func() {
+		path := filepath.Join(t.T().TempDir(), "proxy.pac")
+		t.Require().NoError(os.WriteFile(path, []byte(testPAC), 0o600))
+
+		pac, err := router.LoadPACFile(path)
+		t.Require().NoError(err)
+
+		got, err := pac.FindProxy(addr.NewAddr("intranet", 80))
+		t.Require().NoError(err)
+		t.Equal([]addr.URL{{}}, got)
+	})
+}
@@ -0,0 +1,143 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+)
+
+// maxDatagramSize is large enough to hold any UDP payload.
+const maxDatagramSize = 64 * 1024
+
+func newRoutedPacketConn(ctx context.Context, r *Router) *routedPacketConn {
+	return &routedPacketConn{
+		ctx:    ctx,
+		router: r,
+		conns:  make(map[*balancer]proxy.PacketConn),
+		reads:  make(chan routedDatagram),
+		done:   make(chan struct{}),
+	}
+}
+
+// routedPacketConn sends datagrams through the routes for their destinations, opening a packet connection for each route on first use.
+type routedPacketConn struct {
+	// ctx limits the lifetime of the packet connections opened for routes
+	ctx    context.Context
+	router *Router
+
+	mu     sync.Mutex
+	conns  map[*balancer]proxy.PacketConn
+	closed bool
+
+	// reads collects the datagrams received through all of the routes
+	reads chan routedDatagram
+	done  chan struct{}
+}
+
+type routedDatagram struct {
+	data    []byte
+	srcAddr *addr.Addr
+}
+
+func (c *routedPacketConn) ReadFrom(p []byte) (int, *addr.Addr, error) {
+	select {
+	case d := <-c.reads:
+		return copy(p, d.data), d.srcAddr, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *routedPacketConn) WriteTo(p []byte, dstAddr *addr.Addr) (int, error) {
+	policy, bal, rule, _ := c.router.matchRoute(dstAddr)
+	if policy.Action == ActionReject {
+		return 0, fmt.Errorf("%w: %v", proxy.ErrRejected, rule)
+	}
+
+	conn, err := c.routeConn(policy, bal, rule)
+	if err != nil {
+		return 0, err
+	}
+	return conn.WriteTo(p, dstAddr)
+}
+
+func (c *routedPacketConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+
+	var errs []error
+	for _, conn := range c.conns {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// routeConn finds the packet connection for the route, opening it if there is none yet.
+func (c *routedPacketConn) routeConn(policy *Route, bal *balancer, rule string) (proxy.PacketConn, error) {
+	c.mu.Lock()
+	conn, ok := c.conns[bal]
+	c.mu.Unlock()
+	if ok {
+		return conn, nil
+	}
+
+	// Do not keep other routes waiting while connecting
+	conn, err := c.router.dialPacket(c.ctx, policy, bal, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	if other, ok := c.conns[bal]; ok {
+		conn.Close()
+		return other, nil
+	}
+	c.conns[bal] = conn
+
+	go c.receive(bal, conn)
+	return conn, nil
+}
+
+// receive delivers the datagrams received through a route, until its packet connection fails.
+func (c *routedPacketConn) receive(bal *balancer, conn proxy.PacketConn) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, srcAddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+
+		select {
+		case c.reads <- routedDatagram{slices.Clone(buf[:n]), srcAddr}:
+		case <-c.done:
+			return
+		}
+	}
+
+	// Open the connection again for the next datagram through the route
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		delete(c.conns, bal)
+		conn.Close()
+	}
+}
@@ -2,25 +2,54 @@ package router
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/cerfical/socks2http/internal/proxy"
 	"github.com/cerfical/socks2http/internal/proxy/addr"
 	"github.com/cerfical/socks2http/internal/proxy/client"
 )
 
-func New(ops ...Option) *Router {
+func New(ops ...Option) (*Router, error) {
 	defaults := []Option{
 		WithDialer(proxy.DirectDialer),
+		WithPacketDialer(proxy.DirectPacketDialer),
+		WithLogger(proxy.DiscardLogger),
+		WithMetrics(proxy.DiscardMetrics),
 	}
 
 	var r Router
 	for _, op := range slices.Concat(defaults, ops) {
 		op(&r)
 	}
-	return &r
+
+	for i := range r.routes {
+		if err := r.routes[i].validate(); err != nil {
+			return nil, fmt.Errorf("route %d: %w", i+1, err)
+		}
+		r.balancers = append(r.balancers, newBalancer(fmt.Sprintf("route %d", i+1), &r.routes[i]))
+	}
+	if err := r.defaultRoute.validate(); err != nil {
+		return nil, fmt.Errorf("default route: %w", err)
+	}
+	r.defaultBalancer = newBalancer("default", &r.defaultRoute)
+
+	if r.healthCheck.Probe != nil {
+		r.healthCheck = r.healthCheck.withDefaults()
+	}
+
+	// Compile host patterns once, instead of parsing them on every lookup
+	m, err := newHostMatcher(r.routes)
+	if err != nil {
+		return nil, err
+	}
+	r.matcher = m
+
+	return &r, nil
 }
 
 func WithDefaultRoute(r *Route) Option {
@@ -35,6 +64,46 @@ func WithDialer(d proxy.Dialer) Option {
 	}
 }
 
+func WithPacketDialer(d proxy.PacketDialer) Option {
+	return func(r *Router) {
+		r.packetDialer = d
+	}
+}
+
+// WithDialTimeout limits the time spent connecting through each of the upstreams, with zero meaning no limit.
+func WithDialTimeout(d time.Duration) Option {
+	return func(r *Router) {
+		r.dialTimeout = d
+	}
+}
+
+func WithLogger(l proxy.Logger) Option {
+	return func(r *Router) {
+		r.log = l
+	}
+}
+
+// WithMetrics makes the router report the time spent connecting through each of the upstreams.
+func WithMetrics(m proxy.Metrics) Option {
+	return func(r *Router) {
+		r.metrics = m
+	}
+}
+
+// WithHealthCheck enables active health checking of upstreams, which must then be run with [Router.RunHealthChecks].
+func WithHealthCheck(hc *HealthCheck) Option {
+	return func(r *Router) {
+		r.healthCheck = *hc
+	}
+}
+
+// WithPAC makes the router consult a proxy auto-config script for destinations not matched by any route.
+func WithPAC(p *PAC) Option {
+	return func(r *Router) {
+		r.pac = p
+	}
+}
+
 func WithRoutes(routes []Route) Option {
 	return func(r *Router) {
 		r.routes = routes
@@ -44,39 +113,283 @@ func WithRoutes(routes []Route) Option {
 type Option func(r *Router)
 
 type Route struct {
+	// Hosts is a list of host patterns, as described by [hostMatcher].
 	Hosts []string
-	Proxy addr.URL
+
+	// Proxy is a chain of proxies to connect through, in order, with an empty chain meaning a direct connection.
+	Proxy []addr.URL
+
+	// Upstreams, if set, lists several proxy chains to choose from, instead of a single Proxy.
+	Upstreams [][]addr.URL
+	Strategy  Strategy
+
+	Action Action
+
+	// DialTimeout and IdleTimeout, if set, override the timeouts of the router and tunneler respectively.
+	DialTimeout time.Duration
+	IdleTimeout time.Duration
+
+	// Bandwidth, if set, limits the data transferred through all tunnels opened by the route together.
+	Bandwidth proxy.Bandwidth
+}
+
+func (r *Route) validate() error {
+	if r.Action != ActionProxy && (len(r.Proxy) != 0 || len(r.Upstreams) != 0) {
+		return fmt.Errorf("proxies are not used by action %v", r.Action)
+	}
+	if len(r.Proxy) != 0 && len(r.Upstreams) != 0 {
+		return errors.New("proxy and upstreams are mutually exclusive")
+	}
+	return nil
 }
 
 type Router struct {
-	dialer proxy.Dialer
-	routes []Route
+	dialer       proxy.Dialer
+	packetDialer proxy.PacketDialer
+	routes       []Route
+	balancers    []*balancer
+	matcher      *hostMatcher
+	pac          *PAC
+	healthCheck  HealthCheck
+	dialTimeout  time.Duration
+	log          proxy.Logger
+	metrics      proxy.Metrics
 
-	defaultRoute Route
+	defaultRoute    Route
+	defaultBalancer *balancer
 }
 
 func (r *Router) Dial(ctx context.Context, dstAddr *addr.Addr) (net.Conn, error) {
-	policy := r.matchRoute(dstAddr.Host)
-
-	client := client.New(
-		client.WithDialer(r.dialer),
-		client.WithProxyURL(&policy.Proxy),
-	)
-	return client.Dial(ctx, dstAddr)
-}
-
-func (r *Router) matchRoute(host string) *Route {
-	i := slices.IndexFunc(r.routes, func(r Route) bool {
-		// Check if the host matches any of the route's hosts
-		for _, h := range r.Hosts {
-			if strings.Contains(host, h) {
-				return true
-			}
+	policy, bal, rule, ok := r.matchRoute(dstAddr)
+	if !ok && r.pac != nil {
+		return r.dialPAC(ctx, dstAddr)
+	}
+
+	conn, err := r.dialRoute(ctx, dstAddr, policy, bal, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	if bal.throttle != nil {
+		conn = proxy.WithThrottle(conn, bal.throttle)
+	}
+
+	// The idle timeout is looked up on the outermost connection, so it must come last
+	if policy.IdleTimeout > 0 {
+		return proxy.WithIdleTimeout(conn, policy.IdleTimeout), nil
+	}
+	return conn, nil
+}
+
+func (r *Router) dialRoute(ctx context.Context, dstAddr *addr.Addr, policy *Route, bal *balancer, rule string) (net.Conn, error) {
+	timeout := r.routeDialTimeout(policy)
+
+	switch policy.Action {
+	case ActionDirect:
+		return r.dialDirect(ctx, dstAddr, bal.name, timeout)
+	case ActionReject:
+		return nil, fmt.Errorf("%w: %v", proxy.ErrRejected, rule)
+	}
+
+	order := bal.order()
+	if len(order) == 0 {
+		if r.healthCheck.FallbackDirect {
+			return r.dialDirect(ctx, dstAddr, bal.name, timeout)
 		}
-		return false
-	})
-	if i != -1 {
-		return &r.routes[i]
+		return nil, fmt.Errorf("%w: %v", ErrNoHealthyUpstream, rule)
+	}
+
+	chains := make([][]addr.URL, len(order))
+	for i, j := range order {
+		chains[i] = bal.upstreams[j]
+	}
+
+	conn, i, err := r.dialFirst(ctx, dstAddr, bal.name, chains, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return bal.track(order[i], conn), nil
+}
+
+func (r *Router) dialDirect(ctx context.Context, dstAddr *addr.Addr, route string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := r.dialer.Dial(ctx, dstAddr)
+	r.metrics.DialDone(route, chainName(nil), time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.WithRoute(conn, route, chainName(nil)), nil
+}
+
+// Check reports whether the routes allow reaching the destination, for traffic that does not go through [Router.Dial].
+func (r *Router) Check(dstAddr *addr.Addr) error {
+	policy, _, rule, ok := r.matchRoute(dstAddr)
+	if !ok && r.pac != nil {
+		// PAC scripts can only choose proxies, not reject destinations
+		return nil
+	}
+
+	if policy.Action == ActionReject {
+		return fmt.Errorf("%w: %v", proxy.ErrRejected, rule)
+	}
+	return nil
+}
+
+// DialPacket opens a packet connection sending each datagram through the route for its destination.
+//
+// Datagrams to destinations rejected by the routes are dropped.
+// PAC scripts only decide on proxies for TCP, so datagrams to destinations not matched by any route go through the default route.
+func (r *Router) DialPacket(ctx context.Context) (proxy.PacketConn, error) {
+	conn := newRoutedPacketConn(ctx, r)
+
+	// Most datagrams are likely to go through the default route, so report problems with it right away
+	if r.defaultRoute.Action != ActionReject {
+		if _, err := conn.routeConn(&r.defaultRoute, r.defaultBalancer, "default route"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (r *Router) dialPacket(ctx context.Context, policy *Route, bal *balancer, rule string) (proxy.PacketConn, error) {
+	timeout := r.routeDialTimeout(policy)
+
+	switch policy.Action {
+	case ActionDirect:
+		return r.packetDialer.DialPacket(ctx)
+	case ActionReject:
+		return nil, fmt.Errorf("%w: %v", proxy.ErrRejected, rule)
+	}
+
+	order := bal.order()
+	if len(order) == 0 {
+		if r.healthCheck.FallbackDirect {
+			return r.packetDialer.DialPacket(ctx)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrNoHealthyUpstream, rule)
+	}
+
+	var errs []error
+	for _, i := range order {
+		chain := bal.upstreams[i]
+		client := client.New(
+			client.WithDialer(r.dialer),
+			client.WithPacketDialer(r.packetDialer),
+			client.WithProxyChain(chain),
+		)
+
+		dialCtx, cancel := withTimeout(ctx, timeout)
+		start := time.Now()
+		conn, err := client.DialPacket(dialCtx)
+		r.metrics.DialDone(bal.name, chainName(chain), time.Since(start), err)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("%v: %w", chainName(chain), err))
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, joinDialErrors(errs)
+}
+
+// dialPAC tries each of the candidates returned by the PAC script in turn, until one succeeds.
+func (r *Router) dialPAC(ctx context.Context, dstAddr *addr.Addr) (net.Conn, error) {
+	candidates, err := r.pac.FindProxy(dstAddr)
+	if err != nil {
+		return nil, fmt.Errorf("evaluate PAC: %w", err)
+	}
+
+	chains := make([][]addr.URL, len(candidates))
+	for i := range candidates {
+		chains[i] = candidates[i : i+1]
+	}
+
+	conn, _, err := r.dialFirst(ctx, dstAddr, "pac", chains, r.dialTimeout)
+	return conn, err
+}
+
+// dialFirst connects to the destination through each of the proxy chains in turn, until one succeeds.
+func (r *Router) dialFirst(ctx context.Context, dstAddr *addr.Addr, route string, chains [][]addr.URL, timeout time.Duration) (net.Conn, int, error) {
+	var errs []error
+	for i, chain := range chains {
+		client := client.New(
+			client.WithDialer(r.dialer),
+			client.WithProxyChain(chain),
+		)
+
+		// Each candidate gets its own time limit, so that a slow upstream leaves time for the next one
+		dialCtx, cancel := withTimeout(ctx, timeout)
+		start := time.Now()
+		conn, err := client.Dial(dialCtx, dstAddr)
+		r.metrics.DialDone(route, chainName(chain), time.Since(start), err)
+		cancel()
+		if err == nil {
+			return proxy.WithRoute(conn, route, chainName(chain)), i, nil
+		}
+		errs = append(errs, fmt.Errorf("%v: %w", chainName(chain), err))
+
+		// Do not try other candidates if the caller is no longer interested
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, joinDialErrors(errs)
+}
+
+func (r *Router) routeDialTimeout(route *Route) time.Duration {
+	if route.DialTimeout > 0 {
+		return route.DialTimeout
+	}
+	return r.dialTimeout
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func joinDialErrors(errs []error) error {
+	// Keep the error as is if there was nothing else to try
+	if len(errs) == 1 {
+		return errors.Unwrap(errs[0])
+	}
+	return errors.Join(errs...)
+}
+
+func chainName(chain []addr.URL) string {
+	var names []string
+	for i := range chain {
+		if chain[i].IsZero() {
+			continue
+		}
+
+		// Names end up in metric labels, which must neither leak credentials nor vary by user
+		u := chain[i]
+		u.Username, u.Password = "", ""
+		names = append(names, u.String())
+	}
+
+	if len(names) == 0 {
+		return "DIRECT"
+	}
+	return strings.Join(names, " -> ")
+}
+
+// matchRoute finds the route for the address, along with a description of the rule that selected it.
+//
+// If no route matches, the default route is returned with ok set to false.
+func (r *Router) matchRoute(dstAddr *addr.Addr) (route *Route, bal *balancer, rule string, ok bool) {
+	if i, pattern, ok := r.matcher.match(dstAddr); ok {
+		return &r.routes[i], r.balancers[i], fmt.Sprintf("route %d (%q)", i+1, pattern), true
 	}
-	return &r.defaultRoute
+	return &r.defaultRoute, r.defaultBalancer, "default route", false
 }
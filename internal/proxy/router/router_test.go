@@ -1,10 +1,17 @@
 package router_test
 
 import (
+	"bufio"
 	"context"
 	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/cerfical/socks2http/internal/proxy"
 	"github.com/cerfical/socks2http/internal/proxy/addr"
 	"github.com/cerfical/socks2http/internal/proxy/mocks"
 	"github.com/cerfical/socks2http/internal/proxy/router"
@@ -36,19 +43,20 @@ func (t *RouterTest) TestDial() {
 			Dial(mock.Anything, proxyURL2.Addr()).
 			Return(nil, errors.New("redirected to Proxy#2"))
 
-		router := router.New(
+		router, err := router.New(
 			router.WithDialer(dialer),
 			router.WithRoutes([]router.Route{{
 				Hosts: []string{dstAddr1.Host},
-				Proxy: *proxyURL1,
+				Proxy: []addr.URL{*proxyURL1},
 			}, {
 				Hosts: []string{dstAddr2.Host},
-				Proxy: *proxyURL2,
+				Proxy: []addr.URL{*proxyURL2},
 			}}),
 		)
+		t.Require().NoError(err)
 
 		// Check that the first proxy is called for the first address
-		_, err := router.Dial(context.Background(), dstAddr1)
+		_, err = router.Dial(context.Background(), dstAddr1)
 		t.ErrorContains(err, "Proxy#1")
 
 		// Check that the second proxy is called for the second address
@@ -65,14 +73,924 @@ func (t *RouterTest) TestDial() {
 			Dial(mock.Anything, proxyURL.Addr()).
 			Return(nil, errors.New("redirected to Proxy"))
 
-		router := router.New(
+		router, err := router.New(
 			router.WithDialer(dialer),
 			router.WithDefaultRoute(&router.Route{
-				Proxy: *proxyURL,
+				Proxy: []addr.URL{*proxyURL},
 			}),
 		)
+		t.Require().NoError(err)
 
-		_, err := router.Dial(context.Background(), dstAddr)
+		_, err = router.Dial(context.Background(), dstAddr)
 		t.ErrorContains(err, "Proxy")
 	})
 }
+
+func (t *RouterTest) TestDial_HostPatterns() {
+	tests := map[string]struct {
+		pattern string
+		match   []*addr.Addr
+		noMatch []*addr.Addr
+	}{
+		"exact names match only the name itself": {
+			pattern: "google.com",
+			match:   []*addr.Addr{addr.NewAddr("google.com", 443), addr.NewAddr("Google.COM.", 80)},
+			noMatch: []*addr.Addr{addr.NewAddr("notgoogle.com.evil.net", 443), addr.NewAddr("mail.google.com", 443)},
+		},
+
+		"*.domain matches only subdomains": {
+			pattern: "*.example.com",
+			match:   []*addr.Addr{addr.NewAddr("www.example.com", 80), addr.NewAddr("a.b.example.com", 80)},
+			noMatch: []*addr.Addr{addr.NewAddr("example.com", 80), addr.NewAddr("badexample.com", 80)},
+		},
+
+		".domain matches the domain and its subdomains": {
+			pattern: ".example.com",
+			match:   []*addr.Addr{addr.NewAddr("example.com", 80), addr.NewAddr("www.example.com", 80)},
+			noMatch: []*addr.Addr{addr.NewAddr("badexample.com", 80)},
+		},
+
+		"regular expressions match host names": {
+			pattern: `/^(www|mail)\.example\.(com|org)$/`,
+			match:   []*addr.Addr{addr.NewAddr("www.example.org", 80), addr.NewAddr("mail.example.com", 80)},
+			noMatch: []*addr.Addr{addr.NewAddr("ftp.example.com", 80)},
+		},
+
+		"IPv4 CIDR blocks match addresses in range": {
+			pattern: "10.0.0.0/8",
+			match:   []*addr.Addr{addr.NewAddr("10.1.2.3", 80)},
+			noMatch: []*addr.Addr{addr.NewAddr("11.0.0.1", 80), addr.NewAddr("10.example.com", 80)},
+		},
+
+		"IPv6 CIDR blocks match addresses in range": {
+			pattern: "fd00::/8",
+			match:   []*addr.Addr{addr.NewAddr("fd12::1", 80)},
+			noMatch: []*addr.Addr{addr.NewAddr("fe80::1", 80)},
+		},
+
+		"exact IP addresses match in canonical form": {
+			pattern: "2001:db8::1",
+			match:   []*addr.Addr{addr.NewAddr("2001:0db8:0:0::1", 80)},
+			noMatch: []*addr.Addr{addr.NewAddr("2001:db8::2", 80)},
+		},
+
+		"regular expressions ignore case": {
+			pattern: `/^WWW\.Example\.com$/`,
+			match:   []*addr.Addr{addr.NewAddr("www.example.com", 80), addr.NewAddr("WWW.EXAMPLE.COM", 80)},
+			noMatch: []*addr.Addr{addr.NewAddr("mail.example.com", 80)},
+		},
+
+		"port constraints restrict name matches": {
+			pattern: "example.com:443",
+			match:   []*addr.Addr{addr.NewAddr("example.com", 443)},
+			noMatch: []*addr.Addr{addr.NewAddr("example.com", 80)},
+		},
+
+		"port constraints restrict bracketed IPv6 ranges": {
+			pattern: "[fd00::/8]:443",
+			match:   []*addr.Addr{addr.NewAddr("fd00::1", 443)},
+			noMatch: []*addr.Addr{addr.NewAddr("fd00::1", 80)},
+		},
+
+		"port constraints restrict regular expressions": {
+			pattern: "/example/:8080",
+			match:   []*addr.Addr{addr.NewAddr("example.com", 8080)},
+			noMatch: []*addr.Addr{addr.NewAddr("example.com", 80)},
+		},
+
+		"wildcard matches any host": {
+			pattern: "*",
+			match:   []*addr.Addr{addr.NewAddr("example.com", 80), addr.NewAddr("127.0.0.1", 80)},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func() {
+			router := t.newPatternRouter(test.pattern)
+
+			for _, a := range test.match {
+				_, err := router.Dial(context.Background(), a)
+				t.ErrorContains(err, "dialed matched", a.String())
+			}
+			for _, a := range test.noMatch {
+				_, err := router.Dial(context.Background(), a)
+				t.ErrorContains(err, "dialed unmatched", a.String())
+			}
+		})
+	}
+
+	t.Run("earlier routes take precedence", func() {
+		router, err := router.New(
+			router.WithDialer(t.proxyNameDialer()),
+			router.WithRoutes([]router.Route{{
+				Hosts: []string{"*.example.com"},
+				Proxy: []addr.URL{*addr.NewURL(addr.ProtoHTTP, "first", 8080)},
+			}, {
+				Hosts: []string{"www.example.com"},
+				Proxy: []addr.URL{*addr.NewURL(addr.ProtoHTTP, "second", 8080)},
+			}}),
+		)
+		t.Require().NoError(err)
+
+		_, err = router.Dial(context.Background(), addr.NewAddr("www.example.com", 80))
+		t.ErrorContains(err, "first")
+	})
+
+	t.Run("rejects invalid patterns", func() {
+		patterns := []string{"/unterminated", "/(/", "10.0.0.0/33", "example.com:http", "[fd00::/8"}
+		for _, p := range patterns {
+			_, err := router.New(router.WithRoutes([]router.Route{{Hosts: []string{p}}}))
+			t.Error(err, p)
+		}
+	})
+}
+
+func (t *RouterTest) TestExactHostPatterns() {
+	t.Run("lists patterns matching a single host", func() {
+		routes := []router.Route{
+			{Hosts: []string{"example.com", "*.example.com", ".example.org"}},
+			{Hosts: []string{"10.0.0.1:443", "10.0.0.0/8", "/example/", "*"}},
+		}
+
+		t.Equal([]string{"example.com", "10.0.0.1:443"}, router.ExactHostPatterns(routes))
+	})
+}
+
+func (t *RouterTest) TestDial_Actions() {
+	proxyURL := addr.NewURL(addr.ProtoHTTP, "proxy", 8080)
+
+	t.Run("direct routes bypass the proxy", func() {
+		router, err := router.New(
+			router.WithDialer(t.proxyNameDialer()),
+			router.WithRoutes([]router.Route{{
+				Hosts:  []string{".example.com"},
+				Action: router.ActionDirect,
+			}}),
+			router.WithDefaultRoute(&router.Route{
+				Proxy: []addr.URL{*proxyURL},
+			}),
+		)
+		t.Require().NoError(err)
+
+		_, err = router.Dial(context.Background(), addr.NewAddr("www.example.com", 80))
+		t.ErrorContains(err, "dialed www.example.com")
+	})
+
+	t.Run("reject routes refuse to connect and name the matching rule", func() {
+		router, err := router.New(
+			router.WithDialer(mocks.NewDialer(t.T())),
+			router.WithRoutes([]router.Route{{
+				Hosts:  []string{"*.ads.example.com"},
+				Action: router.ActionReject,
+			}}),
+		)
+		t.Require().NoError(err)
+
+		_, err = router.Dial(context.Background(), addr.NewAddr("banner.ads.example.com", 443))
+		t.ErrorIs(err, proxy.ErrRejected)
+		t.ErrorContains(err, `route 1 ("*.ads.example.com")`)
+	})
+
+	t.Run("rejects proxy chains on routes that do not use them", func() {
+		_, err := router.New(
+			router.WithRoutes([]router.Route{{
+				Hosts:  []string{"example.com"},
+				Proxy:  []addr.URL{*proxyURL},
+				Action: router.ActionReject,
+			}}),
+		)
+		t.Error(err)
+	})
+}
+
+func (t *RouterTest) TestDial_Upstreams() {
+	dstAddr := addr.NewAddr("example.com", 80)
+	proxyA := *addr.NewURL(addr.ProtoHTTP, "a", 8080)
+	proxyB := *addr.NewURL(addr.ProtoHTTP, "b", 8080)
+
+	t.Run("falls back to the next upstream if one is unreachable", func() {
+		dialer, dialed := t.recordingDialer(dstAddr)
+		router, err := router.New(
+			router.WithDialer(dialer),
+			router.WithDefaultRoute(&router.Route{
+				Upstreams: [][]addr.URL{{proxyA}, {}},
+			}),
+		)
+		t.Require().NoError(err)
+
+		conn, err := router.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		t.Equal([]string{"a", "example.com"}, *dialed)
+	})
+
+	t.Run("reports errors from all upstreams", func() {
+		router, err := router.New(
+			router.WithDialer(t.proxyNameDialer()),
+			router.WithDefaultRoute(&router.Route{
+				Upstreams: [][]addr.URL{{proxyA}, {proxyB}},
+			}),
+		)
+		t.Require().NoError(err)
+
+		_, err = router.Dial(context.Background(), dstAddr)
+		t.ErrorContains(err, "dialed a")
+		t.ErrorContains(err, "dialed b")
+	})
+
+	t.Run("does not try other upstreams once the context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		dialer := mocks.NewDialer(t.T())
+		dialer.EXPECT().
+			Dial(mock.Anything, proxyA.Addr()).
+			RunAndReturn(func(context.Context, *addr.Addr) (net.Conn, error) {
+				cancel()
+				return nil, context.Canceled
+			}).
+			Once()
+
+		router, err := router.New(
+			router.WithDialer(dialer),
+			router.WithDefaultRoute(&router.Route{
+				Upstreams: [][]addr.URL{{proxyA}, {proxyB}},
+			}),
+		)
+		t.Require().NoError(err)
+
+		_, err = router.Dial(ctx, dstAddr)
+		t.ErrorIs(err, context.Canceled)
+	})
+
+	t.Run("round-robin starts with the next upstream on each connection", func() {
+		dialer, dialed := t.recordingDialer(dstAddr)
+		router, err := router.New(
+			router.WithDialer(dialer),
+			router.WithDefaultRoute(&router.Route{
+				Upstreams: [][]addr.URL{{proxyA}, {proxyB}},
+				Strategy:  router.StrategyRoundRobin,
+			}),
+		)
+		t.Require().NoError(err)
+
+		for range 3 {
+			_, err := router.Dial(context.Background(), dstAddr)
+			t.Require().Error(err)
+		}
+		t.Equal([]string{"a", "b", "b", "a", "a", "b"}, *dialed)
+	})
+
+	t.Run("least-conn prefers upstreams with fewer active connections", func() {
+		dialer, dialed := t.recordingDialer(dstAddr)
+		router, err := router.New(
+			router.WithDialer(dialer),
+			router.WithDefaultRoute(&router.Route{
+				Upstreams: [][]addr.URL{{}, {proxyB}},
+				Strategy:  router.StrategyLeastConn,
+			}),
+		)
+		t.Require().NoError(err)
+
+		conn1, err := router.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+
+		// The direct upstream is busy now, so the proxy is tried first
+		conn2, err := router.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		t.Require().NoError(conn2.Close())
+		t.Require().NoError(conn1.Close())
+
+		conn3, err := router.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		t.Require().NoError(conn3.Close())
+
+		t.Equal([]string{"example.com", "b", "example.com", "example.com"}, *dialed)
+	})
+
+	t.Run("rejects upstreams combined with a proxy chain", func() {
+		_, err := router.New(
+			router.WithDefaultRoute(&router.Route{
+				Proxy:     []addr.URL{proxyA},
+				Upstreams: [][]addr.URL{{proxyB}},
+			}),
+		)
+		t.Error(err)
+	})
+
+	t.Run("rejects upstreams on routes that do not use them", func() {
+		_, err := router.New(
+			router.WithRoutes([]router.Route{{
+				Hosts:     []string{"example.com"},
+				Upstreams: [][]addr.URL{{proxyA}},
+				Action:    router.ActionDirect,
+			}}),
+		)
+		t.Error(err)
+	})
+}
+
+func (t *RouterTest) TestDial_RouteOf() {
+	t.Run("tags connections with the route and upstream they were made through", func() {
+		dstAddr := addr.NewAddr("example.com", 80)
+		proxyURL := addr.NewURL(addr.ProtoHTTP, "a", 8080)
+
+		dialer, _ := t.recordingDialer(dstAddr)
+		r, err := router.New(
+			router.WithDialer(dialer),
+			router.WithRoutes([]router.Route{{
+				Hosts:       []string{"example.com"},
+				Upstreams:   [][]addr.URL{{*proxyURL}, {}},
+				IdleTimeout: time.Minute,
+			}}),
+		)
+		t.Require().NoError(err)
+
+		conn, err := r.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		route, upstream, ok := proxy.RouteOf(conn)
+		t.Require().True(ok)
+		t.Equal("route 1", route)
+		t.Equal("DIRECT", upstream)
+	})
+}
+
+func (t *RouterTest) TestDial_Bandwidth() {
+	t.Run("attaches a throttle shared by connections of the route", func() {
+		dstAddr := addr.NewAddr("example.com", 80)
+
+		dialer := mocks.NewDialer(t.T())
+		dialer.EXPECT().
+			Dial(mock.Anything, dstAddr).
+			RunAndReturn(func(context.Context, *addr.Addr) (net.Conn, error) {
+				conn, _ := net.Pipe()
+				return conn, nil
+			})
+
+		r, err := router.New(
+			router.WithDialer(dialer),
+			router.WithRoutes([]router.Route{{
+				Hosts:       []string{"example.com"},
+				Bandwidth:   proxy.Bandwidth{Download: 1000},
+				IdleTimeout: time.Minute,
+			}}),
+		)
+		t.Require().NoError(err)
+
+		conn1, err := r.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		defer conn1.Close()
+
+		conn2, err := r.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		defer conn2.Close()
+
+		t.NotNil(proxy.ThrottleOf(conn1))
+		t.Same(proxy.ThrottleOf(conn1), proxy.ThrottleOf(conn2))
+	})
+
+	t.Run("attaches no throttle to routes without limits", func() {
+		dstAddr := addr.NewAddr("example.com", 80)
+		dialer, _ := t.recordingDialer(dstAddr)
+
+		r, err := router.New(router.WithDialer(dialer))
+		t.Require().NoError(err)
+
+		conn, err := r.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		t.Nil(proxy.ThrottleOf(conn))
+	})
+}
+
+func (t *RouterTest) TestDial_Timeouts() {
+	dstAddr := addr.NewAddr("example.com", 80)
+	proxyURL := *addr.NewURL(addr.ProtoHTTP, "proxy", 8080)
+
+	newDialer := func() proxy.Dialer {
+		dialer := mocks.NewDialer(t.T())
+		dialer.EXPECT().
+			Dial(mock.Anything, proxyURL.Addr()).
+			RunAndReturn(func(ctx context.Context, _ *addr.Addr) (net.Conn, error) {
+				// Simulate an unresponsive upstream
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+		dialer.EXPECT().
+			Dial(mock.Anything, dstAddr).
+			RunAndReturn(func(context.Context, *addr.Addr) (net.Conn, error) {
+				conn, peer := net.Pipe()
+				peer.Close()
+				return conn, nil
+			}).
+			Maybe()
+		return dialer
+	}
+
+	tests := map[string][]router.Option{
+		"router dial timeout limits each upstream": {
+			router.WithDialTimeout(50 * time.Millisecond),
+			router.WithDefaultRoute(&router.Route{
+				Upstreams: [][]addr.URL{{proxyURL}, {}},
+			}),
+		},
+
+		"route dial timeout overrides the router one": {
+			router.WithDialTimeout(time.Hour),
+			router.WithDefaultRoute(&router.Route{
+				Upstreams:   [][]addr.URL{{proxyURL}, {}},
+				DialTimeout: 50 * time.Millisecond,
+			}),
+		},
+	}
+
+	for name, ops := range tests {
+		t.Run(name, func() {
+			router, err := router.New(append(ops, router.WithDialer(newDialer()))...)
+			t.Require().NoError(err)
+
+			conn, err := router.Dial(context.Background(), dstAddr)
+			t.Require().NoError(err)
+			t.Require().NoError(conn.Close())
+		})
+	}
+
+	t.Run("reports timeouts of the last upstream", func() {
+		router, err := router.New(
+			router.WithDialer(newDialer()),
+			router.WithDialTimeout(50*time.Millisecond),
+			router.WithDefaultRoute(&router.Route{
+				Proxy: []addr.URL{proxyURL},
+			}),
+		)
+		t.Require().NoError(err)
+
+		_, err = router.Dial(context.Background(), dstAddr)
+		t.ErrorIs(err, context.DeadlineExceeded)
+	})
+}
+
+func (t *RouterTest) TestDial_HealthCheck() {
+	dstAddr := addr.NewAddr("example.com", 80)
+	probeAddr := addr.NewAddr("probe", 80)
+	proxyURL := *addr.NewURL(addr.ProtoHTTP, "proxy", 8080)
+
+	newRouter := func(dialer proxy.Dialer, hc *router.HealthCheck, upstreams ...[]addr.URL) *router.Router {
+		hc.Probe = probeAddr
+		router, err := router.New(
+			router.WithDialer(dialer),
+			router.WithHealthCheck(hc),
+			router.WithDefaultRoute(&router.Route{
+				Upstreams: upstreams,
+			}),
+		)
+		t.Require().NoError(err)
+		return router
+	}
+
+	t.Run("skips upstreams after consecutive failed probes", func() {
+		dialer, dialed := t.recordingDialer(dstAddr)
+		r := newRouter(dialer, &router.HealthCheck{Fall: 2}, []addr.URL{proxyURL}, nil)
+
+		r.CheckHealth(context.Background())
+		r.CheckHealth(context.Background())
+		*dialed = nil
+
+		conn, err := r.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		t.Equal([]string{"example.com"}, *dialed)
+	})
+
+	t.Run("keeps upstreams until the failure threshold is reached", func() {
+		dialer, dialed := t.recordingDialer(dstAddr)
+		r := newRouter(dialer, &router.HealthCheck{Fall: 2}, []addr.URL{proxyURL})
+
+		r.CheckHealth(context.Background())
+		*dialed = nil
+
+		_, err := r.Dial(context.Background(), dstAddr)
+		t.ErrorContains(err, "dialed proxy")
+	})
+
+	t.Run("fails fast if no upstream is healthy", func() {
+		dialer, dialed := t.recordingDialer(dstAddr)
+		r := newRouter(dialer, &router.HealthCheck{Fall: 1}, []addr.URL{proxyURL})
+
+		r.CheckHealth(context.Background())
+		*dialed = nil
+
+		_, err := r.Dial(context.Background(), dstAddr)
+		t.ErrorIs(err, router.ErrNoHealthyUpstream)
+		t.Empty(*dialed)
+	})
+
+	t.Run("falls back to a direct connection if configured to", func() {
+		dialer, dialed := t.recordingDialer(dstAddr)
+		r := newRouter(dialer, &router.HealthCheck{Fall: 1, FallbackDirect: true}, []addr.URL{proxyURL})
+
+		r.CheckHealth(context.Background())
+		*dialed = nil
+
+		conn, err := r.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		t.Equal([]string{"example.com"}, *dialed)
+	})
+
+	t.Run("restores upstreams after consecutive successful probes", func() {
+		proxyUp := false
+		dialer := mocks.NewDialer(t.T())
+		dialer.EXPECT().
+			Dial(mock.Anything, proxyURL.Addr()).
+			RunAndReturn(func(context.Context, *addr.Addr) (net.Conn, error) {
+				if !proxyUp {
+					return nil, errors.New("proxy is down")
+				}
+				return fakeHTTPProxy(), nil
+			})
+
+		r := newRouter(dialer, &router.HealthCheck{Fall: 1, Rise: 2}, []addr.URL{proxyURL})
+		r.CheckHealth(context.Background())
+
+		proxyUp = true
+		r.CheckHealth(context.Background())
+		_, err := r.Dial(context.Background(), dstAddr)
+		t.ErrorIs(err, router.ErrNoHealthyUpstream)
+
+		r.CheckHealth(context.Background())
+		conn, err := r.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		t.Require().NoError(conn.Close())
+	})
+
+	t.Run("counts probes of concurrent health checks", func() {
+		dialer := mocks.NewDialer(t.T())
+		dialer.EXPECT().
+			Dial(mock.Anything, proxyURL.Addr()).
+			Return(nil, errors.New("proxy is down"))
+
+		r := newRouter(dialer, &router.HealthCheck{Fall: 4}, []addr.URL{proxyURL})
+
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.CheckHealth(context.Background())
+			}()
+		}
+		wg.Wait()
+
+		_, err := r.Dial(context.Background(), dstAddr)
+		t.ErrorIs(err, router.ErrNoHealthyUpstream)
+	})
+}
+
+// fakeHTTPProxy returns a connection to a proxy that accepts a single CONNECT request.
+func fakeHTTPProxy() net.Conn {
+	conn, proxyConn := net.Pipe()
+	go func() {
+		defer proxyConn.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(proxyConn)); err != nil {
+			return
+		}
+		_, _ = proxyConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	}()
+	return conn
+}
+
+func (t *RouterTest) TestDial_PAC() {
+	pac, err := router.ParsePAC(`
+function FindProxyForURL(url, host) {
+	return "PROXY down:3128; DIRECT";
+}
+`)
+	t.Require().NoError(err)
+
+	t.Run("falls back to the next candidate if a proxy is unreachable", func() {
+		dstAddr := addr.NewAddr("example.com", 80)
+		dstConn, _ := net.Pipe()
+		defer dstConn.Close()
+
+		dialer := mocks.NewDialer(t.T())
+		dialer.EXPECT().
+			Dial(mock.Anything, addr.NewAddr("down", 3128)).
+			Return(nil, errors.New("proxy is down"))
+		dialer.EXPECT().
+			Dial(mock.Anything, dstAddr).
+			Return(dstConn, nil)
+
+		router, err := router.New(
+			router.WithDialer(dialer),
+			router.WithPAC(pac),
+		)
+		t.Require().NoError(err)
+
+		conn, err := router.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		t.Equal(dstConn, conn.(interface{ NetConn() net.Conn }).NetConn())
+	})
+
+	t.Run("routes take precedence over PAC", func() {
+		router, err := router.New(
+			router.WithDialer(t.proxyNameDialer()),
+			router.WithPAC(pac),
+			router.WithRoutes([]router.Route{{
+				Hosts: []string{"example.com"},
+				Proxy: []addr.URL{*addr.NewURL(addr.ProtoHTTP, "routed", 8080)},
+			}}),
+		)
+		t.Require().NoError(err)
+
+		_, err = router.Dial(context.Background(), addr.NewAddr("example.com", 80))
+		t.ErrorContains(err, "dialed routed")
+	})
+}
+
+func (t *RouterTest) newPatternRouter(pattern string) *router.Router {
+	router, err := router.New(
+		router.WithDialer(t.proxyNameDialer()),
+		router.WithRoutes([]router.Route{{
+			Hosts: []string{pattern},
+			Proxy: []addr.URL{*addr.NewURL(addr.ProtoHTTP, "matched", 8080)},
+		}}),
+		router.WithDefaultRoute(&router.Route{
+			Proxy: []addr.URL{*addr.NewURL(addr.ProtoHTTP, "unmatched", 8080)},
+		}),
+	)
+	t.Require().NoError(err)
+
+	return router
+}
+
+// proxyNameDialer fails all dial attempts with an error naming the dialed host.
+func (t *RouterTest) proxyNameDialer() proxy.Dialer {
+	dialer := mocks.NewDialer(t.T())
+	dialer.EXPECT().
+		Dial(mock.Anything, mock.Anything).
+		RunAndReturn(func(_ context.Context, a *addr.Addr) (net.Conn, error) {
+			return nil, fmt.Errorf("dialed %v", a.Host)
+		}).
+		Maybe()
+
+	return dialer
+}
+
+// recordingDialer connects only to the destination and records the hosts of all dial attempts.
+func (t *RouterTest) recordingDialer(dstAddr *addr.Addr) (proxy.Dialer, *[]string) {
+	var dialed []string
+
+	dialer := mocks.NewDialer(t.T())
+	dialer.EXPECT().
+		Dial(mock.Anything, mock.Anything).
+		RunAndReturn(func(_ context.Context, a *addr.Addr) (net.Conn, error) {
+			dialed = append(dialed, a.Host)
+			if *a != *dstAddr {
+				return nil, fmt.Errorf("dialed %v", a.Host)
+			}
+
+			conn, peer := net.Pipe()
+			peer.Close()
+			return conn, nil
+		}).
+		Maybe()
+
+	return dialer, &dialed
+}
+
+func (t *RouterTest) TestSwitch() {
+	t.Run("routes new connections through the latest router", func() {
+		newRouter := func(proxyHost string) *router.Router {
+			router, err := router.New(
+				router.WithDialer(t.proxyNameDialer()),
+				router.WithDefaultRoute(&router.Route{
+					Proxy: []addr.URL{*addr.NewURL(addr.ProtoHTTP, proxyHost, 8080)},
+				}),
+			)
+			t.Require().NoError(err)
+			return router
+		}
+
+		routes := router.NewSwitch(newRouter("old"))
+		_, err := routes.Dial(context.Background(), addr.NewAddr("example.com", 80))
+		t.ErrorContains(err, "dialed old")
+
+		routes.Store(newRouter("new"))
+		_, err = routes.Dial(context.Background(), addr.NewAddr("example.com", 80))
+		t.ErrorContains(err, "dialed new")
+	})
+}
+
+func (t *RouterTest) TestDial_Metrics() {
+	t.Run("reports dial attempts through each of the upstreams of a route", func() {
+		dstAddr := addr.NewAddr("example.com", 80)
+		proxyURL := addr.NewURL(addr.ProtoHTTP, "a", 8080)
+
+		dialer, _ := t.recordingDialer(dstAddr)
+		metrics := &dialMetrics{Metrics: proxy.DiscardMetrics}
+		r, err := router.New(
+			router.WithDialer(dialer),
+			router.WithMetrics(metrics),
+			router.WithRoutes([]router.Route{{
+				Hosts:     []string{"example.com"},
+				Upstreams: [][]addr.URL{{*proxyURL}, {}},
+			}}),
+		)
+		t.Require().NoError(err)
+
+		conn, err := r.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		t.Equal([]string{
+			fmt.Sprintf("route 1 %v failed", proxyURL),
+			"route 1 DIRECT ok",
+		}, metrics.dials)
+	})
+
+	t.Run("reports direct connections of the default route", func() {
+		dstAddr := addr.NewAddr("example.com", 80)
+
+		dialer, _ := t.recordingDialer(dstAddr)
+		metrics := &dialMetrics{Metrics: proxy.DiscardMetrics}
+		r, err := router.New(
+			router.WithDialer(dialer),
+			router.WithMetrics(metrics),
+			router.WithDefaultRoute(&router.Route{Action: router.ActionDirect}),
+		)
+		t.Require().NoError(err)
+
+		conn, err := r.Dial(context.Background(), dstAddr)
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		t.Equal([]string{"default DIRECT ok"}, metrics.dials)
+	})
+
+	t.Run("leaves credentials out of upstream names", func() {
+		dstAddr := addr.NewAddr("example.com", 80)
+		proxyURL := addr.NewURL(addr.ProtoHTTP, "a", 8080)
+		proxyURL.Username, proxyURL.Password = "user", "secret"
+
+		dialer, _ := t.recordingDialer(dstAddr)
+		metrics := &dialMetrics{Metrics: proxy.DiscardMetrics}
+		r, err := router.New(
+			router.WithDialer(dialer),
+			router.WithMetrics(metrics),
+			router.WithDefaultRoute(&router.Route{Proxy: []addr.URL{*proxyURL}}),
+		)
+		t.Require().NoError(err)
+
+		_, err = r.Dial(context.Background(), dstAddr)
+		t.Require().Error(err)
+		t.Equal([]string{"default http://a:8080 failed"}, metrics.dials)
+	})
+}
+
+// dialMetrics records the dial attempts reported by a router.
+type dialMetrics struct {
+	proxy.Metrics
+	dials []string
+}
+
+func (m *dialMetrics) DialDone(route, upstream string, _ time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	m.dials = append(m.dials, fmt.Sprintf("%v %v %v", route, upstream, result))
+}
+
+func (t *RouterTest) TestDialPacket() {
+	t.Run("routes datagrams through default route", func() {
+		proxyURL := addr.NewURL(addr.ProtoSOCKS5, "proxy", 1080)
+
+		dialer := mocks.NewDialer(t.T())
+		dialer.EXPECT().
+			Dial(mock.Anything, proxyURL.Addr()).
+			Return(nil, errors.New("redirected to Proxy"))
+
+		router, err := router.New(
+			router.WithDialer(dialer),
+			router.WithRoutes([]router.Route{{
+				Hosts: []string{"example.com"},
+				Proxy: []addr.URL{*addr.NewURL(addr.ProtoSOCKS5, "other-proxy", 1080)},
+			}}),
+			router.WithDefaultRoute(&router.Route{
+				Proxy: []addr.URL{*proxyURL},
+			}),
+		)
+		t.Require().NoError(err)
+
+		_, err = router.DialPacket(context.Background())
+		t.ErrorContains(err, "Proxy")
+	})
+
+	t.Run("drops datagrams to rejected destinations", func() {
+		packetConn := &recordingPacketConn{}
+		router, err := router.New(
+			router.WithPacketDialer(proxy.PacketDialerFunc(func(context.Context) (proxy.PacketConn, error) {
+				return packetConn, nil
+			})),
+			router.WithRoutes([]router.Route{{
+				Hosts:  []string{"blocked.example.com"},
+				Action: router.ActionReject,
+			}}),
+			router.WithDefaultRoute(&router.Route{
+				Action: router.ActionDirect,
+			}),
+		)
+		t.Require().NoError(err)
+
+		conn, err := router.DialPacket(context.Background())
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		_, err = conn.WriteTo([]byte("a"), addr.NewAddr("blocked.example.com", 53))
+		t.ErrorIs(err, proxy.ErrRejected)
+
+		_, err = conn.WriteTo([]byte("b"), addr.NewAddr("example.com", 53))
+		t.NoError(err)
+
+		t.Equal([]string{"example.com:53"}, packetConn.writes)
+	})
+
+	t.Run("routes datagrams through the route of their destination", func() {
+		packetConn := &recordingPacketConn{}
+		router, err := router.New(
+			router.WithPacketDialer(proxy.PacketDialerFunc(func(context.Context) (proxy.PacketConn, error) {
+				return packetConn, nil
+			})),
+			router.WithRoutes([]router.Route{{
+				Hosts:  []string{"dns.example.com"},
+				Action: router.ActionDirect,
+			}}),
+			router.WithDefaultRoute(&router.Route{
+				Action: router.ActionReject,
+			}),
+		)
+		t.Require().NoError(err)
+
+		conn, err := router.DialPacket(context.Background())
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		_, err = conn.WriteTo([]byte("a"), addr.NewAddr("dns.example.com", 53))
+		t.NoError(err)
+
+		_, err = conn.WriteTo([]byte("b"), addr.NewAddr("example.com", 53))
+		t.ErrorIs(err, proxy.ErrRejected)
+
+		t.Equal([]string{"dns.example.com:53"}, packetConn.writes)
+	})
+}
+
+func (t *RouterTest) TestCheck() {
+	tests := map[string]struct {
+		routes []router.Route
+		dst    *addr.Addr
+		want   error
+	}{
+		"rejects destinations of reject routes": {
+			routes: []router.Route{{Hosts: []string{"10.0.0.0/8"}, Action: router.ActionReject}},
+			dst:    addr.NewAddr("10.1.2.3", 4444),
+			want:   proxy.ErrRejected,
+		},
+		"allows destinations of other routes": {
+			routes: []router.Route{{Hosts: []string{"10.0.0.0/8"}, Action: router.ActionReject}},
+			dst:    addr.NewAddr("192.168.0.1", 4444),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func() {
+			r, err := router.New(router.WithRoutes(test.routes))
+			t.Require().NoError(err)
+			t.ErrorIs(r.Check(test.dst), test.want)
+		})
+	}
+}
+
+// recordingPacketConn records the destinations of datagrams written to it.
+type recordingPacketConn struct {
+	writes []string
+}
+
+func (c *recordingPacketConn) ReadFrom([]byte) (int, *addr.Addr, error) {
+	return 0, nil, net.ErrClosed
+}
+
+func (c *recordingPacketConn) WriteTo(p []byte, dstAddr *addr.Addr) (int, error) {
+	c.writes = append(c.writes, dstAddr.String())
+	return len(p), nil
+}
+
+func (c *recordingPacketConn) Close() error {
+	return nil
+}
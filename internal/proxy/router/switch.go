@@ -0,0 +1,46 @@
+package router
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+)
+
+// NewSwitch creates a [Switch] that initially routes connections through r.
+func NewSwitch(r *Router) *Switch {
+	var s Switch
+	s.Store(r)
+	return &s
+}
+
+// Switch routes connections through a router that can be replaced at any time.
+//
+// Replacing the router only affects new connections, leaving the established ones intact.
+type Switch struct {
+	router atomic.Pointer[Router]
+}
+
+// Store replaces the router used for new connections.
+func (s *Switch) Store(r *Router) {
+	s.router.Store(r)
+}
+
+// Load returns the router currently in use.
+func (s *Switch) Load() *Router {
+	return s.router.Load()
+}
+
+func (s *Switch) Dial(ctx context.Context, dstAddr *addr.Addr) (net.Conn, error) {
+	return s.Load().Dial(ctx, dstAddr)
+}
+
+func (s *Switch) Check(dstAddr *addr.Addr) error {
+	return s.Load().Check(dstAddr)
+}
+
+func (s *Switch) DialPacket(ctx context.Context) (proxy.PacketConn, error) {
+	return s.Load().DialPacket(ctx)
+}
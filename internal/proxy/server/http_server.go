@@ -2,32 +2,77 @@ package server
 
 import (
 	stdlog "log"
-	"sync"
 
 	"bufio"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cerfical/socks2http/internal/proxy"
 	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/auth"
 )
 
+const httpAuthRealm = "socks2http"
+
 type HTTPServer struct {
 	Tunneler proxy.Tunneler
 	Dialer   proxy.Dialer
 
+	// Registry, if set, keeps track of the tunnels opened by the server.
+	Registry *Registry
+
+	// Limiter, if set, rejects connections over its limits.
+	Limiter *Limiter
+
+	// Throttler, if set, limits the bandwidth of the tunnels opened by the server.
+	Throttler *Throttler
+
+	// Auth, if set, requires clients to authenticate with Basic credentials.
+	Auth *auth.Store
+
+	// HandshakeTimeout, if set, limits the time clients can take to send request headers.
+	HandshakeTimeout time.Duration
+
+	// DrainTimeout, if set, limits the time to wait for active requests and tunnels to finish on shutdown.
+	DrainTimeout time.Duration
+
 	Log proxy.Logger
 
-	activeTunnels sync.WaitGroup
+	// Metrics, if set, collects statistics about served clients.
+	Metrics proxy.Metrics
+
+	tunnels *tunnelGroup
 }
 
 func (s *HTTPServer) ServeHTTP(ctx context.Context, l net.Listener) error {
+	l = s.Limiter.listen(l)
+
+	s.tunnels = newTunnelGroup()
 	server := http.Server{
-		Handler:  http.HandlerFunc(s.handle),
-		ErrorLog: stdlog.New(httpErrorLog{s}, "", 0),
+		Handler:           http.HandlerFunc(s.handle),
+		ErrorLog:          stdlog.New(httpErrorLog{s}, "", 0),
+		ReadHeaderTimeout: s.HandshakeTimeout,
+
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				s.metrics().ConnAccepted(l.Addr().String(), addr.ProtoHTTP)
+			}
+		},
+
+		ConnContext: withLimitError,
+
+		// Make requests, and tunnels opened by them, stop once the drain period is over
+		BaseContext: func(net.Listener) context.Context {
+			return s.tunnels.ctx
+		},
 	}
 
 	errChan := make(chan error, 1)
@@ -37,8 +82,18 @@ func (s *HTTPServer) ServeHTTP(ctx context.Context, l net.Listener) error {
 
 	select {
 	case <-ctx.Done():
-		err := server.Shutdown(context.Background())
-		s.activeTunnels.Wait()
+		deadline := drainDeadline(s.DrainTimeout)
+		shutdownCtx, cancel := withDeadline(context.Background(), deadline)
+		defer cancel()
+
+		// Hijacked connections are not tracked by the HTTP server, so they are drained separately
+		err := server.Shutdown(shutdownCtx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = server.Close()
+		}
+
+		drained, forced := s.tunnels.drain(deadline)
+		s.Log.Info("Tunnels closed", "drained", drained, "forced", forced)
 		return err
 	case err := <-errChan:
 		return err
@@ -46,6 +101,23 @@ func (s *HTTPServer) ServeHTTP(ctx context.Context, l net.Listener) error {
 }
 
 func (s *HTTPServer) handle(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(withRequestID(r.Context()))
+
+	if err := limitErrorFrom(r.Context()); err != nil {
+		s.metrics().HandshakeFailed(addr.ProtoHTTP, failureLimit)
+		s.limitError(w, r, err)
+		return
+	}
+
+	user, err := s.authorize(r)
+	if err != nil {
+		s.metrics().HandshakeFailed(addr.ProtoHTTP, failureAuth)
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", httpAuthRealm))
+		s.httpStatus(w, r, http.StatusProxyAuthRequired, err)
+		return
+	}
+	r = r.WithContext(withUser(r.Context(), user))
+
 	if r.Method == http.MethodConnect {
 		s.connect(w, r)
 	} else {
@@ -53,16 +125,39 @@ func (s *HTTPServer) handle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// authorize checks the credentials of a request, returning the authenticated user, if any.
+func (s *HTTPServer) authorize(r *http.Request) (string, error) {
+	if s.Auth == nil {
+		return "", nil
+	}
+
+	creds := r.Header.Get("Proxy-Authorization")
+	if creds == "" {
+		return "", errors.New("missing credentials")
+	}
+
+	username, password, ok := parseBasicAuth(creds)
+	if !ok {
+		return "", errors.New("malformed credentials")
+	}
+
+	if !s.Auth.Verify(username, password) {
+		return "", fmt.Errorf("invalid credentials for user %q", username)
+	}
+	return username, nil
+}
+
 func (s *HTTPServer) connect(w http.ResponseWriter, r *http.Request) {
 	dstAddr, err := hostFromHTTPConnect(r)
 	if err != nil {
+		s.metrics().HandshakeFailed(addr.ProtoHTTP, failureMalformed)
 		s.httpStatus(w, r, http.StatusBadRequest, fmt.Errorf("parse destination address: %w", err))
 		return
 	}
 
 	dstConn, err := s.Dialer.Dial(r.Context(), dstAddr)
 	if err != nil {
-		s.httpStatus(w, r, http.StatusBadGateway, fmt.Errorf("connect to destination: %w", err))
+		s.dialError(w, r, err)
 		return
 	}
 	defer dstConn.Close()
@@ -74,9 +169,6 @@ func (s *HTTPServer) connect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.activeTunnels.Add(1)
-	defer s.activeTunnels.Done()
-
 	clientConn, _, err := hj.Hijack()
 	if err != nil {
 		s.httpStatus(w, r, http.StatusInternalServerError, fmt.Errorf("hijack connection: %w", err))
@@ -84,37 +176,63 @@ func (s *HTTPServer) connect(w http.ResponseWriter, r *http.Request) {
 	}
 	defer clientConn.Close()
 
+	s.tunnels.add(clientConn)
+	defer s.tunnels.done(clientConn)
+
 	// Establish the HTTP tunnel
 	if !s.httpStatus(clientConn, r, http.StatusOK, nil) {
 		return
 	}
-	if err := s.Tunneler.Tunnel(r.Context(), clientConn, dstConn); err != nil {
-		s.serverError(fmt.Errorf("proxy tunnel: %w", err))
-		return
-	}
+	s.runTunnel(r.Context(), &tunnel{
+		proto:      addr.ProtoHTTP,
+		dstAddr:    dstAddr,
+		clientAddr: clientConn.RemoteAddr().String(),
+		clientConn: clientConn,
+		dstConn:    dstConn,
+	})
 }
 
 func (s *HTTPServer) forwardRequest(w http.ResponseWriter, r *http.Request) {
 	dstAddr, err := hostFromHTTPRequest(r)
 	if err != nil {
+		s.metrics().HandshakeFailed(addr.ProtoHTTP, failureMalformed)
 		s.httpStatus(w, r, http.StatusBadRequest, fmt.Errorf("parse destination address: %w", err))
 		return
 	}
 
 	dstConn, err := s.Dialer.Dial(r.Context(), dstAddr)
 	if err != nil {
-		s.httpStatus(w, r, http.StatusBadGateway, fmt.Errorf("connect to destination: %w", err))
+		s.dialError(w, r, err)
 		return
 	}
 	defer dstConn.Close()
 
-	if err := r.Write(dstConn); err != nil {
+	// Without a client connection to take over, the request is tracked on the destination side
+	fwd := &tunnel{
+		proto:      addr.ProtoHTTP,
+		dstAddr:    dstAddr,
+		clientAddr: r.RemoteAddr,
+		dstConn:    dstConn,
+	}
+	ctx, fwdConn, untrack := fwd.track(r.Context(), dstConn, s.Registry, s.Throttler, s.metrics())
+	defer untrack()
+
+	// Do not let a slow destination hold up the request once the client is gone or the request is closed
+	stop := context.AfterFunc(ctx, func() {
+		dstConn.Close()
+	})
+	defer stop()
+
+	// Keep the client credentials from leaking to the destination
+	r.Header.Del("Proxy-Authorization")
+
+	if err := r.Write(fwdConn); err != nil {
 		s.httpStatus(w, r, http.StatusBadGateway, fmt.Errorf("write request: %w", err))
 		return
 	}
 
 	// Forward the response from the destination to the client
-	resp, err := http.ReadResponse(bufio.NewReader(dstConn), r)
+	resp, err := http.ReadResponse(bufio.NewReader(fwdConn), r)
 	if err != nil {
 		s.httpStatus(w, r, http.StatusBadGateway, fmt.Errorf("read response: %w", err))
 		return
@@ -134,12 +252,40 @@ func (s *HTTPServer) forwardRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *HTTPServer) dialError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	switch {
+	case errors.Is(err, proxy.ErrRejected):
+		status = http.StatusForbidden
+	case isTimeout(err):
+		status = http.StatusGatewayTimeout
+	}
+	s.httpStatus(w, r, status, fmt.Errorf("connect to destination: %w", err))
+}
+
+func (s *HTTPServer) limitError(w http.ResponseWriter, r *http.Request, err error) {
+	// Blame the client for going over its own limits, and the server for the shared ones
+	status := http.StatusServiceUnavailable
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) && limitErr.PerIP {
+		status = http.StatusTooManyRequests
+	}
+	if errors.Is(err, ErrConnRateExceeded) {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	// Make the client open a new connection for further requests, to have it checked against the limits again
+	w.Header().Set("Connection", "close")
+	s.httpStatus(w, r, status, err)
+}
+
 func (s *HTTPServer) httpStatus(w io.Writer, r *http.Request, status int, err error) bool {
 	msg := fmt.Sprintf("%v %v", r.Method, r.RequestURI)
 	fields := []any{
 		"proto", r.Proto,
 		"status", fmt.Sprintf("%v %v", status, http.StatusText(status)),
 		"client", r.RemoteAddr,
+		"request_id", requestIDOf(r.Context()),
 	}
 
 	// Log the request and response status
@@ -151,6 +297,8 @@ func (s *HTTPServer) httpStatus(w io.Writer, r *http.Request, status int, err er
 		s.Log.Info(msg, fields...)
 	}
 
+	s.metrics().RequestServed(addr.ProtoHTTP, strconv.Itoa(status))
+
 	// Write the status code to the client
 	if rw, ok := w.(http.ResponseWriter); ok {
 		rw.WriteHeader(status)
@@ -169,6 +317,17 @@ func (s *HTTPServer) httpStatus(w io.Writer, r *http.Request, status int, err er
 	return true
 }
 
+func (s *HTTPServer) runTunnel(ctx context.Context, t *tunnel) {
+	t.run(ctx, s.Tunneler, s.Registry, s.Throttler, s.metrics(), s.Log)
+}
+
+func (s *HTTPServer) metrics() proxy.Metrics {
+	if s.Metrics == nil {
+		return proxy.DiscardMetrics
+	}
+	return s.Metrics
+}
+
 func (s *HTTPServer) serverError(err error) {
 	s.Log.Error("HTTP failure", "error", err)
 }
@@ -217,3 +376,18 @@ func hostFromHTTPRequest(r *http.Request) (*addr.Addr, error) {
 
 	return addr.NewAddr(r.URL.Hostname(), portNum), nil
 }
+
+func parseBasicAuth(creds string) (username, password string, ok bool) {
+	const prefix = "Basic "
+
+	// The authentication scheme is case-insensitive
+	if len(creds) < len(prefix) || !strings.EqualFold(creds[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(creds[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
@@ -3,8 +3,10 @@ package server_test
 import (
 	"bufio"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/cerfical/socks2http/internal/proxy"
 	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/auth"
 	"github.com/cerfical/socks2http/internal/proxy/mocks"
 	"github.com/cerfical/socks2http/internal/proxy/server"
 	"github.com/stretchr/testify/mock"
@@ -113,7 +116,7 @@ func (t *HTTPServerTest) TestServeHTTP() {
 		tun := mocks.NewTunneler(t.T())
 		tun.EXPECT().
 			Tunnel(mock.Anything, mock.Anything, dstConn).
-			Return(nil)
+			Return(proxy.TunnelStats{}, nil)
 
 		proxyConn := t.openProxyConn(tun, dial)
 
@@ -146,19 +149,183 @@ func (t *HTTPServerTest) TestServeHTTP() {
 	})
 }
 
+func (t *HTTPServerTest) TestServeHTTP_Rejected() {
+	dstHost := addr.NewAddr("localhost", 1111)
+
+	t.Run("replies to CONNECT with 403-Forbidden if destination is rejected by policy", func() {
+		dial := mocks.NewDialer(t.T())
+		dial.EXPECT().
+			Dial(mock.Anything, dstHost).
+			Return(nil, proxy.ErrRejected)
+
+		proxyConn := t.openProxyConn(nil, dial)
+
+		req := httptest.NewRequest(http.MethodConnect, dstHost.String(), nil)
+		t.Require().NoError(req.WriteProxy(proxyConn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(proxyConn), nil)
+		t.Require().NoError(err)
+
+		t.Equal(http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("replies to non-CONNECT requests with 403-Forbidden if destination is rejected by policy", func() {
+		dial := mocks.NewDialer(t.T())
+		dial.EXPECT().
+			Dial(mock.Anything, dstHost).
+			Return(nil, proxy.ErrRejected)
+
+		proxyConn := t.openProxyConn(nil, dial)
+
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://%v", dstHost), nil)
+		t.Require().NoError(req.WriteProxy(proxyConn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(proxyConn), nil)
+		t.Require().NoError(err)
+
+		t.Equal(http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func (t *HTTPServerTest) TestServeHTTP_Timeouts() {
+	dstHost := addr.NewAddr("localhost", 1111)
+
+	t.Run("replies with 504-Gateway-Timeout if destination takes too long to connect", func() {
+		dial := mocks.NewDialer(t.T())
+		dial.EXPECT().
+			Dial(mock.Anything, dstHost).
+			Return(nil, fmt.Errorf("dial: %w", context.DeadlineExceeded))
+
+		proxyConn := t.openProxyConn(nil, dial)
+
+		req := httptest.NewRequest(http.MethodConnect, dstHost.String(), nil)
+		t.Require().NoError(req.WriteProxy(proxyConn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(proxyConn), nil)
+		t.Require().NoError(err)
+
+		t.Equal(http.StatusGatewayTimeout, resp.StatusCode)
+	})
+
+	t.Run("closes connections of clients that do not send request headers in time", func() {
+		proxyConn := t.openServerConn(&server.HTTPServer{
+			Log:              proxy.DiscardLogger,
+			HandshakeTimeout: 50 * time.Millisecond,
+		})
+
+		proxyConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := proxyConn.Read(make([]byte, 1))
+		t.ErrorIs(err, io.EOF)
+	})
+}
+
+func (t *HTTPServerTest) TestServeHTTP_Auth() {
+	users := auth.NewStore(auth.Credentials{Username: "root", Password: "secret"})
+
+	t.Run("replies to requests without credentials with 407-Proxy-Authentication-Required", func() {
+		proxyConn := t.openAuthProxyConn(nil, nil, users)
+
+		req := httptest.NewRequest(http.MethodConnect, "localhost:1111", nil)
+		t.Require().NoError(req.WriteProxy(proxyConn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(proxyConn), nil)
+		t.Require().NoError(err)
+
+		t.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+		t.Equal(`Basic realm="socks2http"`, resp.Header.Get("Proxy-Authenticate"))
+	})
+
+	t.Run("replies to requests with invalid credentials with 407-Proxy-Authentication-Required", func() {
+		proxyConn := t.openAuthProxyConn(nil, nil, users)
+
+		req := httptest.NewRequest(http.MethodConnect, "localhost:1111", nil)
+		req.Header.Set("Proxy-Authorization", basicAuth("root", "wrong"))
+		t.Require().NoError(req.WriteProxy(proxyConn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(proxyConn), nil)
+		t.Require().NoError(err)
+
+		t.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+	})
+
+	t.Run("CONNECT opens a tunnel to destination if credentials are valid", func() {
+		dstHost := addr.NewAddr("localhost", 1111)
+		dstConn := NewDummyConn()
+
+		dial := mocks.NewDialer(t.T())
+		dial.EXPECT().
+			Dial(mock.Anything, dstHost).
+			Return(dstConn, nil)
+
+		tun := mocks.NewTunneler(t.T())
+		tun.EXPECT().
+			Tunnel(mock.Anything, mock.Anything, dstConn).
+			Return(proxy.TunnelStats{}, nil)
+
+		proxyConn := t.openAuthProxyConn(tun, dial, users)
+
+		req := httptest.NewRequest(http.MethodConnect, dstHost.String(), nil)
+		req.Header.Set("Proxy-Authorization", basicAuth("root", "secret"))
+		t.Require().NoError(req.WriteProxy(proxyConn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(proxyConn), nil)
+		t.Require().NoError(err)
+
+		t.Equal(http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("non-CONNECT requests are forwarded without credentials", func() {
+		dstHost := addr.NewAddr("localhost", 1111)
+		dstServerConn, dstProxyConn := net.Pipe()
+
+		dial := mocks.NewDialer(t.T())
+		dial.EXPECT().
+			Dial(mock.Anything, dstHost).
+			Return(dstProxyConn, nil)
+
+		proxyConn := t.openAuthProxyConn(nil, dial, users)
+
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://%v", dstHost), nil)
+		req.Header.Set("Proxy-Authorization", basicAuth("root", "secret"))
+		t.Require().NoError(req.WriteProxy(proxyConn))
+
+		dstReq, err := http.ReadRequest(bufio.NewReader(dstServerConn))
+		t.Require().NoError(err)
+		t.Empty(dstReq.Header.Get("Proxy-Authorization"))
+
+		dstResp := http.Response{
+			StatusCode: http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+		}
+		t.Require().NoError(dstResp.Write(dstServerConn))
+
+		proxyResp, err := http.ReadResponse(bufio.NewReader(proxyConn), nil)
+		t.Require().NoError(err)
+		t.Equal(http.StatusOK, proxyResp.StatusCode)
+	})
+}
+
 func (t *HTTPServerTest) openProxyConn(tun proxy.Tunneler, dial proxy.Dialer) net.Conn {
+	return t.openAuthProxyConn(tun, dial, nil)
+}
+
+func (t *HTTPServerTest) openAuthProxyConn(tun proxy.Tunneler, dial proxy.Dialer, users *auth.Store) net.Conn {
+	return t.openServerConn(&server.HTTPServer{
+		Tunneler: tun,
+		Dialer:   dial,
+		Auth:     users,
+		Log:      proxy.DiscardLogger,
+	})
+}
+
+func (t *HTTPServerTest) openServerConn(server *server.HTTPServer) net.Conn {
 	l, err := net.Listen("tcp", "localhost:0")
 	t.Require().NoError(err)
 
 	serveErr := make(chan error)
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		server := server.HTTPServer{
-			Tunneler: tun,
-			Dialer:   dial,
-			Log:      proxy.DiscardLogger,
-		}
-
 		serveErr <- server.ServeHTTP(ctx, l)
 	}()
 	t.T().Cleanup(func() {
@@ -172,3 +339,8 @@ func (t *HTTPServerTest) openProxyConn(tun proxy.Tunneler, dial proxy.Dialer) ne
 
 	return conn
 }
+
+func basicAuth(username, password string) string {
+	creds := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return "Basic " + creds
+}
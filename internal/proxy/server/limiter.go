@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"golang.org/x/time/rate"
+)
+
+// How often to forget clients that have not been connecting lately.
+const limiterSweepInterval = time.Minute
+
+// rejectTimeout limits the time rejected clients can take to send a request and receive an error reply.
+const rejectTimeout = 10 * time.Second
+
+// maxRejectedConns limits the number of rejected connections waiting for an error reply, with the rest being closed right away.
+const maxRejectedConns = 64
+
+var (
+	// ErrTooManyConns is reported for connections over the limit of concurrent connections.
+	ErrTooManyConns = errors.New("too many concurrent connections")
+
+	// ErrConnRateExceeded is reported for connections over the limit of new connections per second.
+	ErrConnRateExceeded = errors.New("connection rate exceeded")
+)
+
+// Limits restrict the connections clients can open, with zero meaning no limit.
+type Limits struct {
+	// MaxConns limits the number of concurrent connections from all clients.
+	MaxConns int
+
+	// MaxConnsPerIP limits the number of concurrent connections from a single source IP.
+	MaxConnsPerIP int
+
+	// Rate limits the number of new connections per second from all clients.
+	Rate float64
+
+	// RatePerIP limits the number of new connections per second from a single source IP.
+	RatePerIP float64
+}
+
+// LimitError describes a connection rejected for exceeding [Limits].
+type LimitError struct {
+	// Err is either [ErrTooManyConns] or [ErrConnRateExceeded].
+	Err error
+
+	// PerIP tells whether the limit is on a single source IP, rather than on all clients.
+	PerIP bool
+}
+
+func (e *LimitError) Error() string {
+	if e.PerIP {
+		return e.Err.Error() + " for the client IP"
+	}
+	return e.Err.Error()
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// NewLimiter creates a [Limiter] enforcing the limits.
+func NewLimiter(l Limits) *Limiter {
+	return &Limiter{
+		limits:    l,
+		rate:      newRateLimiter(l.Rate),
+		clients:   make(map[netip.Addr]*clientLimit),
+		lastSweep: time.Now(),
+	}
+}
+
+// Limiter keeps the connections accepted by servers within [Limits].
+//
+// Connections over the limits are still accepted, so that servers can reject them with a protocol-appropriate error.
+// Only up to [maxRejectedConns] of them are kept open at once, for no longer than [rejectTimeout].
+type Limiter struct {
+	limits Limits
+	rate   *rate.Limiter
+
+	mu        sync.Mutex
+	conns     int
+	rejected  int
+	clients   map[netip.Addr]*clientLimit
+	lastSweep time.Time
+}
+
+type clientLimit struct {
+	conns int
+	rate  *rate.Limiter
+}
+
+// listen makes the connections accepted from the listener count towards the limits.
+//
+// A nil limiter leaves the listener as is.
+func (l *Limiter) listen(ln net.Listener) net.Listener {
+	if l == nil {
+		return ln
+	}
+	return &limitListener{ln, l}
+}
+
+// acquire admits a new connection from the client IP, returning a function to call once the connection is closed.
+func (l *Limiter) acquire(ip netip.Addr) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= limiterSweepInterval {
+		l.sweep(now)
+	}
+
+	client := l.clients[ip]
+	if client == nil {
+		client = &clientLimit{rate: newRateLimiter(l.limits.RatePerIP)}
+		l.clients[ip] = client
+	}
+
+	// Check the concurrency limits first, so that rejected connections do not use up the rate
+	switch {
+	case l.limits.MaxConnsPerIP > 0 && client.conns >= l.limits.MaxConnsPerIP:
+		return nil, &LimitError{Err: ErrTooManyConns, PerIP: true}
+	case l.limits.MaxConns > 0 && l.conns >= l.limits.MaxConns:
+		return nil, &LimitError{Err: ErrTooManyConns}
+	case client.rate != nil && !client.rate.AllowN(now, 1):
+		return nil, &LimitError{Err: ErrConnRateExceeded, PerIP: true}
+	case l.rate != nil && !l.rate.AllowN(now, 1):
+		return nil, &LimitError{Err: ErrConnRateExceeded}
+	}
+
+	l.conns++
+	client.conns++
+
+	return l.releaser(func() {
+		l.conns--
+		client.conns--
+	}), nil
+}
+
+// acquireRejected admits a connection rejected by [Limiter.acquire] to wait for an error reply,
+// returning a function to call once the connection is closed, or false if there are too many of them already.
+func (l *Limiter) acquireRejected() (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rejected >= maxRejectedConns {
+		return nil, false
+	}
+	l.rejected++
+
+	return l.releaser(func() {
+		l.rejected--
+	}), true
+}
+
+// releaser makes the release of a connection happen only once, under the lock.
+func (l *Limiter) releaser(release func()) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			release()
+		})
+	}
+}
+
+// sweep forgets clients with no connections, whose rate limits have fully recovered.
+func (l *Limiter) sweep(now time.Time) {
+	for ip, c := range l.clients {
+		if c.conns == 0 && (c.rate == nil || c.rate.TokensAt(now) >= float64(c.rate.Burst())) {
+			delete(l.clients, ip)
+		}
+	}
+	l.lastSweep = now
+}
+
+// newRateLimiter allows the number of events per second, with bursts of up to a second worth of them.
+func newRateLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), int(math.Ceil(perSecond)))
+}
+
+// limitListener checks the connections accepted from a listener against the limits.
+type limitListener struct {
+	net.Listener
+	limiter *Limiter
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		release, err := l.limiter.acquire(remoteIP(conn.RemoteAddr().String()))
+		if err == nil {
+			return &limitedConn{Conn: conn, release: release}, nil
+		}
+
+		release, ok := l.limiter.acquireRejected()
+		if !ok {
+			conn.Close()
+			continue
+		}
+
+		c := &limitedConn{Conn: conn, err: err, release: release, deadline: time.Now().Add(rejectTimeout)}
+		c.Conn.SetDeadline(c.deadline)
+		return c, nil
+	}
+}
+
+// limitedConn is a connection counted towards the limits until it is closed.
+type limitedConn struct {
+	net.Conn
+
+	// err tells why the connection was rejected, if it was
+	err     error
+	release func()
+
+	// deadline is the latest deadline that can be set for a rejected connection
+	deadline time.Time
+}
+
+func (c *limitedConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetDeadline(c.clampDeadline(t))
+}
+
+func (c *limitedConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(c.clampDeadline(t))
+}
+
+func (c *limitedConn) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(c.clampDeadline(t))
+}
+
+// clampDeadline keeps rejected connections from extending their deadline.
+func (c *limitedConn) clampDeadline(t time.Time) time.Time {
+	if c.err != nil && (t.IsZero() || t.After(c.deadline)) {
+		return c.deadline
+	}
+	return t
+}
+
+func (c *limitedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+func (c *limitedConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
+
+func (c *limitedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// limitErrorOf tells why the connection was rejected by a limiter, if it was.
+func limitErrorOf(conn net.Conn) error {
+	if c, ok := conn.(*limitedConn); ok {
+		return c.err
+	}
+	return nil
+}
+
+type limitErrorKey struct{}
+
+// withLimitError remembers that the connection served under the context was rejected by a limiter.
+func withLimitError(ctx context.Context, conn net.Conn) context.Context {
+	if err := limitErrorOf(conn); err != nil {
+		return context.WithValue(ctx, limitErrorKey{}, err)
+	}
+	return ctx
+}
+
+func limitErrorFrom(ctx context.Context) error {
+	err, _ := ctx.Value(limitErrorKey{}).(error)
+	return err
+}
+
+// remoteIP finds the IP of a remote address, with an invalid address standing for an unknown one.
+func remoteIP(remoteAddr string) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/socks"
+)
+
+// protoMux detects the protocol of connections accepted from a listener by peeking at their first byte.
+type protoMux struct {
+	l       net.Listener
+	log     proxy.Logger
+	metrics proxy.Metrics
+
+	// handshakeTimeout limits the time to wait for the first byte of a connection
+	handshakeTimeout time.Duration
+
+	socks *connListener
+	http  *connListener
+
+	mu      sync.Mutex
+	pending map[net.Conn]struct{}
+	active  sync.WaitGroup
+}
+
+func newProtoMux(l net.Listener, handshakeTimeout time.Duration, log proxy.Logger, metrics proxy.Metrics) *protoMux {
+	return &protoMux{
+		l:       l,
+		log:     log,
+		metrics: metrics,
+
+		handshakeTimeout: handshakeTimeout,
+
+		socks: newConnListener(l.Addr()),
+		http:  newConnListener(l.Addr()),
+
+		pending: make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve dispatches connections until the listener is closed.
+func (m *protoMux) Serve() {
+	for {
+		conn, err := m.l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			m.log.Error("Protocol detection failure", "error", fmt.Errorf("accept connection: %w", err))
+			continue
+		}
+
+		if m.handshakeTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(m.handshakeTimeout))
+		}
+
+		m.mu.Lock()
+		m.pending[conn] = struct{}{}
+		m.mu.Unlock()
+
+		m.active.Add(1)
+		go func() {
+			defer m.active.Done()
+			m.dispatch(conn)
+		}()
+	}
+
+	// Interrupt the detection of connections that have not sent anything yet
+	m.mu.Lock()
+	for conn := range m.pending {
+		conn.SetReadDeadline(time.Now())
+	}
+	m.mu.Unlock()
+
+	m.active.Wait()
+}
+
+func (m *protoMux) dispatch(conn net.Conn) {
+	bufr := bufio.NewReader(conn)
+	first, err := bufr.Peek(1)
+
+	m.mu.Lock()
+	delete(m.pending, conn)
+	m.mu.Unlock()
+
+	if err != nil {
+		m.metrics.HandshakeFailed(addr.ProtoAuto, handshakeFailure(err))
+		conn.Close()
+		return
+	}
+	if m.handshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+
+	target := m.http
+	switch socks.Version(first[0]) {
+	case socks.V4, socks.V5:
+		target = m.socks
+	}
+
+	if !target.push(proxy.WithBufferedReader(conn, bufr)) {
+		conn.Close()
+	}
+}
+
+func newConnListener(a net.Addr) *connListener {
+	return &connListener{
+		addr:  a,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// connListener is a [net.Listener] that accepts connections handed over to it one at a time.
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+func serveAuto(ctx context.Context, socksServ *SOCKSServer, httpServ *HTTPServer, l net.Listener, handshakeTimeout time.Duration, log proxy.Logger) error {
+	mux := newProtoMux(l, handshakeTimeout, log, socksServ.metrics())
+
+	socksErr := make(chan error, 1)
+	go func() {
+		socksErr <- socksServ.ServeSOCKS(ctx, mux.socks)
+	}()
+
+	httpErr := make(chan error, 1)
+	go func() {
+		httpErr <- httpServ.ServeHTTP(ctx, mux.http)
+	}()
+
+	muxDone := make(chan struct{})
+	go func() {
+		defer close(muxDone)
+		mux.Serve()
+	}()
+
+	<-ctx.Done()
+	err := l.Close()
+	<-muxDone
+
+	if err != nil {
+		err = fmt.Errorf("close listener: %w", err)
+	}
+	return errors.Join(err, <-socksErr, <-httpErr)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+)
+
+// NewRegistry creates an empty [Registry].
+func NewRegistry() *Registry {
+	return &Registry{
+		tunnels: make(map[uint64]*registeredTunnel),
+	}
+}
+
+// Registry keeps track of tunnels open on servers, so that they can be inspected and closed on demand.
+//
+// Plain HTTP requests forwarded by servers are tracked as tunnels too, for as long as they are served.
+type Registry struct {
+	mu      sync.Mutex
+	tunnels map[uint64]*registeredTunnel
+}
+
+// TunnelInfo describes an active tunnel.
+type TunnelInfo struct {
+	// ID is the ID of the request that opened the tunnel, as found in logs.
+	ID uint64
+
+	Proto       addr.Proto
+	Client      string
+	Destination string
+
+	// Route and Upstream tell how the destination was reached, if known.
+	Route    string
+	Upstream string
+
+	// BytesSent is the number of bytes sent by the client so far.
+	BytesSent int64
+
+	// BytesReceived is the number of bytes received by the client so far.
+	BytesReceived int64
+
+	Opened time.Time
+}
+
+// Tunnels lists the active tunnels, in the order they were opened.
+func (r *Registry) Tunnels() []TunnelInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tunnels := make([]TunnelInfo, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		tunnels = append(tunnels, t.snapshot())
+	}
+
+	slices.SortFunc(tunnels, func(a, b TunnelInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return tunnels
+}
+
+// CloseTunnel closes the tunnel with the ID, reporting whether there was one.
+func (r *Registry) CloseTunnel(id uint64) bool {
+	r.mu.Lock()
+	t, ok := r.tunnels[id]
+	r.mu.Unlock()
+
+	if ok {
+		t.cancel()
+	}
+	return ok
+}
+
+// register adds a tunnel opened by the request served under the context.
+//
+// The tunnel must use the returned context and connection in place of the passed one, and be unregistered once it is closed.
+// A nil registry leaves the tunnel as is.
+func (r *Registry) register(ctx context.Context, conn net.Conn, t *tunnel) (context.Context, net.Conn, func()) {
+	if r == nil {
+		return ctx, conn, func() {}
+	}
+
+	info := TunnelInfo{
+		ID:          requestIDOf(ctx),
+		Proto:       t.proto,
+		Client:      t.clientAddr,
+		Destination: t.dstAddr.String(),
+		Opened:      time.Now(),
+	}
+	info.Route, info.Upstream, _ = proxy.RouteOf(t.dstConn)
+
+	ctx, cancel := context.WithCancel(ctx)
+	entry := &registeredTunnel{
+		info:   info,
+		conn:   &countingConn{Conn: conn, dst: t.clientConn == nil},
+		cancel: cancel,
+	}
+
+	r.mu.Lock()
+	r.tunnels[info.ID] = entry
+	r.mu.Unlock()
+
+	return ctx, entry.conn, func() {
+		r.mu.Lock()
+		delete(r.tunnels, info.ID)
+		r.mu.Unlock()
+
+		cancel()
+	}
+}
+
+type registeredTunnel struct {
+	info   TunnelInfo
+	conn   *countingConn
+	cancel context.CancelFunc
+}
+
+func (t *registeredTunnel) snapshot() TunnelInfo {
+	info := t.info
+	info.BytesSent = t.conn.read.Load()
+	info.BytesReceived = t.conn.written.Load()
+	if t.conn.dst {
+		info.BytesSent, info.BytesReceived = info.BytesReceived, info.BytesSent
+	}
+	return info
+}
+
+// countingConn counts the bytes transferred over a connection as they go.
+type countingConn struct {
+	net.Conn
+	read    atomic.Int64
+	written atomic.Int64
+
+	// dst is set for connections to the destination, which the client receives data from rather than sends it to
+	dst bool
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *countingConn) MaxTransfer() int {
+	return 0
+}
+
+func (c *countingConn) Transferred(read, written int) error {
+	c.read.Add(int64(read))
+	c.written.Add(int64(written))
+	return nil
+}
+
+func (c *countingConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
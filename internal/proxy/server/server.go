@@ -2,20 +2,30 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"slices"
+	"sync/atomic"
+	"time"
 
 	"github.com/cerfical/socks2http/internal/proxy"
 	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/auth"
 	"github.com/cerfical/socks2http/internal/proxy/socks"
 )
 
+var lastRequestID atomic.Uint64
+
 func New(ops ...Option) *Server {
 	defaults := []Option{
 		WithDialer(proxy.DirectDialer),
+		WithPacketDialer(proxy.DirectPacketDialer),
 		WithTunneler(proxy.DefaultTunneler),
 		WithLogger(proxy.DiscardLogger),
+		WithMetrics(proxy.DiscardMetrics),
 	}
 
 	var s Server
@@ -31,6 +41,12 @@ func WithDialer(d proxy.Dialer) Option {
 	}
 }
 
+func WithPacketDialer(d proxy.PacketDialer) Option {
+	return func(s *Server) {
+		s.packetDialer = d
+	}
+}
+
 func WithTunneler(t proxy.Tunneler) Option {
 	return func(s *Server) {
 		s.tunneler = t
@@ -43,42 +59,146 @@ func WithLogger(l proxy.Logger) Option {
 	}
 }
 
+// WithMetrics makes the servers report statistics about served clients.
+func WithMetrics(m proxy.Metrics) Option {
+	return func(s *Server) {
+		s.metrics = m
+	}
+}
+
+// WithHandshakeTimeout limits the time clients can take to send a request, with zero meaning no limit.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.handshakeTimeout = d
+	}
+}
+
+// WithDrainTimeout limits the time to wait for active tunnels to close on shutdown, with zero meaning no limit.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.drainTimeout = d
+	}
+}
+
+// WithRegistry makes the servers register all of their tunnels, to be inspected and closed on demand.
+func WithRegistry(r *Registry) Option {
+	return func(s *Server) {
+		s.registry = r
+	}
+}
+
+// WithLimits makes the servers reject connections over the limits, which are shared by all listeners.
+func WithLimits(l Limits) Option {
+	return func(s *Server) {
+		s.limiter = NewLimiter(l)
+	}
+}
+
+// WithThrottling makes the servers limit the bandwidth of tunnels, with the limits shared by all listeners.
+func WithThrottling(t Throttling) Option {
+	return func(s *Server) {
+		s.throttler = NewThrottler(t)
+	}
+}
+
+func WithAuth(a *auth.Store) Option {
+	return func(s *Server) {
+		s.auth = a
+	}
+}
+
 type Option func(*Server)
 
 type Server struct {
-	tunneler proxy.Tunneler
-	dialer   proxy.Dialer
+	tunneler     proxy.Tunneler
+	dialer       proxy.Dialer
+	packetDialer proxy.PacketDialer
+	auth         *auth.Store
+	registry     *Registry
+	limiter      *Limiter
+	throttler    *Throttler
+
+	handshakeTimeout time.Duration
+	drainTimeout     time.Duration
 
-	log proxy.Logger
+	log     proxy.Logger
+	metrics proxy.Metrics
 }
 
-func (s *Server) ListenAndServe(ctx context.Context, serverURL *addr.URL) error {
+// ListenAndServe serves on all of the specified addresses until the context is canceled or any of the servers fails.
+func (s *Server) ListenAndServe(ctx context.Context, serverURLs ...addr.URL) error {
 	s.log.Info("Starting up a server")
 
+	// Bind all listeners up front, so that no server is left running if any of the addresses is unavailable
 	var lc net.ListenConfig
-	l, err := lc.Listen(ctx, "tcp", serverURL.Addr().String())
-	if err != nil {
-		return err
+	listeners := make([]net.Listener, 0, len(serverURLs))
+	for i := range serverURLs {
+		l, err := lc.Listen(ctx, "tcp", serverURLs[i].Addr().String())
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("listen on %v: %w", &serverURLs[i], err)
+		}
+		listeners = append(listeners, l)
 	}
 
-	// Use an automatically assigned port if one was not specified
-	listenPort := uint16(l.Addr().(*net.TCPAddr).Port)
-	s.log.Info("Server is up", "server_url", addr.NewURL(serverURL.Proto, serverURL.Host, listenPort))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	serveErrs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		serverURL := &serverURLs[i]
+
+		// Use an automatically assigned port if one was not specified
+		listenPort := uint16(l.Addr().(*net.TCPAddr).Port)
+		s.log.Info("Server is up", "server_url", addr.NewURL(serverURL.Proto, serverURL.Host, listenPort))
 
-	return s.Serve(ctx, serverURL.Proto, l)
+		go func() {
+			err := s.Serve(ctx, serverURL.Proto, l)
+			if err != nil {
+				// Take down the remaining servers too
+				cancel()
+			}
+			serveErrs <- err
+		}()
+	}
+
+	var errs []error
+	for range listeners {
+		errs = append(errs, <-serveErrs)
+	}
+	return errors.Join(errs...)
 }
 
 func (s *Server) Serve(ctx context.Context, p addr.Proto, l net.Listener) error {
 	socksServ := SOCKSServer{
-		Dialer:   s.dialer,
-		Tunneler: s.tunneler,
-		Log:      s.log,
+		Dialer:       s.dialer,
+		PacketDialer: s.packetDialer,
+		Tunneler:     s.tunneler,
+		Registry:     s.registry,
+		Limiter:      s.limiter,
+		Throttler:    s.throttler,
+		Auth:         s.auth,
+		Log:          s.log,
+		Metrics:      s.metrics,
+
+		HandshakeTimeout: s.handshakeTimeout,
+		DrainTimeout:     s.drainTimeout,
 	}
 
 	httpServ := HTTPServer{
-		Tunneler: s.tunneler,
-		Dialer:   s.dialer,
-		Log:      s.log,
+		Tunneler:  s.tunneler,
+		Dialer:    s.dialer,
+		Registry:  s.registry,
+		Limiter:   s.limiter,
+		Throttler: s.throttler,
+		Auth:      s.auth,
+		Log:       s.log,
+		Metrics:   s.metrics,
+
+		HandshakeTimeout: s.handshakeTimeout,
+		DrainTimeout:     s.drainTimeout,
 	}
 
 	switch p {
@@ -92,8 +212,177 @@ func (s *Server) Serve(ctx context.Context, p addr.Proto, l net.Listener) error
 		return socksServ.ServeSOCKS(ctx, l)
 	case addr.ProtoHTTP:
 		return httpServ.ServeHTTP(ctx, l)
+	case addr.ProtoAuto:
+		return serveAuto(ctx, &socksServ, &httpServ, l, s.handshakeTimeout, s.log)
 	default:
 		_ = l.Close()
 		return fmt.Errorf("unsupported protocol: %v", p)
 	}
 }
+
+// Reasons for clients failing to make a request.
+const (
+	failureTimeout     = "timeout"
+	failureClosed      = "closed"
+	failureMalformed   = "malformed"
+	failureAuth        = "auth"
+	failureUnsupported = "unsupported"
+	failureLimit       = "limit"
+)
+
+// handshakeFailure tells the reason for a client request failing to be read.
+func handshakeFailure(err error) string {
+	switch {
+	case isTimeout(err):
+		return failureTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return failureClosed
+	default:
+		return failureMalformed
+	}
+}
+
+// isTimeout reports whether the error was caused by an operation taking too long.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+type requestIDKey struct{}
+
+// withRequestID assigns a new ID to the request served under the context, to correlate its log entries.
+func withRequestID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, lastRequestID.Add(1))
+}
+
+func requestIDOf(ctx context.Context) uint64 {
+	id, _ := ctx.Value(requestIDKey{}).(uint64)
+	return id
+}
+
+type userKey struct{}
+
+// withUser remembers the user authenticated by the request served under the context.
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// userOf tells the user authenticated by the request served under the context, if any.
+func userOf(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// tunnel is a tunnel opened for a client request.
+type tunnel struct {
+	proto      addr.Proto
+	dstAddr    *addr.Addr
+	clientAddr string
+
+	// clientConn is nil for tunnels forwarding a single HTTP request
+	clientConn net.Conn
+	dstConn    net.Conn
+}
+
+// run transfers data through the tunnel until it is closed, keeping track of it meanwhile.
+func (t *tunnel) run(ctx context.Context, tunneler proxy.Tunneler, registry *Registry, throttler *Throttler, metrics proxy.Metrics, log proxy.Logger) {
+	ctx, clientConn, untrack := t.track(ctx, t.clientConn, registry, throttler, metrics)
+	defer untrack()
+
+	metrics.TunnelOpened(t.proto)
+	stats, err := tunneler.Tunnel(ctx, clientConn, t.dstConn)
+	metrics.TunnelClosed(t.proto, &stats)
+	logTunnelClosed(ctx, log, &stats, err)
+}
+
+// track registers, throttles and meters a connection of the tunnel, until the returned function is called.
+//
+// The connection is the client one, unless the tunnel forwards a single request and has none.
+// The tunnel must use the returned context and connection in place of the passed ones.
+func (t *tunnel) track(ctx context.Context, conn net.Conn, registry *Registry, throttler *Throttler, metrics proxy.Metrics) (context.Context, net.Conn, func()) {
+	ctx, conn, unregister := registry.register(ctx, conn, t)
+	conn, release := throttler.throttle(ctx, conn, t)
+	return ctx, meter(conn, metrics, t), func() {
+		release()
+		unregister()
+	}
+}
+
+// meter makes a connection of the tunnel report the bytes transferred over it as they go, unless metrics are discarded.
+//
+// The connection is the client one, unless the tunnel forwards a single request and has none.
+func meter(conn net.Conn, metrics proxy.Metrics, t *tunnel) net.Conn {
+	if metrics == proxy.DiscardMetrics {
+		return conn
+	}
+	return &meteredConn{Conn: conn, metrics: metrics, proto: t.proto, dst: t.clientConn == nil}
+}
+
+// meteredConn reports the bytes transferred over a connection of a tunnel to metrics.
+type meteredConn struct {
+	net.Conn
+	metrics proxy.Metrics
+	proto   addr.Proto
+
+	// dst is set for connections to the destination, which the client receives data from rather than sends it to
+	dst bool
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.Transferred(n, 0)
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.Transferred(0, n)
+	}
+	return n, err
+}
+
+func (c *meteredConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *meteredConn) MaxTransfer() int {
+	return 0
+}
+
+func (c *meteredConn) Transferred(read, written int) error {
+	sent, received := int64(read), int64(written)
+	if c.dst {
+		sent, received = received, sent
+	}
+	c.metrics.TunnelTransferred(c.proto, sent, received)
+	return nil
+}
+
+func (c *meteredConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
+
+// logTunnelClosed reports the traffic through a tunnel opened by the request served under the context.
+func logTunnelClosed(ctx context.Context, log proxy.Logger, stats *proxy.TunnelStats, err error) {
+	fields := []any{
+		"request_id", requestIDOf(ctx),
+		"bytes_sent", stats.BytesSent,
+		"bytes_received", stats.BytesReceived,
+		"duration", stats.Duration,
+		"close_reason", stats.CloseReason,
+	}
+
+	if err != nil {
+		log.Error("Tunnel closed", append(fields,
+			"error", err,
+		)...)
+	} else {
+		log.Info("Tunnel closed", fields...)
+	}
+}
@@ -0,0 +1,899 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/auth"
+	"github.com/cerfical/socks2http/internal/proxy/mocks"
+	"github.com/cerfical/socks2http/internal/proxy/server"
+	"github.com/cerfical/socks2http/internal/proxy/socks"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestServer(t *testing.T) {
+	suite.Run(t, new(ServerTest))
+}
+
+type ServerTest struct {
+	suite.Suite
+}
+
+func (t *ServerTest) TestServe_Auto() {
+	dstHost := addr.NewAddr("127.0.0.1", 1111)
+
+	t.Run("detects SOCKS4 clients", func() {
+		dial, _ := t.startServer(addr.ProtoAuto, t.expectTunnel(dstHost))
+		proxyConn := dial()
+
+		req := socks.Request{
+			Version: socks.V4,
+			Command: socks.CommandConnect,
+			DstAddr: *dstHost,
+		}
+		t.Require().NoError(req.Write(proxyConn))
+
+		reply, err := socks.ReadReply(bufio.NewReader(proxyConn))
+		t.Require().NoError(err)
+
+		t.Equal(socks.StatusGranted, reply.Status)
+	})
+
+	t.Run("detects SOCKS5 clients", func() {
+		dial, _ := t.startServer(addr.ProtoAuto, t.expectTunnel(dstHost))
+		proxyConn := dial()
+		proxyRead := bufio.NewReader(proxyConn)
+
+		greet := socks.Greeting{
+			Version: socks.V5,
+			Auth:    []socks.Auth{socks.AuthNone},
+		}
+		t.Require().NoError(greet.Write(proxyConn))
+
+		_, err := socks.ReadGreetingReply(proxyRead)
+		t.Require().NoError(err)
+
+		req := socks.Request{
+			Version: socks.V5,
+			Command: socks.CommandConnect,
+			DstAddr: *dstHost,
+		}
+		t.Require().NoError(req.Write(proxyConn))
+
+		reply, err := socks.ReadReply(proxyRead)
+		t.Require().NoError(err)
+
+		t.Equal(socks.StatusGranted, reply.Status)
+	})
+
+	t.Run("detects HTTP clients", func() {
+		dial, _ := t.startServer(addr.ProtoAuto, t.expectTunnel(dstHost))
+		proxyConn := dial()
+
+		req := httptest.NewRequest(http.MethodConnect, dstHost.String(), nil)
+		t.Require().NoError(req.WriteProxy(proxyConn))
+
+		resp, err := http.ReadResponse(bufio.NewReader(proxyConn), nil)
+		t.Require().NoError(err)
+
+		t.Equal(http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("shuts down with connections waiting for protocol detection", func() {
+		dial, stop := t.startServer(addr.ProtoAuto)
+		dial()
+
+		t.Require().NoError(<-stop())
+	})
+}
+
+func (t *ServerTest) TestServe_Drain() {
+	dstHost := addr.NewAddr("127.0.0.1", 1111)
+	protos := map[string]addr.Proto{
+		"SOCKS": addr.ProtoSOCKS5,
+		"HTTP":  addr.ProtoHTTP,
+	}
+
+	for name, proto := range protos {
+		t.Run(name+" server waits for active tunnels to finish", func() {
+			release := make(chan struct{})
+			tunnelErrs := make(chan error, 1)
+			stop := t.serveTunnel(proto, dstHost, func(ctx context.Context) (proxy.TunnelStats, error) {
+				<-release
+				tunnelErrs <- ctx.Err()
+				return proxy.TunnelStats{}, nil
+			}, server.WithDrainTimeout(time.Minute))
+
+			serveErr := stop()
+			select {
+			case <-serveErr:
+				t.Fail("server shut down with an active tunnel")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			close(release)
+			t.NoError(<-tunnelErrs)
+			t.NoError(<-serveErr)
+		})
+
+		t.Run(name+" server closes remaining tunnels after drain period", func() {
+			stop := t.serveTunnel(proto, dstHost, func(ctx context.Context) (proxy.TunnelStats, error) {
+				<-ctx.Done()
+				return proxy.TunnelStats{}, ctx.Err()
+			}, server.WithDrainTimeout(50*time.Millisecond))
+
+			select {
+			case err := <-stop():
+				t.NoError(err)
+			case <-time.After(2 * time.Second):
+				t.Fail("server did not close the tunnel after drain period")
+			}
+		})
+
+		t.Run(name+" server closes silent clients after drain period", func() {
+			dial, stop := t.startServer(proto, server.WithDrainTimeout(50*time.Millisecond))
+			dial()
+
+			// Make sure the connection is being served before shutting down
+			time.Sleep(50 * time.Millisecond)
+
+			select {
+			case err := <-stop():
+				t.NoError(err)
+			case <-time.After(2 * time.Second):
+				t.Fail("server did not close the silent client after drain period")
+			}
+		})
+	}
+}
+
+func (t *ServerTest) TestServe_TunnelStats() {
+	dstHost := addr.NewAddr("127.0.0.1", 1111)
+	protos := map[string]addr.Proto{
+		"SOCKS": addr.ProtoSOCKS5,
+		"HTTP":  addr.ProtoHTTP,
+	}
+
+	for name, proto := range protos {
+		t.Run(name+" server logs traffic of closed tunnels along with the request", func() {
+			log := &RecordingLogger{}
+			stats := proxy.TunnelStats{
+				BytesSent:     7,
+				BytesReceived: 13,
+				Duration:      time.Second,
+				CloseReason:   proxy.CloseReasonDestination,
+			}
+			t.serveTunnel(proto, dstHost, func(context.Context) (proxy.TunnelStats, error) {
+				return stats, nil
+			}, server.WithLogger(log))
+
+			var closed, accepted []LogEntry
+			t.Eventually(func() bool {
+				closed, accepted = nil, nil
+				for _, e := range log.Entries() {
+					if e.Msg == "Tunnel closed" {
+						closed = append(closed, e)
+					} else if _, ok := e.Fields["request_id"]; ok {
+						accepted = append(accepted, e)
+					}
+				}
+				return len(closed) != 0
+			}, time.Second, 10*time.Millisecond)
+
+			t.Require().Len(closed, 1)
+			t.Require().Len(accepted, 1)
+			t.Equal(accepted[0].Fields["request_id"], closed[0].Fields["request_id"])
+
+			t.Equal(stats.BytesSent, closed[0].Fields["bytes_sent"])
+			t.Equal(stats.BytesReceived, closed[0].Fields["bytes_received"])
+			t.Equal(stats.Duration, closed[0].Fields["duration"])
+			t.Equal(stats.CloseReason, closed[0].Fields["close_reason"])
+		})
+	}
+}
+
+func (t *ServerTest) TestServe_Metrics() {
+	dstHost := addr.NewAddr("127.0.0.1", 1111)
+	tests := map[string]struct {
+		proto addr.Proto
+		want  []string
+	}{
+		"SOCKS": {
+			proto: addr.ProtoSOCKS5,
+			want: []string{
+				"accepted SOCKS5",
+				"served SOCKS5 Granted",
+				"tunnel opened SOCKS5",
+				"tunnel closed SOCKS5 source-closed",
+			},
+		},
+		"HTTP": {
+			proto: addr.ProtoHTTP,
+			want: []string{
+				"accepted HTTP",
+				"served HTTP 200",
+				"tunnel opened HTTP",
+				"tunnel closed HTTP source-closed",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name+" server reports served tunnels", func() {
+			metrics := &RecordingMetrics{}
+			t.serveTunnel(test.proto, dstHost, func(context.Context) (proxy.TunnelStats, error) {
+				return proxy.TunnelStats{CloseReason: proxy.CloseReasonSource}, nil
+			}, server.WithMetrics(metrics))
+
+			t.Eventually(func() bool {
+				return len(metrics.Events()) == len(test.want)
+			}, time.Second, 10*time.Millisecond)
+			t.Equal(test.want, metrics.Events())
+		})
+	}
+
+	protos := map[string]addr.Proto{
+		"SOCKS": addr.ProtoSOCKS5,
+		"HTTP":  addr.ProtoHTTP,
+	}
+
+	for name, proto := range protos {
+		t.Run(name+" server reports traffic of tunnels while they are open", func() {
+			metrics := &RecordingMetrics{}
+			conn, dstConn := t.serveOpenTunnel(proto, dstHost, "", server.WithMetrics(metrics))
+
+			t.writeString(conn, "abcd")
+			t.Equal("abcd", t.readString(dstConn, 4))
+			t.writeString(dstConn, "ef")
+			t.Equal("ef", t.readString(conn, 2))
+
+			t.Eventually(func() bool {
+				sent, received := metrics.Transferred()
+				return sent == 4 && received == 2
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+
+	t.Run("HTTP server reports traffic of forwarded requests", func() {
+		metrics := &RecordingMetrics{}
+		pipe, dstConn := t.pipeTo(dstHost)
+		dial, _ := t.startServer(addr.ProtoHTTP, pipe, server.WithMetrics(metrics))
+
+		t.Equal("abcd", t.forwardRequest(dial(), dstConn, dstHost, "", "abcd"))
+
+		// The request and the response headers are counted too
+		sent, received := metrics.Transferred()
+		t.Greater(sent, int64(0))
+		t.Greater(received, int64(4))
+	})
+
+	t.Run("SOCKS server reports handshake timeouts", func() {
+		metrics := &RecordingMetrics{}
+		dial, _ := t.startServer(addr.ProtoSOCKS5,
+			server.WithHandshakeTimeout(50*time.Millisecond),
+			server.WithMetrics(metrics),
+		)
+		dial()
+
+		t.Eventually(func() bool {
+			return len(metrics.Events()) == 2
+		}, time.Second, 10*time.Millisecond)
+		t.Equal([]string{"accepted SOCKS5", "handshake failed SOCKS5 timeout"}, metrics.Events())
+	})
+}
+
+func (t *ServerTest) TestServe_Registry() {
+	dstHost := addr.NewAddr("127.0.0.1", 1111)
+	protos := map[string]addr.Proto{
+		"SOCKS": addr.ProtoSOCKS5,
+		"HTTP":  addr.ProtoHTTP,
+	}
+
+	for name, proto := range protos {
+		t.Run(name+" server registers tunnels while they are open", func() {
+			registry := server.NewRegistry()
+			conn, dstConn := t.serveOpenTunnel(proto, dstHost, "", server.WithRegistry(registry))
+
+			t.writeString(conn, "ping")
+			t.Equal("ping", t.readString(dstConn, 4))
+			t.writeString(dstConn, "pong!")
+			t.Equal("pong!", t.readString(conn, 5))
+
+			// The traffic is counted once the tunnel is done with writing it
+			var tunnels []server.TunnelInfo
+			t.Eventually(func() bool {
+				tunnels = registry.Tunnels()
+				return len(tunnels) == 1 && tunnels[0].BytesReceived == 5
+			}, time.Second, 10*time.Millisecond)
+
+			t.Equal(proto, tunnels[0].Proto)
+			t.Equal(conn.LocalAddr().String(), tunnels[0].Client)
+			t.Equal(dstHost.String(), tunnels[0].Destination)
+			t.Equal(int64(4), tunnels[0].BytesSent)
+
+			conn.Close()
+			t.Eventually(func() bool {
+				return len(registry.Tunnels()) == 0
+			}, time.Second, 10*time.Millisecond)
+		})
+
+		t.Run(name+" server closes tunnels on demand", func() {
+			registry := server.NewRegistry()
+			conn, _ := t.serveOpenTunnel(proto, dstHost, "", server.WithRegistry(registry))
+
+			t.Eventually(func() bool {
+				return len(registry.Tunnels()) == 1
+			}, time.Second, 10*time.Millisecond)
+			t.True(registry.CloseTunnel(registry.Tunnels()[0].ID))
+
+			_, err := io.ReadAll(conn)
+			t.NoError(err)
+			t.Eventually(func() bool {
+				return len(registry.Tunnels()) == 0
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+
+	t.Run("HTTP server registers forwarded requests and closes them on demand", func() {
+		registry := server.NewRegistry()
+		pipe, dstConn := t.pipeTo(dstHost)
+		dial, _ := t.startServer(addr.ProtoHTTP, pipe, server.WithRegistry(registry))
+		conn := dial()
+
+		req := httptest.NewRequest(http.MethodGet, "http://"+dstHost.String()+"/", nil)
+		t.Require().NoError(req.WriteProxy(conn))
+		_, err := http.ReadRequest(bufio.NewReader(dstConn))
+		t.Require().NoError(err)
+
+		var tunnels []server.TunnelInfo
+		t.Eventually(func() bool {
+			tunnels = registry.Tunnels()
+			return len(tunnels) == 1 && tunnels[0].BytesSent > 0
+		}, time.Second, 10*time.Millisecond)
+		t.Equal(conn.LocalAddr().String(), tunnels[0].Client)
+		t.Equal(dstHost.String(), tunnels[0].Destination)
+
+		t.True(registry.CloseTunnel(tunnels[0].ID))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		t.Require().NoError(err)
+		resp.Body.Close()
+		t.Equal(http.StatusBadGateway, resp.StatusCode)
+		t.Eventually(func() bool {
+			return len(registry.Tunnels()) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("closing an unknown tunnel does nothing", func() {
+		t.False(server.NewRegistry().CloseTunnel(1))
+	})
+}
+
+func (t *ServerTest) TestServe_Limits() {
+	dstHost := addr.NewAddr("127.0.0.1", 1111)
+	protos := map[string]addr.Proto{
+		"SOCKS": addr.ProtoSOCKS5,
+		"HTTP":  addr.ProtoHTTP,
+	}
+
+	tests := map[string]struct {
+		limits     server.Limits
+		wantStatus int
+	}{
+		"concurrent connections": {
+			limits:     server.Limits{MaxConns: 1},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		"concurrent connections per IP": {
+			limits:     server.Limits{MaxConnsPerIP: 1},
+			wantStatus: http.StatusTooManyRequests,
+		},
+		"connection rate": {
+			limits:     server.Limits{Rate: 1},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		"connection rate per IP": {
+			limits:     server.Limits{RatePerIP: 1},
+			wantStatus: http.StatusTooManyRequests,
+		},
+	}
+
+	for protoName, proto := range protos {
+		for name, test := range tests {
+			t.Run(fmt.Sprintf("%s server limits %s", protoName, name), func() {
+				metrics := &RecordingMetrics{}
+				dial, _ := t.startServer(proto, t.holdTunnels(dstHost), server.WithLimits(test.limits), server.WithMetrics(metrics))
+
+				conn := dial()
+				t.requestTunnel(conn, proto, dstHost)
+				t.awaitTunnel(conn, proto)
+
+				rejectedConn := dial()
+				t.requestTunnel(rejectedConn, proto, dstHost)
+				t.awaitRejection(rejectedConn, proto, test.wantStatus)
+
+				t.Contains(metrics.Events(), fmt.Sprintf("handshake failed %v limit", proto))
+			})
+		}
+
+		t.Run(protoName+" server admits connections again once others are closed", func() {
+			dial, _ := t.startServer(proto, t.holdTunnels(dstHost), server.WithLimits(server.Limits{MaxConns: 1}))
+
+			conn := dial()
+			t.requestTunnel(conn, proto, dstHost)
+			t.awaitTunnel(conn, proto)
+			conn.Close()
+
+			// The connection is released once the server is done with it
+			t.Eventually(func() bool {
+				conn := dial()
+				defer conn.Close()
+
+				t.requestTunnel(conn, proto, dstHost)
+				if proto == addr.ProtoHTTP {
+					resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+					t.Require().NoError(err)
+					return resp.StatusCode == http.StatusOK
+				}
+
+				r := bufio.NewReader(conn)
+				_, err := socks.ReadGreetingReply(r)
+				t.Require().NoError(err)
+				reply, err := socks.ReadReply(r)
+				t.Require().NoError(err)
+				return reply.Status == socks.StatusGranted
+			}, time.Second, 10*time.Millisecond)
+		})
+
+		t.Run(protoName+" server closes rejected connections over the limit right away", func() {
+			dial, _ := t.startServer(proto, t.holdTunnels(dstHost), server.WithLimits(server.Limits{MaxConns: 1}))
+			dial()
+
+			// Only a limited number of rejected clients are kept waiting for a request
+			for range 64 {
+				dial()
+			}
+
+			conn := dial()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := conn.Read(make([]byte, 1))
+			t.NotErrorIs(err, os.ErrDeadlineExceeded)
+		})
+	}
+
+	t.Run("SOCKS server refuses authentication of rejected clients", func() {
+		dial, _ := t.startServer(addr.ProtoSOCKS5, t.holdTunnels(dstHost),
+			server.WithLimits(server.Limits{MaxConns: 1}),
+			server.WithAuth(auth.NewStore(auth.Credentials{Username: "root", Password: "secret"})),
+		)
+		dial()
+
+		conn := dial()
+		t.Require().NoError((&socks.Greeting{Version: socks.V5, Auth: []socks.Auth{socks.AuthPassword}}).Write(conn))
+		t.Require().NoError((&socks.PasswordAuth{Username: "root", Password: "secret"}).Write(conn))
+
+		r := bufio.NewReader(conn)
+		_, err := socks.ReadGreetingReply(r)
+		t.Require().NoError(err)
+		authReply, err := socks.ReadPasswordAuthReply(r)
+		t.Require().NoError(err)
+		t.False(authReply.Success)
+
+		// The client is expected to close the connection after a failed authentication
+		_, err = r.ReadByte()
+		t.ErrorIs(err, io.EOF)
+	})
+}
+
+// holdTunnels makes a server keep tunnels to the destination open until clients close them.
+func (t *ServerTest) holdTunnels(dstHost *addr.Addr) server.Option {
+	dial := mocks.NewDialer(t.T())
+	dial.EXPECT().
+		Dial(mock.Anything, dstHost).
+		Return(NewDummyConn(), nil).
+		Maybe()
+
+	tun := mocks.NewTunneler(t.T())
+	tun.EXPECT().
+		Tunnel(mock.Anything, mock.Anything, mock.Anything).
+		RunAndReturn(func(_ context.Context, clientConn, _ net.Conn) (proxy.TunnelStats, error) {
+			_, err := io.Copy(io.Discard, clientConn)
+			return proxy.TunnelStats{}, err
+		}).
+		Maybe()
+
+	return withMocks(tun, dial)
+}
+
+// awaitRejection reads the reply to a tunnel request, which must have been rejected for exceeding the limits.
+func (t *ServerTest) awaitRejection(conn net.Conn, proto addr.Proto, wantStatus int) {
+	r := bufio.NewReader(conn)
+	if proto == addr.ProtoHTTP {
+		resp, err := http.ReadResponse(r, nil)
+		t.Require().NoError(err)
+		t.Equal(wantStatus, resp.StatusCode)
+		t.True(resp.Close)
+		return
+	}
+
+	_, err := socks.ReadGreetingReply(r)
+	t.Require().NoError(err)
+
+	reply, err := socks.ReadReply(r)
+	t.Require().NoError(err)
+	t.Equal(socks.StatusGeneralFailure, reply.Status)
+}
+
+func (t *ServerTest) TestServe_Throttling() {
+	dstHost := addr.NewAddr("127.0.0.1", 1111)
+	protos := map[string]addr.Proto{
+		"SOCKS": addr.ProtoSOCKS5,
+		"HTTP":  addr.ProtoHTTP,
+	}
+
+	// The burst is available right away, and the rest takes 200ms
+	bandwidth := proxy.Bandwidth{
+		Upload:        1000,
+		UploadBurst:   100,
+		Download:      1000,
+		DownloadBurst: 100,
+	}
+
+	tests := map[string]server.Throttling{
+		"global":    {Global: bandwidth},
+		"per-IP":    {PerIP: bandwidth},
+		"per-user":  {PerUser: bandwidth},
+		"unlimited": {},
+	}
+
+	for protoName, proto := range protos {
+		for name, throttling := range tests {
+			t.Run(fmt.Sprintf("%s server applies %s bandwidth limits", protoName, name), func() {
+				conn, dstConn := t.serveOpenTunnel(proto, dstHost, "root", server.WithThrottling(throttling))
+
+				download := t.measure(func() {
+					go io.WriteString(dstConn, strings.Repeat("a", 300))
+					t.readString(conn, 300)
+				})
+				upload := t.measure(func() {
+					go io.WriteString(conn, strings.Repeat("a", 300))
+					t.readString(dstConn, 300)
+				})
+
+				// Only check that limits slow tunnels down, as loaded machines can slow down any tunnel
+				if throttling != (server.Throttling{}) {
+					t.GreaterOrEqual(download, 150*time.Millisecond)
+					t.GreaterOrEqual(upload, 150*time.Millisecond)
+				}
+			})
+		}
+	}
+
+	for name, throttling := range tests {
+		if throttling == (server.Throttling{}) {
+			continue
+		}
+
+		t.Run(fmt.Sprintf("HTTP server applies %s bandwidth limits to forwarded requests", name), func() {
+			pipe, dstConn := t.pipeTo(dstHost)
+			dial, _ := t.startServer(addr.ProtoHTTP, pipe,
+				server.WithThrottling(throttling),
+				server.WithAuth(auth.NewStore(auth.Credentials{Username: "root", Password: "secret"})),
+			)
+			conn := dial()
+
+			download := t.measure(func() {
+				body := t.forwardRequest(conn, dstConn, dstHost, "root", strings.Repeat("a", 300))
+				t.Equal(300, len(body))
+			})
+			t.GreaterOrEqual(download, 150*time.Millisecond)
+		})
+	}
+
+	t.Run("per-user bandwidth limits do not apply to anonymous clients", func() {
+		// The limit is low enough for the transfer to take minutes if it were applied
+		conn, dstConn := t.serveOpenTunnel(addr.ProtoHTTP, dstHost, "", server.WithThrottling(server.Throttling{
+			PerUser: proxy.Bandwidth{Download: 1, DownloadBurst: 1},
+		}))
+
+		go io.WriteString(dstConn, strings.Repeat("a", 300))
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		t.Equal(300, len(t.readString(conn, 300)))
+	})
+}
+
+// forwardRequest sends a plain HTTP request through a server, with the destination replying with the body.
+func (t *ServerTest) forwardRequest(conn, dstConn net.Conn, dstHost *addr.Addr, user, body string) string {
+	go func() {
+		if _, err := http.ReadRequest(bufio.NewReader(dstConn)); err == nil {
+			fmt.Fprintf(dstConn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		}
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+dstHost.String()+"/", nil)
+	if user != "" {
+		req.Header.Set("Proxy-Authorization", basicAuth(user, "secret"))
+	}
+	t.Require().NoError(req.WriteProxy(conn))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	t.Require().NoError(err)
+	defer resp.Body.Close()
+
+	got, err := io.ReadAll(resp.Body)
+	t.Require().NoError(err)
+	return string(got)
+}
+
+func (t *ServerTest) measure(f func()) time.Duration {
+	start := time.Now()
+	f()
+	return time.Since(start)
+}
+
+// serveOpenTunnel opens a tunnel through a server, authenticating as the user if one is specified.
+func (t *ServerTest) serveOpenTunnel(proto addr.Proto, dstHost *addr.Addr, user string, ops ...server.Option) (conn, dstConn net.Conn) {
+	if user != "" {
+		ops = append(ops, server.WithAuth(auth.NewStore(auth.Credentials{Username: user, Password: "secret"})))
+	}
+	pipe, dstConn := t.pipeTo(dstHost)
+	dial, _ := t.startServer(proto, append(ops, pipe)...)
+	conn = dial()
+
+	if user == "" {
+		t.requestTunnel(conn, proto, dstHost)
+		t.awaitTunnel(conn, proto)
+		return conn, dstConn
+	}
+
+	if proto == addr.ProtoHTTP {
+		req := httptest.NewRequest(http.MethodConnect, dstHost.String(), nil)
+		req.Header.Set("Proxy-Authorization", basicAuth(user, "secret"))
+		t.Require().NoError(req.WriteProxy(conn))
+		t.awaitTunnel(conn, proto)
+		return conn, dstConn
+	}
+
+	t.Require().NoError((&socks.Greeting{Version: socks.V5, Auth: []socks.Auth{socks.AuthPassword}}).Write(conn))
+	t.Require().NoError((&socks.PasswordAuth{Username: user, Password: "secret"}).Write(conn))
+	t.Require().NoError((&socks.Request{Version: socks.V5, Command: socks.CommandConnect, DstAddr: *dstHost}).Write(conn))
+
+	r := bufio.NewReaderSize(oneByteReader{conn}, 16)
+	_, err := socks.ReadGreetingReply(r)
+	t.Require().NoError(err)
+	authReply, err := socks.ReadPasswordAuthReply(r)
+	t.Require().NoError(err)
+	t.Require().True(authReply.Success)
+	reply, err := socks.ReadReply(r)
+	t.Require().NoError(err)
+	t.Require().Equal(socks.StatusGranted, reply.Status)
+	return conn, dstConn
+}
+
+// pipeTo makes a server connect to the destination over a pipe, returning the other end of the pipe.
+func (t *ServerTest) pipeTo(dstHost *addr.Addr) (server.Option, net.Conn) {
+	dstConn, dstProxyConn := net.Pipe()
+	t.T().Cleanup(func() { dstConn.Close() })
+
+	dial := mocks.NewDialer(t.T())
+	dial.EXPECT().
+		Dial(mock.Anything, dstHost).
+		Return(dstProxyConn, nil)
+
+	return server.WithDialer(dial), dstConn
+}
+
+func (t *ServerTest) writeString(w io.Writer, s string) {
+	_, err := io.WriteString(w, s)
+	t.Require().NoError(err)
+}
+
+func (t *ServerTest) readString(r io.Reader, n int) string {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	t.Require().NoError(err)
+	return string(buf)
+}
+
+// serveTunnel starts a server and opens a tunnel through it, which is handled by the tunnel function.
+func (t *ServerTest) serveTunnel(proto addr.Proto, dstHost *addr.Addr, tunnel func(context.Context) (proxy.TunnelStats, error), ops ...server.Option) (stop func() <-chan error) {
+	dial := mocks.NewDialer(t.T())
+	dial.EXPECT().
+		Dial(mock.Anything, dstHost).
+		Return(NewDummyConn(), nil)
+
+	tunnelStarted := make(chan struct{})
+	tun := mocks.NewTunneler(t.T())
+	tun.EXPECT().
+		Tunnel(mock.Anything, mock.Anything, mock.Anything).
+		RunAndReturn(func(ctx context.Context, _, _ net.Conn) (proxy.TunnelStats, error) {
+			close(tunnelStarted)
+			return tunnel(ctx)
+		})
+
+	connect, stop := t.startServer(proto, append(ops, withMocks(tun, dial))...)
+	t.requestTunnel(connect(), proto, dstHost)
+
+	<-tunnelStarted
+	return stop
+}
+
+// requestTunnel asks the server to open a tunnel to the destination, without waiting for a reply.
+func (t *ServerTest) requestTunnel(conn net.Conn, proto addr.Proto, dstHost *addr.Addr) {
+	if proto == addr.ProtoHTTP {
+		req := httptest.NewRequest(http.MethodConnect, dstHost.String(), nil)
+		t.Require().NoError(req.WriteProxy(conn))
+		return
+	}
+
+	greet := socks.Greeting{
+		Version: socks.V5,
+		Auth:    []socks.Auth{socks.AuthNone},
+	}
+	t.Require().NoError(greet.Write(conn))
+
+	req := socks.Request{
+		Version: socks.V5,
+		Command: socks.CommandConnect,
+		DstAddr: *dstHost,
+	}
+	t.Require().NoError(req.Write(conn))
+}
+
+// awaitTunnel reads the reply to a tunnel request, which must have succeeded.
+func (t *ServerTest) awaitTunnel(conn net.Conn, proto addr.Proto) {
+	// Read byte by byte, so that no tunnel data is consumed along with the reply
+	r := bufio.NewReaderSize(oneByteReader{conn}, 16)
+	if proto == addr.ProtoHTTP {
+		resp, err := http.ReadResponse(r, nil)
+		t.Require().NoError(err)
+		t.Require().Equal(http.StatusOK, resp.StatusCode)
+		return
+	}
+
+	_, err := socks.ReadGreetingReply(r)
+	t.Require().NoError(err)
+
+	reply, err := socks.ReadReply(r)
+	t.Require().NoError(err)
+	t.Require().Equal(socks.StatusGranted, reply.Status)
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r oneByteReader) Read(p []byte) (int, error) {
+	return r.r.Read(p[:min(len(p), 1)])
+}
+
+func (t *ServerTest) TestListenAndServe() {
+	t.Run("serves on all of the specified addresses", func() {
+		serverURLs := []addr.URL{
+			*addr.NewURL(addr.ProtoHTTP, "127.0.0.1", t.freePort()),
+			*addr.NewURL(addr.ProtoSOCKS5, "127.0.0.1", t.freePort()),
+		}
+
+		serveErr := make(chan error)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			serveErr <- server.New().ListenAndServe(ctx, serverURLs...)
+		}()
+
+		for _, u := range serverURLs {
+			t.Eventually(func() bool {
+				conn, err := net.Dial("tcp", u.Addr().String())
+				if err != nil {
+					return false
+				}
+				conn.Close()
+				return true
+			}, time.Second, 10*time.Millisecond)
+		}
+
+		cancel()
+		t.Require().NoError(<-serveErr)
+	})
+
+	t.Run("releases all addresses if any of them is unavailable", func() {
+		busy, err := net.Listen("tcp", "127.0.0.1:0")
+		t.Require().NoError(err)
+		defer busy.Close()
+
+		freeURL := addr.NewURL(addr.ProtoHTTP, "127.0.0.1", t.freePort())
+		busyURL := addr.NewURL(addr.ProtoSOCKS5, "127.0.0.1", uint16(busy.Addr().(*net.TCPAddr).Port))
+
+		err = server.New().ListenAndServe(context.Background(), *freeURL, *busyURL)
+		t.Require().Error(err)
+
+		l, err := net.Listen("tcp", freeURL.Addr().String())
+		t.Require().NoError(err)
+		l.Close()
+	})
+}
+
+func (t *ServerTest) freePort() uint16 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Require().NoError(err)
+	defer l.Close()
+
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+// expectTunnel makes a server expect a single tunnel to be opened to the destination.
+func (t *ServerTest) expectTunnel(dstHost *addr.Addr) server.Option {
+	dstConn := NewDummyConn()
+
+	dial := mocks.NewDialer(t.T())
+	dial.EXPECT().
+		Dial(mock.Anything, dstHost).
+		Return(dstConn, nil)
+
+	tun := mocks.NewTunneler(t.T())
+	tun.EXPECT().
+		Tunnel(mock.Anything, mock.Anything, dstConn).
+		Return(proxy.TunnelStats{}, nil)
+
+	return withMocks(tun, dial)
+}
+
+// startServer starts a server for the protocol, and returns a function to connect to it.
+//
+// The server is shut down once the test is over, unless it is stopped earlier with the returned function, which yields the result of serving.
+// Either way, the connections made to the server are closed at the end of the test.
+func (t *ServerTest) startServer(proto addr.Proto, ops ...server.Option) (dial func() net.Conn, stop func() <-chan error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	t.Require().NoError(err)
+
+	serveErr := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		serveErr <- server.New(ops...).Serve(ctx, proto, l)
+	}()
+
+	var (
+		conns   []net.Conn
+		stopped bool
+	)
+	t.T().Cleanup(func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		if !stopped {
+			cancel()
+			t.NoError(<-serveErr)
+		}
+	})
+
+	dial = func() net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		t.Require().NoError(err)
+		conns = append(conns, conn)
+		return conn
+	}
+	stop = func() <-chan error {
+		stopped = true
+		cancel()
+		return serveErr
+	}
+	return dial, stop
+}
+
+// withMocks makes a server use the tunneler and dialer.
+func withMocks(tun proxy.Tunneler, dial proxy.Dialer) server.Option {
+	return func(s *server.Server) {
+		server.WithTunneler(tun)(s)
+		server.WithDialer(dial)(s)
+	}
+}
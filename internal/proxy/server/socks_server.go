@@ -7,31 +7,62 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"sync"
+	"slices"
+	"time"
 
 	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/auth"
 	"github.com/cerfical/socks2http/internal/proxy/socks"
 )
 
+// defaultBindTimeout limits the time to wait for the peer of a BIND request to connect, if not configured otherwise.
+const defaultBindTimeout = 2 * time.Minute
+
 type SOCKSServer struct {
 	Version socks.Version
 
-	Dialer   proxy.Dialer
-	Tunneler proxy.Tunneler
+	Dialer       proxy.Dialer
+	PacketDialer proxy.PacketDialer
+	Tunneler     proxy.Tunneler
+
+	// Registry, if set, keeps track of the tunnels opened by the server.
+	Registry *Registry
+
+	// Limiter, if set, rejects connections over its limits.
+	Limiter *Limiter
+
+	// Throttler, if set, limits the bandwidth of the tunnels opened by the server.
+	Throttler *Throttler
+
+	// Auth, if set, requires clients to authenticate with a username and a password.
+	Auth *auth.Store
+
+	// HandshakeTimeout, if set, limits the time clients can take to send a request.
+	HandshakeTimeout time.Duration
+
+	// DrainTimeout, if set, limits the time to wait for active connections to close on shutdown.
+	DrainTimeout time.Duration
+
+	// BindTimeout limits the time to wait for the peer of a BIND request to connect, defaulting to [defaultBindTimeout].
+	BindTimeout time.Duration
 
 	Log proxy.Logger
+
+	// Metrics, if set, collects statistics about served clients.
+	Metrics proxy.Metrics
 }
 
 func (s *SOCKSServer) ServeSOCKS(ctx context.Context, l net.Listener) error {
-	var activeConns sync.WaitGroup
+	l = s.Limiter.listen(l)
+
+	tunnels := newTunnelGroup()
+	acceptDone := make(chan struct{})
 	go func() {
+		defer close(acceptDone)
 		for {
-			activeConns.Add(1)
-
 			clientConn, err := l.Accept()
 			if err != nil {
-				activeConns.Done()
-
 				if errors.Is(err, net.ErrClosed) {
 					break
 				}
@@ -39,13 +70,16 @@ func (s *SOCKSServer) ServeSOCKS(ctx context.Context, l net.Listener) error {
 				continue
 			}
 
+			s.metrics().ConnAccepted(l.Addr().String(), socksProto(s.Version))
+
+			tunnels.add(clientConn)
 			go func() {
 				defer func() {
 					clientConn.Close()
-					activeConns.Done()
+					tunnels.done(clientConn)
 				}()
 
-				s.serve(context.Background(), clientConn)
+				s.serve(tunnels.ctx, clientConn)
 			}()
 		}
 	}()
@@ -53,7 +87,10 @@ func (s *SOCKSServer) ServeSOCKS(ctx context.Context, l net.Listener) error {
 	// Wait for server shutdown
 	<-ctx.Done()
 	err := l.Close()
-	activeConns.Wait()
+	<-acceptDone
+
+	drained, forced := tunnels.drain(drainDeadline(s.DrainTimeout))
+	s.Log.Info("Tunnels closed", "drained", drained, "forced", forced)
 
 	if err != nil {
 		return fmt.Errorf("close listener: %w", err)
@@ -62,66 +99,263 @@ func (s *SOCKSServer) ServeSOCKS(ctx context.Context, l net.Listener) error {
 }
 
 func (s *SOCKSServer) serve(ctx context.Context, clientConn net.Conn) {
+	ctx = withRequestID(ctx)
+
+	if s.HandshakeTimeout > 0 {
+		clientConn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+
+	// Rejected clients still get to make a request, so that they can be sent an error reply
+	limitErr := limitErrorOf(clientConn)
+
 	bufr := bufio.NewReader(clientConn)
 	if s.Version == socks.V5 || s.Version == 0 {
-		s.auth(clientConn, bufr)
+		user, ok := s.auth(clientConn, bufr, limitErr)
+		if !ok {
+			return
+		}
+		ctx = withUser(ctx, user)
 	}
 
 	req, err := socks.ReadRequest(bufr)
 	if err != nil {
+		s.metrics().HandshakeFailed(socksProto(s.Version), handshakeFailure(err))
 		s.serverError(fmt.Errorf("read request: %w", err))
 		return
 	}
+	clientConn.SetDeadline(time.Time{})
+
+	if limitErr != nil {
+		s.metrics().HandshakeFailed(socksProto(req.Version), failureLimit)
+		s.reply(ctx, clientConn, req, socks.StatusGeneralFailure, limitErr)
+		return
+	}
+
+	// SOCKS4 has no means to authenticate clients
+	if req.Version == socks.V4 && s.Auth != nil {
+		s.metrics().HandshakeFailed(addr.ProtoSOCKS4, failureAuth)
+		s.reply(ctx, clientConn, req, socks.StatusConnectionNotAllowed, errors.New("authentication required"))
+		return
+	}
 
 	switch req.Command {
 	case socks.CommandConnect:
 		dstConn, err := s.Dialer.Dial(ctx, &req.DstAddr)
 		if err != nil {
-			s.reply(clientConn, req, socks.StatusHostUnreachable, fmt.Errorf("dial destination: %w", err))
+			s.reply(ctx, clientConn, req, dialErrorStatus(err, socks.StatusHostUnreachable), fmt.Errorf("dial destination: %w", err))
 			return
 		}
 		defer dstConn.Close()
 
-		if !s.reply(clientConn, req, socks.StatusGranted, nil) {
+		if !s.reply(ctx, clientConn, req, socks.StatusGranted, nil) {
 			return
 		}
 
-		if err := s.Tunneler.Tunnel(ctx, clientConn, dstConn); err != nil {
-			s.serverError(fmt.Errorf("proxy tunnel: %w", err))
+		s.runTunnel(ctx, &tunnel{
+			proto:      socksProto(req.Version),
+			dstAddr:    &req.DstAddr,
+			clientAddr: clientConn.RemoteAddr().String(),
+			clientConn: clientConn,
+			dstConn:    dstConn,
+		})
+	case socks.CommandBind:
+		s.bind(ctx, clientConn, req)
+	case socks.CommandAssociate:
+		if req.Version != socks.V5 {
+			s.metrics().HandshakeFailed(socksProto(req.Version), failureUnsupported)
+			s.reply(ctx, clientConn, req, socks.StatusCommandNotSupported, nil)
 			return
 		}
+		s.associate(ctx, clientConn, req)
 	default:
-		s.reply(clientConn, req, socks.StatusCommandNotSupported, nil)
+		s.metrics().HandshakeFailed(socksProto(req.Version), failureUnsupported)
+		s.reply(ctx, clientConn, req, socks.StatusCommandNotSupported, nil)
 		return
 	}
 }
 
-func (s *SOCKSServer) auth(clientConn net.Conn, clientRead *bufio.Reader) {
+// auth negotiates the authentication with a client, returning the authenticated user, if any.
+//
+// Clients rejected with the limit error are refused authentication without verifying their credentials.
+func (s *SOCKSServer) auth(clientConn net.Conn, clientRead *bufio.Reader, limitErr error) (string, bool) {
 	greet, err := socks.ReadGreeting(clientRead)
 	if err != nil {
 		if errors.Is(err, socks.ErrInvalidVersion) {
-			return
+			// Let the request handling decide what to do with a non-SOCKS5 client
+			return "", true
 		}
+		s.metrics().HandshakeFailed(socksProto(s.Version), handshakeFailure(err))
 		s.serverError(fmt.Errorf("read greeting: %w", err))
-		return
+		return "", false
+	}
+
+	wantAuth := socks.AuthNone
+	if s.Auth != nil {
+		wantAuth = socks.AuthPassword
 	}
 
 	greetReply := socks.GreetingReply{
 		Version: greet.Version,
-		Auth:    selectSOCKSAuth(greet.Auth),
+		Auth:    selectSOCKSAuth(greet.Auth, wantAuth),
 	}
 	if err := greetReply.Write(clientConn); err != nil {
 		s.serverError(fmt.Errorf("write greeting reply: %w", err))
+		return "", false
+	}
+
+	switch greetReply.Auth {
+	case socks.AuthNone:
+		return "", true
+	case socks.AuthPassword:
+		return s.passwordAuth(clientConn, clientRead, limitErr)
+	default:
+		// The client is expected to close the connection
+		s.metrics().HandshakeFailed(addr.ProtoSOCKS5, failureUnsupported)
+		s.serverError(fmt.Errorf("no acceptable auth method among %v", greet.Auth))
+		return "", false
+	}
+}
+
+func (s *SOCKSServer) passwordAuth(clientConn net.Conn, clientRead *bufio.Reader, limitErr error) (string, bool) {
+	creds, err := socks.ReadPasswordAuth(clientRead)
+	if err != nil {
+		s.metrics().HandshakeFailed(addr.ProtoSOCKS5, handshakeFailure(err))
+		s.serverError(fmt.Errorf("read auth request: %w", err))
+		return "", false
+	}
+
+	authReply := socks.PasswordAuthReply{
+		Success: limitErr == nil && s.Auth.Verify(creds.Username, creds.Password),
+	}
+	if err := authReply.Write(clientConn); err != nil {
+		s.serverError(fmt.Errorf("write auth reply: %w", err))
+		return "", false
+	}
+
+	if limitErr != nil {
+		s.metrics().HandshakeFailed(addr.ProtoSOCKS5, failureLimit)
+		s.Log.Error("SOCKS client rejected",
+			"client", clientConn.RemoteAddr().String(),
+			"error", limitErr,
+		)
+		return "", false
+	}
+
+	if !authReply.Success {
+		s.metrics().HandshakeFailed(addr.ProtoSOCKS5, failureAuth)
+		s.Log.Error("SOCKS authentication failed",
+			"user", creds.Username,
+			"client", clientConn.RemoteAddr().String(),
+		)
+		return "", false
+	}
+	return creds.Username, true
+}
+
+func (s *SOCKSServer) bind(ctx context.Context, clientConn net.Conn, req *socks.Request) {
+	// Connections from a peer are subject to the same policy as connections to it
+	if err := proxy.CheckDestination(s.Dialer, &req.DstAddr); err != nil {
+		s.reply(ctx, clientConn, req, dialErrorStatus(err, socks.StatusConnectionNotAllowed), fmt.Errorf("check peer: %w", err))
+		return
+	}
+
+	// Accept the connection on the interface the client has used to reach the server
+	localHost, _, err := net.SplitHostPort(clientConn.LocalAddr().String())
+	if err != nil {
+		s.reply(ctx, clientConn, req, socks.StatusGeneralFailure, fmt.Errorf("parse local address: %w", err))
+		return
+	}
+
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "tcp", net.JoinHostPort(localHost, "0"))
+	if err != nil {
+		s.reply(ctx, clientConn, req, socks.StatusGeneralFailure, fmt.Errorf("listen for peer: %w", err))
+		return
+	}
+	defer l.Close()
+
+	if !s.replyBind(ctx, clientConn, req, socks.StatusGranted, tcpAddrOf(l.Addr()), nil) {
+		return
+	}
+
+	peerConn, controlConn, err := acceptPeer(ctx, l, clientConn, s.bindTimeout())
+	if err != nil {
+		s.reply(ctx, clientConn, req, socks.StatusGeneralFailure, fmt.Errorf("accept peer: %w", err))
+		return
+	}
+	clientConn = controlConn
+	defer peerConn.Close()
+
+	peerAddr := tcpAddrOf(peerConn.RemoteAddr())
+	if err := checkBindPeer(ctx, &req.DstAddr, peerAddr); err != nil {
+		s.replyBind(ctx, clientConn, req, socks.StatusConnectionNotAllowed, peerAddr, err)
+		return
+	}
+	if err := proxy.CheckDestination(s.Dialer, peerAddr); err != nil {
+		s.replyBind(ctx, clientConn, req, socks.StatusConnectionNotAllowed, peerAddr, err)
+		return
+	}
+
+	if !s.replyBind(ctx, clientConn, req, socks.StatusGranted, peerAddr, nil) {
 		return
 	}
+
+	s.runTunnel(ctx, &tunnel{
+		proto:      socksProto(req.Version),
+		dstAddr:    peerAddr,
+		clientAddr: clientConn.RemoteAddr().String(),
+		clientConn: clientConn,
+		dstConn:    peerConn,
+	})
 }
 
-func (s *SOCKSServer) reply(clientConn net.Conn, r *socks.Request, status socks.Status, err error) bool {
+func (s *SOCKSServer) associate(ctx context.Context, clientConn net.Conn, req *socks.Request) {
+	dstConn, err := s.PacketDialer.DialPacket(ctx)
+	if err != nil {
+		s.reply(ctx, clientConn, req, dialErrorStatus(err, socks.StatusGeneralFailure), fmt.Errorf("open packet connection: %w", err))
+		return
+	}
+
+	relay, err := newUDPRelay(clientConn, &req.DstAddr, dstConn)
+	if err != nil {
+		s.reply(ctx, clientConn, req, socks.StatusGeneralFailure, fmt.Errorf("open UDP relay: %w", err))
+		return
+	}
+	defer relay.Close()
+
+	if !s.replyBind(ctx, clientConn, req, socks.StatusGranted, relay.Addr(), nil) {
+		return
+	}
+
+	// The association terminates when the control connection is closed
+	ctx, cancel := context.WithCancel(ctx)
+	controlDone := make(chan struct{})
+	go func() {
+		defer close(controlDone)
+		_, _ = io.Copy(io.Discard, clientConn)
+		cancel()
+	}()
+
+	if err := relay.Serve(ctx); err != nil {
+		s.serverError(fmt.Errorf("relay datagrams: %w", err))
+	}
+
+	// Stop watching the control connection
+	clientConn.SetReadDeadline(time.Now())
+	<-controlDone
+}
+
+func (s *SOCKSServer) reply(ctx context.Context, clientConn net.Conn, r *socks.Request, status socks.Status, err error) bool {
+	return s.replyBind(ctx, clientConn, r, status, &addr.Addr{}, err)
+}
+
+func (s *SOCKSServer) replyBind(ctx context.Context, clientConn net.Conn, r *socks.Request, status socks.Status, bindAddr *addr.Addr, err error) bool {
 	msg := fmt.Sprintf("%v %v", r.Command, &r.DstAddr)
 	fields := []any{
 		"status", status,
 		"proto", r.Version,
 		"client", clientConn.RemoteAddr().String(),
+		"request_id", requestIDOf(ctx),
 	}
 
 	if err != nil {
@@ -132,9 +366,12 @@ func (s *SOCKSServer) reply(clientConn net.Conn, r *socks.Request, status socks.
 		s.Log.Info(msg, fields...)
 	}
 
+	s.metrics().RequestServed(socksProto(r.Version), status.String())
+
 	reply := socks.Reply{
-		Version: r.Version,
-		Status:  status,
+		Version:  r.Version,
+		Status:   status,
+		BindAddr: *bindAddr,
 	}
 	if err := reply.Write(clientConn); err != nil {
 		s.serverError(fmt.Errorf("write reply: %w", err))
@@ -143,6 +380,24 @@ func (s *SOCKSServer) reply(clientConn net.Conn, r *socks.Request, status socks.
 	return true
 }
 
+func (s *SOCKSServer) runTunnel(ctx context.Context, t *tunnel) {
+	t.run(ctx, s.Tunneler, s.Registry, s.Throttler, s.metrics(), s.Log)
+}
+
+func (s *SOCKSServer) bindTimeout() time.Duration {
+	if s.BindTimeout <= 0 {
+		return defaultBindTimeout
+	}
+	return s.BindTimeout
+}
+
+func (s *SOCKSServer) metrics() proxy.Metrics {
+	if s.Metrics == nil {
+		return proxy.DiscardMetrics
+	}
+	return s.Metrics
+}
+
 func (s *SOCKSServer) serverError(err error) {
 	// Ignore errors caused by client closing the connection
 	if errors.Is(err, io.EOF) {
@@ -151,11 +406,117 @@ func (s *SOCKSServer) serverError(err error) {
 	s.Log.Error("SOCKS failure", "error", err)
 }
 
-func selectSOCKSAuth(auth []socks.Auth) socks.Auth {
-	for _, a := range auth {
-		if a == socks.AuthNone {
-			return a
+// acceptPeer waits for an incoming connection, giving up if the client closes the control connection or the timeout expires.
+//
+// Any data sent by the client meanwhile is kept in the returned control connection.
+func acceptPeer(ctx context.Context, l net.Listener, controlConn net.Conn, timeout time.Duration) (peerConn, clientConn net.Conn, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	controlRead := bufio.NewReader(controlConn)
+	controlDone := make(chan struct{})
+	go func() {
+		defer close(controlDone)
+
+		// The client is not supposed to send anything before the peer connects, so only a failure ends the wait
+		if _, err := controlRead.Peek(1); err != nil {
+			cancel()
+		}
+	}()
+
+	acceptDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-acceptDone:
+		}
+	}()
+
+	peerConn, err = l.Accept()
+	close(acceptDone)
+
+	// Stop watching the control connection
+	controlConn.SetReadDeadline(time.Now())
+	<-controlDone
+	controlConn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = ctx.Err()
+		}
+		return nil, nil, err
+	}
+
+	clientConn = controlConn
+	if controlRead.Buffered() != 0 {
+		clientConn = proxy.WithBufferedReader(controlConn, controlRead)
+	}
+	return peerConn, clientConn, nil
+}
+
+// checkBindPeer verifies that the peer connection comes from the host specified in the BIND request.
+func checkBindPeer(ctx context.Context, want *addr.Addr, peer *addr.Addr) error {
+	if want.Host == "" {
+		return nil
+	}
+
+	wantIPs := []net.IP{net.ParseIP(want.Host)}
+	if wantIPs[0] == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, want.Host)
+		if err != nil {
+			return fmt.Errorf("resolve expected peer: %w", err)
 		}
+
+		wantIPs = wantIPs[:0]
+		for _, a := range addrs {
+			wantIPs = append(wantIPs, a.IP)
+		}
+	} else if wantIPs[0].IsUnspecified() {
+		return nil
+	}
+
+	peerIP := net.ParseIP(peer.Host)
+	for _, ip := range wantIPs {
+		if ip.Equal(peerIP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected peer %v", peer)
+}
+
+// dialErrorStatus selects the reply status for a failure to connect to the destination.
+func dialErrorStatus(err error, fallback socks.Status) socks.Status {
+	switch {
+	case errors.Is(err, proxy.ErrRejected):
+		return socks.StatusConnectionNotAllowed
+	case isTimeout(err):
+		return socks.StatusTTLExpired
+	default:
+		return fallback
+	}
+}
+
+func tcpAddrOf(a net.Addr) *addr.Addr {
+	tcpAddr := a.(*net.TCPAddr).AddrPort()
+	return addr.NewAddr(tcpAddr.Addr().Unmap().String(), tcpAddr.Port())
+}
+
+func selectSOCKSAuth(offered []socks.Auth, want socks.Auth) socks.Auth {
+	if slices.Contains(offered, want) {
+		return want
 	}
 	return socks.AuthNotAcceptable
 }
+
+// socksProto tells the protocol of a SOCKS version, with zero meaning any version.
+func socksProto(v socks.Version) addr.Proto {
+	switch v {
+	case socks.V4:
+		return addr.ProtoSOCKS4
+	case socks.V5:
+		return addr.ProtoSOCKS5
+	default:
+		return addr.ProtoSOCKS
+	}
+}
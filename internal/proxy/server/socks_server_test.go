@@ -2,15 +2,22 @@ package server_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/cerfical/socks2http/internal/proxy"
 	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/auth"
 	"github.com/cerfical/socks2http/internal/proxy/mocks"
+	"github.com/cerfical/socks2http/internal/proxy/router"
 	"github.com/cerfical/socks2http/internal/proxy/server"
 	"github.com/cerfical/socks2http/internal/proxy/socks"
 	"github.com/stretchr/testify/mock"
@@ -59,7 +66,7 @@ func (t *SOCKSServerTest) TestServeSOCKS_V4() {
 		tun := mocks.NewTunneler(t.T())
 		tun.EXPECT().
 			Tunnel(mock.Anything, mock.Anything, dstConn).
-			Return(nil)
+			Return(proxy.TunnelStats{}, nil)
 
 		proxyConn := t.openProxyConn(tun, dial)
 
@@ -113,7 +120,7 @@ func (t *SOCKSServerTest) TestServeSOCKS_V5() {
 		tun := mocks.NewTunneler(t.T())
 		tun.EXPECT().
 			Tunnel(mock.Anything, mock.Anything, dstConn).
-			Return(nil)
+			Return(proxy.TunnelStats{}, nil)
 
 		proxyConn := t.openProxyConn(tun, dial)
 		t.socks5Authenticate(proxyConn)
@@ -131,7 +138,7 @@ func (t *SOCKSServerTest) TestServeSOCKS_V5() {
 		t.Equal(socks.StatusGranted, reply.Status)
 	})
 
-	t.Run("replies to non-CONNECT requests with Command-Not-Supported", func() {
+	t.Run("replies to unknown commands with Command-Not-Supported", func() {
 		dstHost := addr.NewAddr("localhost", 1111)
 
 		proxyConn := t.openProxyConn(nil, nil)
@@ -139,7 +146,7 @@ func (t *SOCKSServerTest) TestServeSOCKS_V5() {
 
 		req := socks.Request{
 			Version: socks.V5,
-			Command: socks.CommandBind,
+			Command: 0x17,
 			DstAddr: *dstHost,
 		}
 		t.Require().NoError(req.Write(proxyConn))
@@ -190,13 +197,381 @@ func (t *SOCKSServerTest) TestServeSOCKS_V5() {
 	})
 }
 
-func (t *SOCKSServerTest) openProxyConn(tun proxy.Tunneler, dial proxy.Dialer) net.Conn {
-	server := server.SOCKSServer{
-		Tunneler: tun,
-		Dialer:   dial,
-		Log:      proxy.DiscardLogger,
+func (t *SOCKSServerTest) TestServeSOCKS_Rejected() {
+	t.Run("replies to CONNECT with Connection-Not-Allowed if destination is rejected by policy", func() {
+		dstHost := addr.NewAddr("localhost", 1111)
+
+		dial := mocks.NewDialer(t.T())
+		dial.EXPECT().
+			Dial(mock.Anything, dstHost).
+			Return(nil, proxy.ErrRejected)
+
+		proxyConn := t.openProxyConn(nil, dial)
+		t.socks5Authenticate(proxyConn)
+
+		req := socks.Request{
+			Version: socks.V5,
+			Command: socks.CommandConnect,
+			DstAddr: *dstHost,
+		}
+		t.Require().NoError(req.Write(proxyConn))
+
+		reply, err := socks.ReadReply(bufio.NewReader(proxyConn))
+		t.Require().NoError(err)
+
+		t.Equal(socks.StatusConnectionNotAllowed, reply.Status)
+	})
+}
+
+func (t *SOCKSServerTest) TestServeSOCKS_Timeouts() {
+	t.Run("replies to CONNECT with TTL-Expired if destination takes too long to connect", func() {
+		dstHost := addr.NewAddr("localhost", 1111)
+
+		dial := mocks.NewDialer(t.T())
+		dial.EXPECT().
+			Dial(mock.Anything, dstHost).
+			Return(nil, fmt.Errorf("dial: %w", context.DeadlineExceeded))
+
+		proxyConn := t.openProxyConn(nil, dial)
+		t.socks5Authenticate(proxyConn)
+
+		req := socks.Request{
+			Version: socks.V5,
+			Command: socks.CommandConnect,
+			DstAddr: *dstHost,
+		}
+		t.Require().NoError(req.Write(proxyConn))
+
+		reply, err := socks.ReadReply(bufio.NewReader(proxyConn))
+		t.Require().NoError(err)
+
+		t.Equal(socks.StatusTTLExpired, reply.Status)
+	})
+
+	t.Run("closes connections of clients that do not send a request in time", func() {
+		proxyConn := t.openServerConn(&server.SOCKSServer{
+			Log:              proxy.DiscardLogger,
+			HandshakeTimeout: 50 * time.Millisecond,
+		})
+
+		proxyConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := proxyConn.Read(make([]byte, 1))
+		t.ErrorIs(err, io.EOF)
+	})
+}
+
+func (t *SOCKSServerTest) TestServeSOCKS_Bind() {
+	versions := map[string]socks.Version{
+		"SOCKS4": socks.V4,
+		"SOCKS5": socks.V5,
 	}
 
+	for name, version := range versions {
+		t.Run(name+" BIND tunnels the incoming connection to client", func() {
+			tun := mocks.NewTunneler(t.T())
+			tun.EXPECT().
+				Tunnel(mock.Anything, mock.Anything, mock.Anything).
+				Return(proxy.TunnelStats{}, nil)
+
+			proxyConn := t.openProxyConn(tun, nil)
+			proxyRead := bufio.NewReader(proxyConn)
+			if version == socks.V5 {
+				t.socks5Authenticate(proxyConn)
+			}
+
+			bindAddr := t.bind(proxyConn, proxyRead, version, addr.NewAddr("127.0.0.1", 0))
+			t.NotZero(bindAddr.Port)
+
+			peerConn, err := net.Dial("tcp", bindAddr.String())
+			t.Require().NoError(err)
+			defer peerConn.Close()
+
+			reply, err := socks.ReadReply(proxyRead)
+			t.Require().NoError(err)
+
+			t.Equal(socks.StatusGranted, reply.Status)
+			t.Equal(peerConn.LocalAddr().String(), reply.BindAddr.String())
+		})
+
+		t.Run(name+" BIND rejects connections from unexpected peers", func() {
+			proxyConn := t.openProxyConn(nil, nil)
+			proxyRead := bufio.NewReader(proxyConn)
+			if version == socks.V5 {
+				t.socks5Authenticate(proxyConn)
+			}
+
+			bindAddr := t.bind(proxyConn, proxyRead, version, addr.NewAddr("10.0.0.1", 0))
+
+			peerConn, err := net.Dial("tcp", bindAddr.String())
+			t.Require().NoError(err)
+			defer peerConn.Close()
+
+			reply, err := socks.ReadReply(proxyRead)
+			t.Require().NoError(err)
+
+			t.NotEqual(socks.StatusGranted, reply.Status)
+		})
+
+		t.Run(name+" BIND keeps data sent by client before the peer connects", func() {
+			proxyConn := t.openProxyConn(proxy.DefaultTunneler, nil)
+			proxyRead := bufio.NewReader(proxyConn)
+			if version == socks.V5 {
+				t.socks5Authenticate(proxyConn)
+			}
+
+			bindAddr := t.bind(proxyConn, proxyRead, version, addr.NewAddr("127.0.0.1", 0))
+			_, err := proxyConn.Write([]byte("abcd"))
+			t.Require().NoError(err)
+
+			peerConn, err := net.Dial("tcp", bindAddr.String())
+			t.Require().NoError(err)
+			defer peerConn.Close()
+
+			reply, err := socks.ReadReply(proxyRead)
+			t.Require().NoError(err)
+			t.Require().Equal(socks.StatusGranted, reply.Status)
+
+			got := make([]byte, 4)
+			peerConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err = io.ReadFull(peerConn, got)
+			t.Require().NoError(err)
+			t.Equal("abcd", string(got))
+		})
+
+		t.Run(name+" BIND gives up if the peer does not connect in time", func() {
+			proxyConn := t.openServerConn(&server.SOCKSServer{
+				Dialer:      proxy.DirectDialer,
+				Log:         proxy.DiscardLogger,
+				BindTimeout: 50 * time.Millisecond,
+			})
+			proxyRead := bufio.NewReader(proxyConn)
+			if version == socks.V5 {
+				t.socks5Authenticate(proxyConn)
+			}
+
+			t.bind(proxyConn, proxyRead, version, addr.NewAddr("127.0.0.1", 0))
+
+			proxyConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			reply, err := socks.ReadReply(proxyRead)
+			t.Require().NoError(err)
+			t.Equal(socks.StatusGeneralFailure, reply.Status)
+		})
+
+		// SOCKS4 has no status more specific than a general failure
+		notAllowed := socks.StatusConnectionNotAllowed
+		if version == socks.V4 {
+			notAllowed = socks.StatusGeneralFailure
+		}
+
+		t.Run(name+" BIND refuses peers rejected by the routes", func() {
+			proxyConn := t.openProxyConn(nil, t.rejectingRouter("10.0.0.1"))
+			proxyRead := bufio.NewReader(proxyConn)
+			if version == socks.V5 {
+				t.socks5Authenticate(proxyConn)
+			}
+
+			req := socks.Request{
+				Version: version,
+				Command: socks.CommandBind,
+				DstAddr: *addr.NewAddr("10.0.0.1", 0),
+			}
+			t.Require().NoError(req.Write(proxyConn))
+
+			reply, err := socks.ReadReply(proxyRead)
+			t.Require().NoError(err)
+			t.Equal(notAllowed, reply.Status)
+		})
+
+		t.Run(name+" BIND refuses connections from peers rejected by the routes", func() {
+			proxyConn := t.openProxyConn(nil, t.rejectingRouter("127.0.0.1"))
+			proxyRead := bufio.NewReader(proxyConn)
+			if version == socks.V5 {
+				t.socks5Authenticate(proxyConn)
+			}
+
+			// Any peer is expected, so only the routes decide
+			bindAddr := t.bind(proxyConn, proxyRead, version, addr.NewAddr("0.0.0.0", 0))
+
+			peerConn, err := net.Dial("tcp", bindAddr.String())
+			t.Require().NoError(err)
+			defer peerConn.Close()
+
+			reply, err := socks.ReadReply(proxyRead)
+			t.Require().NoError(err)
+			t.Equal(notAllowed, reply.Status)
+		})
+	}
+}
+
+func (t *SOCKSServerTest) TestServeSOCKS_V5Associate() {
+	t.Run("UDP ASSOCIATE relays datagrams to destination and back", func() {
+		echoAddr := t.startUDPEcho()
+
+		proxyConn := t.openProxyConn(nil, nil)
+		t.socks5Authenticate(proxyConn)
+
+		relayAddr := t.socks5Associate(proxyConn, addr.NewAddr("0.0.0.0", 0))
+		clientConn := t.listenUDP()
+
+		t.sendDatagram(clientConn, relayAddr, echoAddr, "abcd")
+		got := t.receiveDatagram(clientConn)
+
+		t.Require().NotNil(got)
+		t.Equal(echoAddr, &got.DstAddr)
+		t.Equal("abcd", string(got.Data))
+	})
+
+	t.Run("UDP ASSOCIATE drops datagrams from unexpected sources", func() {
+		echoAddr := t.startUDPEcho()
+
+		proxyConn := t.openProxyConn(nil, nil)
+		t.socks5Authenticate(proxyConn)
+
+		clientConn := t.listenUDP()
+		clientPort := uint16(clientConn.LocalAddr().(*net.UDPAddr).Port)
+		relayAddr := t.socks5Associate(proxyConn, addr.NewAddr("127.0.0.1", clientPort))
+
+		otherConn := t.listenUDP()
+		t.sendDatagram(otherConn, relayAddr, echoAddr, "abcd")
+
+		t.Nil(t.receiveDatagram(otherConn))
+	})
+
+	t.Run("UDP ASSOCIATE drops datagrams to destinations rejected by the routes", func() {
+		rejectedAddr := t.startUDPEcho()
+		allowedAddr := t.startUDPEcho()
+
+		r := t.rejectingRouter(rejectedAddr.String())
+		proxyConn := t.openServerConn(&server.SOCKSServer{
+			Dialer:       r,
+			PacketDialer: r,
+			Log:          proxy.DiscardLogger,
+		})
+		t.socks5Authenticate(proxyConn)
+
+		relayAddr := t.socks5Associate(proxyConn, addr.NewAddr("0.0.0.0", 0))
+		clientConn := t.listenUDP()
+
+		t.sendDatagram(clientConn, relayAddr, rejectedAddr, "abcd")
+		t.Nil(t.receiveDatagram(clientConn))
+
+		t.sendDatagram(clientConn, relayAddr, allowedAddr, "abcd")
+		got := t.receiveDatagram(clientConn)
+		t.Require().NotNil(got)
+		t.Equal(allowedAddr, &got.DstAddr)
+	})
+
+	t.Run("UDP ASSOCIATE terminates when control connection is closed", func() {
+		proxyConn := t.openProxyConn(nil, nil)
+		t.socks5Authenticate(proxyConn)
+
+		relayAddr := t.socks5Associate(proxyConn, addr.NewAddr("0.0.0.0", 0))
+		proxyConn.Close()
+
+		// Once the relay is closed, the host reports its port as unreachable
+		conn, err := net.Dial("udp", relayAddr.String())
+		t.Require().NoError(err)
+		defer conn.Close()
+
+		t.Eventually(func() bool {
+			_, _ = conn.Write([]byte{0})
+			conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			_, err := conn.Read(make([]byte, 1))
+			return errors.Is(err, syscall.ECONNREFUSED)
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func (t *SOCKSServerTest) TestServeSOCKS_Auth() {
+	users := auth.NewStore(auth.Credentials{Username: "root", Password: "secret"})
+
+	t.Run("CONNECT opens a tunnel to destination after successful authentication", func() {
+		dstHost := addr.NewAddr("localhost", 1111)
+		dstConn := NewDummyConn()
+
+		dial := mocks.NewDialer(t.T())
+		dial.EXPECT().
+			Dial(mock.Anything, dstHost).
+			Return(dstConn, nil)
+
+		tun := mocks.NewTunneler(t.T())
+		tun.EXPECT().
+			Tunnel(mock.Anything, mock.Anything, dstConn).
+			Return(proxy.TunnelStats{}, nil)
+
+		proxyConn := t.openAuthProxyConn(tun, dial, users)
+		proxyRead := bufio.NewReader(proxyConn)
+
+		authReply := t.socks5PasswordAuthenticate(proxyConn, proxyRead, "root", "secret")
+		t.Require().True(authReply.Success)
+
+		req := socks.Request{
+			Version: socks.V5,
+			Command: socks.CommandConnect,
+			DstAddr: *dstHost,
+		}
+		t.Require().NoError(req.Write(proxyConn))
+
+		reply, err := socks.ReadReply(proxyRead)
+		t.Require().NoError(err)
+
+		t.Equal(socks.StatusGranted, reply.Status)
+	})
+
+	t.Run("replies to invalid credentials with failure", func() {
+		proxyConn := t.openAuthProxyConn(nil, nil, users)
+
+		authReply := t.socks5PasswordAuthenticate(proxyConn, bufio.NewReader(proxyConn), "root", "wrong")
+		t.False(authReply.Success)
+	})
+
+	t.Run("replies to clients without credentials with Not-Acceptable", func() {
+		proxyConn := t.openAuthProxyConn(nil, nil, users)
+
+		greet := socks.Greeting{
+			Version: socks.V5,
+			Auth:    []socks.Auth{socks.AuthNone},
+		}
+		t.Require().NoError(greet.Write(proxyConn))
+
+		greetReply, err := socks.ReadGreetingReply(bufio.NewReader(proxyConn))
+		t.Require().NoError(err)
+
+		t.Equal(socks.AuthNotAcceptable, greetReply.Auth)
+	})
+
+	t.Run("rejects SOCKS4 requests", func() {
+		proxyConn := t.openAuthProxyConn(nil, nil, users)
+
+		req := socks.Request{
+			Version: socks.V4,
+			Command: socks.CommandConnect,
+			DstAddr: *addr.NewAddr("127.0.0.1", 1111),
+		}
+		t.Require().NoError(req.Write(proxyConn))
+
+		reply, err := socks.ReadReply(bufio.NewReader(proxyConn))
+		t.Require().NoError(err)
+
+		t.NotEqual(socks.StatusGranted, reply.Status)
+	})
+}
+
+func (t *SOCKSServerTest) openProxyConn(tun proxy.Tunneler, dial proxy.Dialer) net.Conn {
+	return t.openAuthProxyConn(tun, dial, nil)
+}
+
+func (t *SOCKSServerTest) openAuthProxyConn(tun proxy.Tunneler, dial proxy.Dialer, users *auth.Store) net.Conn {
+	return t.openServerConn(&server.SOCKSServer{
+		Tunneler:     tun,
+		Dialer:       dial,
+		PacketDialer: proxy.DirectPacketDialer,
+		Auth:         users,
+		Log:          proxy.DiscardLogger,
+	})
+}
+
+func (t *SOCKSServerTest) openServerConn(server *server.SOCKSServer) net.Conn {
 	l, err := net.Listen("tcp", "localhost:0")
 	t.Require().NoError(err)
 
@@ -229,3 +604,127 @@ func (t *SOCKSServerTest) socks5Authenticate(c net.Conn) {
 
 	t.Equal(socks.AuthNone, greetReply.Auth)
 }
+
+func (t *SOCKSServerTest) socks5PasswordAuthenticate(c net.Conn, r *bufio.Reader, username, password string) *socks.PasswordAuthReply {
+	greet := socks.Greeting{
+		Version: socks.V5,
+		Auth:    []socks.Auth{socks.AuthNone, socks.AuthPassword},
+	}
+	t.Require().NoError(greet.Write(c))
+
+	greetReply, err := socks.ReadGreetingReply(r)
+	t.Require().NoError(err)
+	t.Require().Equal(socks.AuthPassword, greetReply.Auth)
+
+	creds := socks.PasswordAuth{
+		Username: username,
+		Password: password,
+	}
+	t.Require().NoError(creds.Write(c))
+
+	authReply, err := socks.ReadPasswordAuthReply(r)
+	t.Require().NoError(err)
+
+	return authReply
+}
+
+func (t *SOCKSServerTest) bind(c net.Conn, r *bufio.Reader, version socks.Version, peerAddr *addr.Addr) *addr.Addr {
+	req := socks.Request{
+		Version: version,
+		Command: socks.CommandBind,
+		DstAddr: *peerAddr,
+	}
+	t.Require().NoError(req.Write(c))
+
+	reply, err := socks.ReadReply(r)
+	t.Require().NoError(err)
+	t.Require().Equal(socks.StatusGranted, reply.Status)
+
+	return &reply.BindAddr
+}
+
+func (t *SOCKSServerTest) socks5Associate(c net.Conn, clientAddr *addr.Addr) *addr.Addr {
+	req := socks.Request{
+		Version: socks.V5,
+		Command: socks.CommandAssociate,
+		DstAddr: *clientAddr,
+	}
+	t.Require().NoError(req.Write(c))
+
+	reply, err := socks.ReadReply(bufio.NewReader(c))
+	t.Require().NoError(err)
+	t.Require().Equal(socks.StatusGranted, reply.Status)
+
+	return &reply.BindAddr
+}
+
+func (t *SOCKSServerTest) startUDPEcho() *addr.Addr {
+	conn := t.listenUDP()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], from)
+		}
+	}()
+
+	a := conn.LocalAddr().(*net.UDPAddr)
+	return addr.NewAddr(a.IP.String(), uint16(a.Port))
+}
+
+// rejectingRouter creates a router rejecting the host pattern, and connecting directly to any other destination.
+func (t *SOCKSServerTest) rejectingRouter(pattern string) *router.Router {
+	r, err := router.New(
+		router.WithRoutes([]router.Route{{
+			Hosts:  []string{pattern},
+			Action: router.ActionReject,
+		}}),
+		router.WithDefaultRoute(&router.Route{
+			Action: router.ActionDirect,
+		}),
+	)
+	t.Require().NoError(err)
+	return r
+}
+
+func (t *SOCKSServerTest) listenUDP() *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	t.Require().NoError(err)
+	t.T().Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func (t *SOCKSServerTest) sendDatagram(c *net.UDPConn, relayAddr, dstAddr *addr.Addr, data string) {
+	relay, err := net.ResolveUDPAddr("udp", relayAddr.String())
+	t.Require().NoError(err)
+
+	var buf bytes.Buffer
+	d := socks.Datagram{
+		DstAddr: *dstAddr,
+		Data:    []byte(data),
+	}
+	t.Require().NoError(d.Write(&buf))
+
+	_, err = c.WriteTo(buf.Bytes(), relay)
+	t.Require().NoError(err)
+}
+
+func (t *SOCKSServerTest) receiveDatagram(c *net.UDPConn) *socks.Datagram {
+	t.Require().NoError(c.SetReadDeadline(time.Now().Add(200 * time.Millisecond)))
+
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	t.Require().NoError(err)
+
+	d, err := socks.ReadDatagram(bufio.NewReader(bytes.NewReader(buf[:n])))
+	t.Require().NoError(err)
+
+	return d
+}
@@ -1,9 +1,14 @@
 package server_test
 
 import (
+	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
 )
 
 // NewDummyConn creates a new [DummyConn].
@@ -78,7 +83,7 @@ func (l *IdleListener) Close() error {
 }
 
 func (l *IdleListener) Addr() net.Addr {
-	return nil
+	return &net.TCPAddr{}
 }
 
 func (l *IdleListener) OpenConns() int {
@@ -95,3 +100,97 @@ func (t *connCloser) Close() error {
 	t.close()
 	return t.Conn.Close()
 }
+
+// LogEntry is a message logged along with its fields.
+type LogEntry struct {
+	Msg    string
+	Fields map[string]any
+}
+
+// RecordingLogger keeps all of the logged entries.
+type RecordingLogger struct {
+	mu      sync.Mutex
+	entries []LogEntry
+}
+
+func (l *RecordingLogger) Error(msg string, fields ...any) {
+	l.record(msg, fields)
+}
+
+func (l *RecordingLogger) Info(msg string, fields ...any) {
+	l.record(msg, fields)
+}
+
+func (l *RecordingLogger) record(msg string, fields []any) {
+	entry := LogEntry{Msg: msg, Fields: make(map[string]any)}
+	for i := 0; i+1 < len(fields); i += 2 {
+		entry.Fields[fields[i].(string)] = fields[i+1]
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+// Entries returns the entries logged so far.
+func (l *RecordingLogger) Entries() []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]LogEntry(nil), l.entries...)
+}
+
+// RecordingMetrics keeps a description of each of the reported events, except for the bytes transferred, which are summed up.
+type RecordingMetrics struct {
+	mu     sync.Mutex
+	events []string
+
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+func (m *RecordingMetrics) ConnAccepted(_ string, proto addr.Proto) {
+	m.record("accepted %v", proto)
+}
+
+func (m *RecordingMetrics) HandshakeFailed(proto addr.Proto, reason string) {
+	m.record("handshake failed %v %v", proto, reason)
+}
+
+func (m *RecordingMetrics) RequestServed(proto addr.Proto, status string) {
+	m.record("served %v %v", proto, status)
+}
+
+func (m *RecordingMetrics) TunnelOpened(proto addr.Proto) {
+	m.record("tunnel opened %v", proto)
+}
+
+func (m *RecordingMetrics) TunnelClosed(proto addr.Proto, stats *proxy.TunnelStats) {
+	m.record("tunnel closed %v %v", proto, stats.CloseReason)
+}
+
+func (m *RecordingMetrics) TunnelTransferred(_ addr.Proto, sent, received int64) {
+	m.sent.Add(sent)
+	m.received.Add(received)
+}
+
+// Transferred returns the bytes sent and received by clients so far.
+func (m *RecordingMetrics) Transferred() (sent, received int64) {
+	return m.sent.Load(), m.received.Load()
+}
+
+func (m *RecordingMetrics) DialDone(route, upstream string, _ time.Duration, _ error) {
+	m.record("dial %v %v", route, upstream)
+}
+
+func (m *RecordingMetrics) record(format string, args ...any) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, fmt.Sprintf(format, args...))
+}
+
+// Events returns the events reported so far.
+func (m *RecordingMetrics) Events() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.events...)
+}
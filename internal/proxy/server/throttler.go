@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+)
+
+// Throttling limits the bandwidth of tunnels, on top of the limits of the routes they were opened through.
+type Throttling struct {
+	// Global is shared by all tunnels.
+	Global proxy.Bandwidth
+
+	// PerIP is shared by the tunnels of a single client IP.
+	PerIP proxy.Bandwidth
+
+	// PerUser is shared by the tunnels of a single authenticated user.
+	PerUser proxy.Bandwidth
+}
+
+// NewThrottler creates a [Throttler] enforcing the bandwidth limits.
+func NewThrottler(t Throttling) *Throttler {
+	return &Throttler{
+		global:  proxy.NewThrottle(&t.Global),
+		perIP:   t.PerIP,
+		perUser: t.PerUser,
+		ips:     make(map[netip.Addr]*sharedThrottle),
+		users:   make(map[string]*sharedThrottle),
+	}
+}
+
+// Throttler keeps tunnels within [Throttling] limits.
+type Throttler struct {
+	global  *proxy.Throttle
+	perIP   proxy.Bandwidth
+	perUser proxy.Bandwidth
+
+	mu    sync.Mutex
+	ips   map[netip.Addr]*sharedThrottle
+	users map[string]*sharedThrottle
+}
+
+// sharedThrottle is a throttle kept for as long as there are tunnels using it.
+type sharedThrottle struct {
+	throttle *proxy.Throttle
+	refs     int
+}
+
+// throttle keeps a connection of a tunnel within the limits, until the returned function is called.
+//
+// The connection is the client one, unless the tunnel forwards a single request and has none.
+// A nil throttler only applies the limits of the route the tunnel was opened through.
+func (t *Throttler) throttle(ctx context.Context, conn net.Conn, tun *tunnel) (net.Conn, func()) {
+	throttled := proxy.Throttled
+	if tun.clientConn == nil {
+		throttled = proxy.ThrottledDestination
+	}
+
+	throttles := []*proxy.Throttle{proxy.ThrottleOf(tun.dstConn)}
+	if t == nil {
+		return throttled(ctx, conn, throttles...), func() {}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ip := remoteIP(tun.clientAddr)
+	throttles = append(throttles, t.global, acquireThrottle(t.ips, ip, &t.perIP))
+
+	// Anonymous clients are only limited by IP
+	user := userOf(ctx)
+	if user != "" {
+		throttles = append(throttles, acquireThrottle(t.users, user, &t.perUser))
+	}
+
+	return throttled(ctx, conn, throttles...), func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		releaseThrottle(t.ips, ip)
+		if user != "" {
+			releaseThrottle(t.users, user)
+		}
+	}
+}
+
+func acquireThrottle[K comparable](throttles map[K]*sharedThrottle, key K, b *proxy.Bandwidth) *proxy.Throttle {
+	t := throttles[key]
+	if t == nil {
+		t = &sharedThrottle{throttle: proxy.NewThrottle(b)}
+		throttles[key] = t
+	}
+	t.refs++
+	return t.throttle
+}
+
+func releaseThrottle[K comparable](throttles map[K]*sharedThrottle, key K) {
+	t := throttles[key]
+	if t.refs--; t.refs == 0 {
+		delete(throttles, key)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+func newTunnelGroup() *tunnelGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &tunnelGroup{
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// tunnelGroup keeps track of client connections and their tunnels, so that they can be drained on shutdown.
+type tunnelGroup struct {
+	// ctx is canceled to force the remaining tunnels to close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// add tracks a client connection until done is called for it.
+func (g *tunnelGroup) add(clientConn net.Conn) {
+	g.wg.Add(1)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.conns[clientConn] = struct{}{}
+}
+
+func (g *tunnelGroup) done(clientConn net.Conn) {
+	g.mu.Lock()
+	delete(g.conns, clientConn)
+	g.mu.Unlock()
+
+	g.wg.Done()
+}
+
+func (g *tunnelGroup) active() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return int64(len(g.conns))
+}
+
+// closeAll closes the client connections still being tracked, to stop them from waiting on clients.
+func (g *tunnelGroup) closeAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for conn := range g.conns {
+		conn.Close()
+	}
+}
+
+// drain waits for tunnels to close until the deadline, with a zero deadline meaning no limit, and then closes the remaining ones.
+func (g *tunnelGroup) drain(deadline time.Time) (drained, forced int64) {
+	defer g.cancel()
+
+	total := g.active()
+	allDone := make(chan struct{})
+	go func() {
+		defer close(allDone)
+		g.wg.Wait()
+	}()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-allDone:
+		return total, 0
+	case <-expired:
+		forced = g.active()
+
+		// Not every connection watches the context, as with clients yet to send a request
+		g.cancel()
+		g.closeAll()
+		<-allDone
+		return total - forced, forced
+	}
+}
+
+func drainDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func withDeadline(ctx context.Context, deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
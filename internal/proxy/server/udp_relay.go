@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/socks"
+)
+
+// maxDatagramSize is large enough to hold any UDP payload.
+const maxDatagramSize = 64 * 1024
+
+// newUDPRelay opens a relay for a client connected to the SOCKS server via controlConn.
+// Datagrams are exchanged with destinations through dstConn, which is owned by the relay from now on.
+//
+// Datagrams are only accepted from the IP address of the control connection.
+// If the client has announced a source port with the UDP ASSOCIATE request, datagrams from other ports are dropped,
+// otherwise the port of the first received datagram is used for the rest of the association.
+func newUDPRelay(controlConn net.Conn, clientAddr *addr.Addr, dstConn proxy.PacketConn) (*udpRelay, error) {
+	localAddr, err := netip.ParseAddrPort(controlConn.LocalAddr().String())
+	if err != nil {
+		dstConn.Close()
+		return nil, fmt.Errorf("parse local address: %w", err)
+	}
+
+	remoteAddr, err := netip.ParseAddrPort(controlConn.RemoteAddr().String())
+	if err != nil {
+		dstConn.Close()
+		return nil, fmt.Errorf("parse client address: %w", err)
+	}
+
+	// Bind the relay to the interface the client has used to reach the server
+	clientConn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(localAddr.Addr(), 0)))
+	if err != nil {
+		dstConn.Close()
+		return nil, fmt.Errorf("listen for client: %w", err)
+	}
+
+	return &udpRelay{
+		clientConn: clientConn,
+		dstConn:    dstConn,
+		clientAddr: netip.AddrPortFrom(remoteAddr.Addr().Unmap(), clientAddr.Port),
+	}, nil
+}
+
+type udpRelay struct {
+	clientConn *net.UDPConn
+	dstConn    proxy.PacketConn
+
+	mu         sync.Mutex
+	clientAddr netip.AddrPort
+}
+
+// Addr returns the address the client is expected to send datagrams to.
+func (r *udpRelay) Addr() *addr.Addr {
+	a := r.clientConn.LocalAddr().(*net.UDPAddr).AddrPort()
+	return addr.NewAddr(a.Addr().Unmap().String(), a.Port())
+}
+
+// Serve relays datagrams until the context is canceled or an I/O error occurs.
+func (r *udpRelay) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- r.relayToDst()
+	}()
+	go func() {
+		errChan <- r.relayToClient()
+	}()
+
+	pending := cap(errChan)
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errChan:
+		pending--
+	}
+
+	// Stop the other side and wait for it to return
+	r.Close()
+	for range pending {
+		<-errChan
+	}
+
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (r *udpRelay) Close() error {
+	return errors.Join(
+		r.clientConn.Close(),
+		r.dstConn.Close(),
+	)
+}
+
+func (r *udpRelay) relayToDst() error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, srcAddr, err := r.clientConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return err
+		}
+
+		if !r.acceptClient(srcAddr) {
+			continue
+		}
+
+		datagram, err := socks.ReadDatagram(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil {
+			// Drop malformed datagrams
+			continue
+		}
+
+		// Fragmentation is not supported, so drop all fragments
+		if datagram.Fragment != 0 {
+			continue
+		}
+
+		// Delivery of UDP datagrams is not guaranteed anyway, so ignore failed writes, including those rejected by policy
+		_, _ = r.dstConn.WriteTo(datagram.Data, &datagram.DstAddr)
+	}
+}
+
+func (r *udpRelay) relayToClient() error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, srcAddr, err := r.dstConn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		clientAddr, ok := r.client()
+		if !ok {
+			// The client has not sent anything yet, so there is nowhere to send the datagram to
+			continue
+		}
+
+		datagram := socks.Datagram{
+			DstAddr: *srcAddr,
+			Data:    buf[:n],
+		}
+		_ = datagram.Write(&udpWriter{r.clientConn, clientAddr})
+	}
+}
+
+func (r *udpRelay) acceptClient(a netip.AddrPort) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if a.Addr().Unmap() != r.clientAddr.Addr() {
+		return false
+	}
+
+	if r.clientAddr.Port() == 0 {
+		r.clientAddr = netip.AddrPortFrom(r.clientAddr.Addr(), a.Port())
+		return true
+	}
+	return a.Port() == r.clientAddr.Port()
+}
+
+func (r *udpRelay) client() (netip.AddrPort, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.clientAddr, r.clientAddr.Port() != 0
+}
+
+// udpWriter sends each write as a single datagram to the specified address.
+type udpWriter struct {
+	conn *net.UDPConn
+	addr netip.AddrPort
+}
+
+func (w *udpWriter) Write(p []byte) (int, error) {
+	return w.conn.WriteToUDPAddrPort(p, w.addr)
+}
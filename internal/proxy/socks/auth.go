@@ -3,13 +3,15 @@ package socks
 import "fmt"
 
 const (
-	AuthNone Auth = 0x00
+	AuthNone     Auth = 0x00
+	AuthPassword Auth = 0x02
 
 	AuthNotAcceptable Auth = 0xff
 )
 
 var authText = map[Auth]string{
-	AuthNone: "None",
+	AuthNone:     "None",
+	AuthPassword: "Username/Password",
 
 	AuthNotAcceptable: "No Acceptable Authentication",
 }
@@ -0,0 +1,66 @@
+package socks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+)
+
+// ReadDatagram decodes a SOCKS5 UDP datagram, consuming the rest of the input as the payload.
+func ReadDatagram(r *bufio.Reader) (*Datagram, error) {
+	var rsv [2]byte
+	if _, err := io.ReadFull(r, rsv[:]); err != nil {
+		return nil, fmt.Errorf("decode reserved field: %w", err)
+	}
+	if rsv != [2]byte{} {
+		return nil, fmt.Errorf("non-zero value for reserved field (%#04x)", rsv)
+	}
+
+	frag, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("decode fragment number: %w", err)
+	}
+
+	dstAddr, err := v5ReadAddr(r)
+	if err != nil {
+		return nil, fmt.Errorf("decode destination address: %w", err)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decode data: %w", err)
+	}
+
+	return &Datagram{
+		Fragment: frag,
+		DstAddr:  *dstAddr,
+		Data:     data,
+	}, nil
+}
+
+// Datagram is a UDP packet relayed through a SOCKS5 proxy.
+type Datagram struct {
+	// Fragment is the fragment number, with zero meaning a standalone datagram.
+	Fragment byte
+
+	DstAddr addr.Addr
+	Data    []byte
+}
+
+// Write encodes the datagram with a single call to w.Write, so that it can be sent as one UDP packet.
+func (d *Datagram) Write(w io.Writer) error {
+	dstAddr, err := v5EncodeAddr(&d.DstAddr)
+	if err != nil {
+		return fmt.Errorf("encode destination address: %w", err)
+	}
+
+	bytes := make([]byte, 0, 3+len(dstAddr)+len(d.Data))
+	bytes = append(bytes, 0, 0, d.Fragment)
+	bytes = append(bytes, dstAddr...)
+	bytes = append(bytes, d.Data...)
+
+	_, err = w.Write(bytes)
+	return err
+}
@@ -0,0 +1,121 @@
+package socks_test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/socks"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestDatagram(t *testing.T) {
+	suite.Run(t, new(DatagramTest))
+}
+
+type DatagramTest struct {
+	suite.Suite
+}
+
+func (t *DatagramTest) TestRead() {
+	t.Run("decodes SOCKS5 UDP datagram", func() {
+		got, err := decodeDatagram([]byte{
+			0, 0, // Reserved field
+			0,               // Fragment number
+			1, 127, 0, 0, 1, // Destination address
+			0x04, 0x38, // Destination port
+			'a', 'b', 'c', // Data
+		})
+		t.Require().NoError(err)
+
+		t.Run("decodes fragment number", func() {
+			t.Equal(byte(0), got.Fragment)
+		})
+
+		t.Run("decodes destination address", func() {
+			t.Equal(addr.NewAddr("127.0.0.1", 1080), &got.DstAddr)
+		})
+
+		t.Run("decodes data", func() {
+			t.Equal([]byte("abc"), got.Data)
+		})
+	})
+
+	t.Run("decodes destination hostname", func() {
+		got, err := decodeDatagram([]byte{
+			0, 0, 0,
+			3, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't',
+			0x04, 0x38,
+		})
+		t.Require().NoError(err)
+
+		t.Equal("localhost", got.DstAddr.Host)
+		t.Empty(got.Data)
+	})
+
+	t.Run("rejects non-zero reserved field", func() {
+		_, err := decodeDatagram([]byte{0, 1, 0, 1, 127, 0, 0, 1, 0, 0})
+		t.Require().Error(err)
+	})
+
+	t.Run("rejects truncated header", func() {
+		_, err := decodeDatagram([]byte{0, 0, 0, 1, 127})
+		t.Require().Error(err)
+	})
+}
+
+func (t *DatagramTest) TestWrite() {
+	t.Run("encodes SOCKS5 UDP datagram", func() {
+		d := socks.Datagram{
+			Fragment: 1,
+			DstAddr:  *addr.NewAddr("127.0.0.1", 1080),
+			Data:     []byte("abc"),
+		}
+
+		got, err := encodeDatagram(&d)
+		t.Require().NoError(err)
+
+		t.Run("encodes zero reserved field", func() {
+			t.Equal([]byte{0, 0}, got[0:2])
+		})
+
+		t.Run("encodes fragment number", func() {
+			t.Equal(byte(1), got[2])
+		})
+
+		t.Run("encodes destination address", func() {
+			t.Equal([]byte{1, 127, 0, 0, 1, 0x04, 0x38}, got[3:10])
+		})
+
+		t.Run("encodes data", func() {
+			t.Equal([]byte("abc"), got[10:])
+		})
+	})
+
+	t.Run("rejects destination hostname longer than 255 bytes", func() {
+		d := socks.Datagram{
+			DstAddr: *addr.NewAddr(strings.Repeat("a", 256), 0),
+		}
+
+		_, err := encodeDatagram(&d)
+		t.Require().Error(err)
+	})
+}
+
+func decodeDatagram(b []byte) (*socks.Datagram, error) {
+	return socks.ReadDatagram(
+		bufio.NewReader(
+			bytes.NewReader(b),
+		),
+	)
+}
+
+func encodeDatagram(d *socks.Datagram) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := d.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,58 @@
+package socks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+)
+
+// passwordAuthVersion is the version of the username/password subnegotiation defined by RFC 1929.
+const passwordAuthVersion Version = 0x01
+
+func ReadPasswordAuth(r *bufio.Reader) (*PasswordAuth, error) {
+	if _, err := checkVersion(r, passwordAuthVersion); err != nil {
+		return nil, err
+	}
+
+	username, err := readLenString(r)
+	if err != nil {
+		return nil, fmt.Errorf("decode username: %w", err)
+	}
+
+	password, err := readLenString(r)
+	if err != nil {
+		return nil, fmt.Errorf("decode password: %w", err)
+	}
+
+	return &PasswordAuth{
+		Username: username,
+		Password: password,
+	}, nil
+}
+
+type PasswordAuth struct {
+	Username string
+	Password string
+}
+
+func (a *PasswordAuth) Write(w io.Writer) error {
+	if n := len(a.Username); n > math.MaxUint8 {
+		return fmt.Errorf("username too long (%v)", n)
+	}
+	if n := len(a.Password); n > math.MaxUint8 {
+		return fmt.Errorf("password too long (%v)", n)
+	}
+
+	bytes := make([]byte, 0, 3+len(a.Username)+len(a.Password))
+	bytes = append(bytes, byte(passwordAuthVersion))
+
+	bytes = append(bytes, byte(len(a.Username)))
+	bytes = append(bytes, []byte(a.Username)...)
+
+	bytes = append(bytes, byte(len(a.Password)))
+	bytes = append(bytes, []byte(a.Password)...)
+
+	_, err := w.Write(bytes)
+	return err
+}
@@ -0,0 +1,40 @@
+package socks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+const (
+	passwordAuthSuccess byte = 0x00
+	passwordAuthFailure byte = 0x01
+)
+
+func ReadPasswordAuthReply(r *bufio.Reader) (*PasswordAuthReply, error) {
+	if _, err := checkVersion(r, passwordAuthVersion); err != nil {
+		return nil, err
+	}
+
+	status, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("decode status: %w", err)
+	}
+
+	// Any non-zero status indicates a failure
+	return &PasswordAuthReply{Success: status == passwordAuthSuccess}, nil
+}
+
+type PasswordAuthReply struct {
+	Success bool
+}
+
+func (r *PasswordAuthReply) Write(w io.Writer) error {
+	status := passwordAuthFailure
+	if r.Success {
+		status = passwordAuthSuccess
+	}
+
+	_, err := w.Write([]byte{byte(passwordAuthVersion), status})
+	return err
+}
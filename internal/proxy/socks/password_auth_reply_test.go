@@ -0,0 +1,71 @@
+package socks_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/cerfical/socks2http/internal/proxy/socks"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestPasswordAuthReply(t *testing.T) {
+	suite.Run(t, new(PasswordAuthReplyTest))
+}
+
+type PasswordAuthReplyTest struct {
+	suite.Suite
+}
+
+func (t *PasswordAuthReplyTest) TestRead() {
+	t.Run("decodes zero status as success", func() {
+		got, err := decodePasswordAuthReply([]byte{1, 0})
+		t.Require().NoError(err)
+
+		t.True(got.Success)
+	})
+
+	t.Run("decodes non-zero status as failure", func() {
+		got, err := decodePasswordAuthReply([]byte{1, 0x17})
+		t.Require().NoError(err)
+
+		t.False(got.Success)
+	})
+
+	t.Run("rejects invalid version", func() {
+		_, err := decodePasswordAuthReply([]byte{5, 0})
+		t.Require().ErrorIs(err, socks.ErrInvalidVersion)
+	})
+}
+
+func (t *PasswordAuthReplyTest) TestWrite() {
+	t.Run("encodes success", func() {
+		got, err := encodePasswordAuthReply(&socks.PasswordAuthReply{Success: true})
+		t.Require().NoError(err)
+
+		t.Equal([]byte{1, 0}, got)
+	})
+
+	t.Run("encodes failure", func() {
+		got, err := encodePasswordAuthReply(&socks.PasswordAuthReply{Success: false})
+		t.Require().NoError(err)
+
+		t.Equal([]byte{1, 1}, got)
+	})
+}
+
+func decodePasswordAuthReply(b []byte) (*socks.PasswordAuthReply, error) {
+	return socks.ReadPasswordAuthReply(
+		bufio.NewReader(
+			bytes.NewReader(b),
+		),
+	)
+}
+
+func encodePasswordAuthReply(r *socks.PasswordAuthReply) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
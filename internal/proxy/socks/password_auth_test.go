@@ -0,0 +1,102 @@
+package socks_test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/cerfical/socks2http/internal/proxy/socks"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestPasswordAuth(t *testing.T) {
+	suite.Run(t, new(PasswordAuthTest))
+}
+
+type PasswordAuthTest struct {
+	suite.Suite
+}
+
+func (t *PasswordAuthTest) TestRead() {
+	t.Run("decodes username/password request", func() {
+		got, err := decodePasswordAuth([]byte{
+			1,                     // Version
+			4, 'r', 'o', 'o', 't', // Username
+			3, 'p', 'w', 'd', // Password
+		})
+		t.Require().NoError(err)
+
+		t.Run("decodes username", func() {
+			t.Equal("root", got.Username)
+		})
+
+		t.Run("decodes password", func() {
+			t.Equal("pwd", got.Password)
+		})
+	})
+
+	t.Run("rejects truncated password", func() {
+		_, err := decodePasswordAuth([]byte{1, 1, 'a', 3, 'p'})
+		t.Require().Error(err)
+	})
+
+	t.Run("rejects invalid version", func() {
+		_, err := decodePasswordAuth([]byte{5})
+		t.Require().ErrorIs(err, socks.ErrInvalidVersion)
+	})
+}
+
+func (t *PasswordAuthTest) TestWrite() {
+	t.Run("encodes username/password request", func() {
+		a := socks.PasswordAuth{
+			Username: "root",
+			Password: "pwd",
+		}
+
+		got, err := encodePasswordAuth(&a)
+		t.Require().NoError(err)
+
+		t.Run("encodes version", func() {
+			t.Equal(byte(1), got[0])
+		})
+
+		t.Run("encodes username", func() {
+			t.Equal([]byte{4, 'r', 'o', 'o', 't'}, got[1:6])
+		})
+
+		t.Run("encodes password", func() {
+			t.Equal([]byte{3, 'p', 'w', 'd'}, got[6:])
+		})
+	})
+
+	t.Run("rejects username longer than 255 bytes", func() {
+		a := socks.PasswordAuth{Username: strings.Repeat("a", 256)}
+
+		_, err := encodePasswordAuth(&a)
+		t.Require().Error(err)
+	})
+
+	t.Run("rejects password longer than 255 bytes", func() {
+		a := socks.PasswordAuth{Password: strings.Repeat("a", 256)}
+
+		_, err := encodePasswordAuth(&a)
+		t.Require().Error(err)
+	})
+}
+
+func decodePasswordAuth(b []byte) (*socks.PasswordAuth, error) {
+	return socks.ReadPasswordAuth(
+		bufio.NewReader(
+			bytes.NewReader(b),
+		),
+	)
+}
+
+func encodePasswordAuth(a *socks.PasswordAuth) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := a.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -157,6 +157,19 @@ func v4EncodeAddr(a *addr.Addr) (addr []byte, hostname []byte, err error) {
 
 }
 
+func readLenString(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	str := make([]byte, n)
+	if _, err := io.ReadFull(r, str); err != nil {
+		return "", err
+	}
+	return string(str), nil
+}
+
 func readPort(r *bufio.Reader) (uint16, error) {
 	var port [2]byte
 	if _, err := io.ReadFull(r, port[:]); err != nil {
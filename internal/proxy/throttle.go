@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// Bandwidth limits the rate of data transfer through tunnels, in bytes per second, with zero meaning no limit.
+type Bandwidth struct {
+	// Upload limits the data sent by clients.
+	Upload int
+
+	// Download limits the data received by clients.
+	Download int
+
+	// UploadBurst and DownloadBurst, if set, limit the data transferred at once, which defaults to a second worth of it.
+	UploadBurst   int
+	DownloadBurst int
+}
+
+// NewThrottle creates a [Throttle] for the bandwidth, or returns nil if the bandwidth is unlimited.
+func NewThrottle(b *Bandwidth) *Throttle {
+	if b.Upload <= 0 && b.Download <= 0 {
+		return nil
+	}
+	return &Throttle{
+		upload:   newByteLimiter(b.Upload, b.UploadBurst),
+		download: newByteLimiter(b.Download, b.DownloadBurst),
+	}
+}
+
+// Throttle shares a bandwidth among all of the connections it is applied to.
+type Throttle struct {
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+func newByteLimiter(perSecond, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = perSecond
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// Throttled keeps transfers over a client connection within the bandwidth of all of the throttles, with nil ones being ignored.
+//
+// Reading from the connection counts as upload, and writing to it as download.
+// Transfers stop waiting for the bandwidth once the context is canceled.
+func Throttled(ctx context.Context, clientConn net.Conn, throttles ...*Throttle) net.Conn {
+	return throttled(ctx, clientConn, false, throttles)
+}
+
+// ThrottledDestination is like [Throttled], but for a connection to the destination, where writing counts as upload and reading as download.
+func ThrottledDestination(ctx context.Context, dstConn net.Conn, throttles ...*Throttle) net.Conn {
+	return throttled(ctx, dstConn, true, throttles)
+}
+
+func throttled(ctx context.Context, conn net.Conn, reversed bool, throttles []*Throttle) net.Conn {
+	c := throttledConn{Conn: conn, ctx: ctx}
+	for _, t := range throttles {
+		if t == nil {
+			continue
+		}
+
+		upload, download := t.upload, t.download
+		if reversed {
+			upload, download = download, upload
+		}
+		if upload != nil {
+			c.read = append(c.read, upload)
+		}
+		if download != nil {
+			c.write = append(c.write, download)
+		}
+	}
+
+	if len(c.read) == 0 && len(c.write) == 0 {
+		return conn
+	}
+	c.readChunk = maxChunk(c.read)
+	c.writeChunk = maxChunk(c.write)
+	return &c
+}
+
+// throttledConn waits for the bandwidth after reading data, and before writing it.
+type throttledConn struct {
+	net.Conn
+	ctx context.Context
+
+	// read and write are the limiters applied to reading from and writing to the connection
+	read  []*rate.Limiter
+	write []*rate.Limiter
+
+	// readChunk and writeChunk limit the data transferred at once, to fit within the bursts of all limiters
+	readChunk  int
+	writeChunk int
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if len(c.read) == 0 {
+		return c.Conn.Read(p)
+	}
+
+	n, err := c.Conn.Read(p[:min(len(p), c.readChunk)])
+	if n > 0 {
+		// The data has already been read, so it is delivered even if the wait is interrupted
+		_ = waitAll(c.ctx, c.read, n)
+	}
+	return n, err
+}
+
+func (c *throttledConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *throttledConn) MaxTransfer() int {
+	switch {
+	case c.readChunk == 0:
+		return c.writeChunk
+	case c.writeChunk == 0:
+		return c.readChunk
+	}
+	return min(c.readChunk, c.writeChunk)
+}
+
+func (c *throttledConn) Transferred(read, written int) error {
+	if read > 0 {
+		_ = waitAll(c.ctx, c.read, read)
+	}
+	if written > 0 {
+		return waitAll(c.ctx, c.write, written)
+	}
+	return nil
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	if len(c.write) == 0 {
+		return c.Conn.Write(p)
+	}
+
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), c.writeChunk)]
+		if err := waitAll(c.ctx, c.write, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *throttledConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func waitAll(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, l := range limiters {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func maxChunk(limiters []*rate.Limiter) int {
+	chunk := 0
+	for _, l := range limiters {
+		if chunk == 0 || l.Burst() < chunk {
+			chunk = l.Burst()
+		}
+	}
+	return chunk
+}
+
+// WithThrottle attaches a throttle to be applied to tunnels through the connection, which can be found later with [ThrottleOf].
+func WithThrottle(conn net.Conn, t *Throttle) net.Conn {
+	return &throttleConn{conn, t}
+}
+
+// ThrottleOf finds the throttle attached to the connection, if there is one.
+func ThrottleOf(conn net.Conn) *Throttle {
+	for {
+		switch c := conn.(type) {
+		case *throttleConn:
+			return c.throttle
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+type throttleConn struct {
+	net.Conn
+	throttle *Throttle
+}
+
+func (c *throttleConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func (c *throttleConn) NetConn() net.Conn {
+	return c.Conn
+}
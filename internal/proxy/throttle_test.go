@@ -0,0 +1,132 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestThrottle(t *testing.T) {
+	suite.Run(t, new(ThrottleTest))
+}
+
+type ThrottleTest struct {
+	suite.Suite
+}
+
+func (t *ThrottleTest) TestThrottled() {
+	t.Run("limits the data received by the client", func() {
+		throttle := proxy.NewThrottle(&proxy.Bandwidth{Download: 1000, DownloadBurst: 100})
+		clientConn, conn := net.Pipe()
+		defer clientConn.Close()
+		throttled := proxy.Throttled(context.Background(), conn, throttle)
+		defer throttled.Close()
+
+		// The burst is available right away, and the rest takes 200ms
+		elapsed := t.measure(func() {
+			go io.WriteString(throttled, strings.Repeat("a", 300))
+			t.readN(clientConn, 300)
+		})
+		t.GreaterOrEqual(elapsed, 150*time.Millisecond)
+	})
+
+	t.Run("limits the data sent by the client", func() {
+		throttle := proxy.NewThrottle(&proxy.Bandwidth{Upload: 1000, UploadBurst: 100})
+		clientConn, conn := net.Pipe()
+		defer clientConn.Close()
+		throttled := proxy.Throttled(context.Background(), conn, throttle)
+		defer throttled.Close()
+
+		elapsed := t.measure(func() {
+			go io.WriteString(clientConn, strings.Repeat("a", 300))
+			t.readN(throttled, 300)
+		})
+		t.GreaterOrEqual(elapsed, 150*time.Millisecond)
+	})
+
+	t.Run("shares the bandwidth among connections", func() {
+		throttle := proxy.NewThrottle(&proxy.Bandwidth{Download: 1000, DownloadBurst: 100})
+
+		elapsed := t.measure(func() {
+			done := make(chan struct{})
+			for range 2 {
+				clientConn, conn := net.Pipe()
+				defer clientConn.Close()
+				throttled := proxy.Throttled(context.Background(), conn, throttle)
+				defer throttled.Close()
+
+				go io.WriteString(throttled, strings.Repeat("a", 150))
+				go func() {
+					_, _ = io.ReadFull(clientConn, make([]byte, 150))
+					done <- struct{}{}
+				}()
+			}
+			<-done
+			<-done
+		})
+		t.GreaterOrEqual(elapsed, 150*time.Millisecond)
+	})
+
+	t.Run("stops waiting for the bandwidth once the context is canceled", func() {
+		throttle := proxy.NewThrottle(&proxy.Bandwidth{Download: 1, DownloadBurst: 1})
+		clientConn, conn := net.Pipe()
+		defer clientConn.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		throttled := proxy.Throttled(ctx, conn, throttle)
+		defer throttled.Close()
+
+		writeErr := make(chan error, 1)
+		go func() {
+			_, err := io.WriteString(throttled, "abc")
+			writeErr <- err
+		}()
+		t.readN(clientConn, 1)
+
+		cancel()
+		t.ErrorIs(<-writeErr, context.Canceled)
+	})
+
+	t.Run("leaves connections without limits as is", func() {
+		conn, _ := net.Pipe()
+		defer conn.Close()
+
+		t.Same(conn, proxy.Throttled(context.Background(), conn, nil, proxy.NewThrottle(&proxy.Bandwidth{})))
+	})
+}
+
+func (t *ThrottleTest) TestThrottleOf() {
+	t.Run("finds the throttle attached to a wrapped connection", func() {
+		throttle := proxy.NewThrottle(&proxy.Bandwidth{Upload: 1000})
+		conn, _ := net.Pipe()
+		defer conn.Close()
+
+		conn = proxy.WithIdleTimeout(proxy.WithThrottle(conn, throttle), time.Minute)
+
+		t.Same(throttle, proxy.ThrottleOf(conn))
+	})
+
+	t.Run("finds no throttle if none is attached", func() {
+		conn, _ := net.Pipe()
+		defer conn.Close()
+
+		t.Nil(proxy.ThrottleOf(conn))
+	})
+}
+
+func (t *ThrottleTest) measure(f func()) time.Duration {
+	start := time.Now()
+	f()
+	return time.Since(start)
+}
+
+func (t *ThrottleTest) readN(r io.Reader, n int) {
+	_, err := io.ReadFull(r, make([]byte, n))
+	t.Require().NoError(err)
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// CloseReasonSource means the source has finished sending data.
+	CloseReasonSource CloseReason = iota
+	// CloseReasonDestination means the destination has finished sending data.
+	CloseReasonDestination
+	// CloseReasonIdle means no data was transferred for too long.
+	CloseReasonIdle
+	// CloseReasonCanceled means the tunnel was closed from the outside, e.g. on server shutdown.
+	CloseReasonCanceled
+	// CloseReasonError means the data transfer has failed.
+	CloseReasonError
+)
+
+var closeReasons = []string{
+	CloseReasonSource:      "source-closed",
+	CloseReasonDestination: "destination-closed",
+	CloseReasonIdle:        "idle-timeout",
+	CloseReasonCanceled:    "canceled",
+	CloseReasonError:       "error",
+}
+
+// CloseReason describes why a tunnel was closed.
+type CloseReason int
+
+func (r CloseReason) String() string {
+	text, err := r.MarshalText()
+	if err != nil {
+		return ""
+	}
+	return string(text)
+}
+
+func (r CloseReason) MarshalText() ([]byte, error) {
+	if r < CloseReasonSource || r > CloseReasonError {
+		return nil, errors.New("unknown close reason")
+	}
+	return []byte(closeReasons[r]), nil
+}
+
+// TunnelStats describes the traffic through a closed tunnel.
+type TunnelStats struct {
+	// BytesSent is the number of bytes transferred from the source to the destination.
+	BytesSent int64
+
+	// BytesReceived is the number of bytes transferred from the destination back to the source.
+	BytesReceived int64
+
+	Duration    time.Duration
+	CloseReason CloseReason
+}
+
+func closeReasonOf(err error) CloseReason {
+	switch {
+	case errors.Is(err, ErrIdleTimeout):
+		return CloseReasonIdle
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return CloseReasonCanceled
+	default:
+		return CloseReasonError
+	}
+}
@@ -2,44 +2,208 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var DefaultTunneler Tunneler = &defaultTunneler{}
+// ErrIdleTimeout is returned by tunnels closed because no data was transferred for too long.
+var ErrIdleTimeout = errors.New("tunnel idle timeout")
+
+var DefaultTunneler Tunneler = NewTunneler(0)
+
+// NewTunneler creates a [Tunneler] that closes tunnels idle for longer than idleTimeout, with zero meaning no limit.
+func NewTunneler(idleTimeout time.Duration) Tunneler {
+	return &defaultTunneler{idleTimeout, copyConn}
+}
+
+// WithIdleTimeout overrides the idle timeout of tunnels to the connection.
+func WithIdleTimeout(conn net.Conn, idleTimeout time.Duration) net.Conn {
+	return &idleTimeoutConn{conn, idleTimeout}
+}
+
+type idleTimeoutConn struct {
+	net.Conn
+	idleTimeout time.Duration
+}
+
+func (c *idleTimeoutConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func (c *idleTimeoutConn) NetConn() net.Conn {
+	return c.Conn
+}
 
 type Tunneler interface {
-	Tunnel(ctx context.Context, srcConn, dstConn net.Conn) error
+	// Tunnel transfers data between the connections until the tunnel is closed, reporting the traffic through it.
+	Tunnel(ctx context.Context, srcConn, dstConn net.Conn) (TunnelStats, error)
 }
 
-type defaultTunneler struct{}
+type defaultTunneler struct {
+	idleTimeout time.Duration
+	copy        copyFunc
+}
 
-func (t *defaultTunneler) Tunnel(ctx context.Context, srcConn, dstConn net.Conn) error {
-	dst2SrcDone, dst2SrcStop := transfer(dstConn, srcConn)
-	src2DstDone, src2DstStop := transfer(srcConn, dstConn)
+// copyFunc copies data from src to dst until EOF or an error, returning the number of bytes copied.
+type copyFunc func(dst net.Conn, src io.Reader) (int64, error)
 
-	// The first side that finishes the transfer stops the other side to prevent hanging connections
+func copyConn(dst net.Conn, src io.Reader) (int64, error) {
+	return io.Copy(dst, src)
+}
+
+func (t *defaultTunneler) Tunnel(ctx context.Context, srcConn, dstConn net.Conn) (TunnelStats, error) {
+	start := time.Now()
+	var stats TunnelStats
+
+	idleTimeout := t.idleTimeout
+	if c, ok := dstConn.(*idleTimeoutConn); ok {
+		idleTimeout = c.idleTimeout
+	}
+
+	// Both directions share the time of last activity, so that a tunnel is only idle if neither side sends anything
+	var lastActive *atomic.Int64
+	if idleTimeout > 0 {
+		lastActive = new(atomic.Int64)
+		lastActive.Store(time.Now().UnixNano())
+	}
+
+	// The byte counts are only read once both transfers have returned
+	dst2SrcDone, dst2SrcStop := t.transfer(dstConn, srcConn, &stats.BytesSent, idleTimeout, lastActive)
+	src2DstDone, src2DstStop := t.transfer(srcConn, dstConn, &stats.BytesReceived, idleTimeout, lastActive)
+
+	var err error
 	select {
-	case err := <-dst2SrcDone:
-		src2DstStop()
-		return err
-	case err := <-src2DstDone:
+	case err = <-dst2SrcDone:
+		stats.CloseReason = CloseReasonSource
+		err = finishTransfer(ctx, err, dstConn, srcConn, src2DstDone, src2DstStop)
+	case err = <-src2DstDone:
+		stats.CloseReason = CloseReasonDestination
+		err = finishTransfer(ctx, err, srcConn, dstConn, dst2SrcDone, dst2SrcStop)
+	case <-ctx.Done():
 		dst2SrcStop()
-		return err
+		src2DstStop()
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		stats.CloseReason = closeReasonOf(err)
+	}
+	stats.Duration = time.Since(start)
+	return stats, err
+}
+
+// finishTransfer waits for the remaining direction of a tunnel, writing to otherDst, after the other one finished writing to dst.
+func finishTransfer(ctx context.Context, err error, dst, otherDst net.Conn, otherDone <-chan error, otherStop func()) error {
+	// Pass the end of data on to the other side, which may still have a response to send
+	if err == nil && CloseWrite(dst) == nil {
+		select {
+		case err := <-otherDone:
+			if err == nil {
+				CloseWrite(otherDst)
+			}
+			return err
+		case <-ctx.Done():
+			otherStop()
+			return ctx.Err()
+		}
 	}
+
+	// Otherwise stop the other side to prevent hanging connections
+	otherStop()
+	return err
 }
 
-func transfer(dst net.Conn, src net.Conn) (done <-chan error, stop func()) {
+// CloseWrite shuts down the writing side of the connection, if it supports half-closing.
+func CloseWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (t *defaultTunneler) transfer(dst net.Conn, src net.Conn, written *int64, idleTimeout time.Duration, lastActive *atomic.Int64) (done <-chan error, stop func()) {
+	var r io.Reader = src
+	var idleSrc *idleReader
+	if idleTimeout > 0 {
+		idleSrc = &idleReader{conn: src, timeout: idleTimeout, lastActive: lastActive}
+		r = idleSrc
+	}
+
 	errChan := make(chan error, 1)
 	go func() {
-		_, err := io.Copy(dst, src)
+		n, err := t.copy(dst, r)
+		*written = n
 		errChan <- err
 	}()
 
 	return errChan, func() {
 		// Stop the ongoing read operation and wait for it to return
-		src.SetReadDeadline(time.Now())
+		if idleSrc != nil {
+			idleSrc.stop()
+		} else {
+			src.SetReadDeadline(time.Now())
+		}
 		<-errChan
 	}
 }
+
+// idleReader reads from a connection until no data was transferred in either direction of a tunnel for too long.
+type idleReader struct {
+	conn       net.Conn
+	timeout    time.Duration
+	lastActive *atomic.Int64
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	for {
+		if !r.extendDeadline() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		n, err := r.conn.Read(p)
+		if n > 0 {
+			r.lastActive.Store(time.Now().UnixNano())
+		}
+		if n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) || r.isStopped() {
+			return n, err
+		}
+
+		// Keep waiting while data flows in the other direction
+		if time.Since(time.Unix(0, r.lastActive.Load())) >= r.timeout {
+			return 0, ErrIdleTimeout
+		}
+	}
+}
+
+func (r *idleReader) extendDeadline() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return false
+	}
+	r.conn.SetReadDeadline(time.Unix(0, r.lastActive.Load()).Add(r.timeout))
+	return true
+}
+
+func (r *idleReader) isStopped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopped
+}
+
+func (r *idleReader) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stopped = true
+	r.conn.SetReadDeadline(time.Now())
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	spliceBufferSize = 32 * 1024
+
+	// spliceChunkSize limits the data spliced at once when it needs to be reported to observers
+	spliceChunkSize = 256 * 1024
+)
+
+var spliceBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, spliceBufferSize)
+		return &buf
+	},
+}
+
+// TransferObserver is implemented by connection wrappers that count or throttle the data transferred over them,
+// but still let tunnels get to the underlying connection with a NetConn method.
+//
+// Tunnels transferring data through the underlying connection report it to the observer instead of reading or writing through it.
+type TransferObserver interface {
+	// MaxTransfer limits the bytes transferred at once before being reported, with zero meaning no limit.
+	MaxTransfer() int
+
+	// Transferred reports the bytes read from and written to the underlying connection, possibly waiting before returning.
+	Transferred(read, written int) error
+}
+
+// NewSpliceTunneler creates a [Tunneler] that moves data between TCP connections without copying it to user space.
+//
+// On Linux, [net.TCPConn.ReadFrom] uses splice(2) when reading from another TCP connection, which is relied upon here.
+// Connections are unwrapped with a NetConn method to get to the underlying TCP connections.
+// Wrappers implementing [TransferObserver] are told about the data spliced past them, which is then moved in chunks they can handle.
+// As each chunk is reported once moved, throttled tunnels may run one chunk ahead of their bandwidth.
+//
+// Other connections, as well as tunnels with an idle timeout, which needs to observe every read, are copied with pooled buffers.
+func NewSpliceTunneler(idleTimeout time.Duration) Tunneler {
+	return &defaultTunneler{idleTimeout, spliceConn}
+}
+
+func spliceConn(dst net.Conn, src io.Reader) (int64, error) {
+	if dstTCP, dstObservers, ok := tcpConnOf(dst); ok {
+		if srcConn, ok := src.(net.Conn); ok {
+			if srcTCP, srcObservers, ok := tcpConnOf(srcConn); ok {
+				return splice(dstTCP, srcTCP, dstObservers, srcObservers)
+			}
+		}
+	}
+
+	buf := spliceBuffers.Get().(*[]byte)
+	defer spliceBuffers.Put(buf)
+
+	// Hide ReadFrom and WriteTo methods, so that the buffer is actually used
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// splice moves data from src to dst, reporting every chunk of it to the observers of both connections.
+func splice(dst, src *net.TCPConn, dstObservers, srcObservers []TransferObserver) (int64, error) {
+	if len(dstObservers) == 0 && len(srcObservers) == 0 {
+		return dst.ReadFrom(src)
+	}
+
+	chunk := spliceChunkSize
+	for _, o := range slices.Concat(dstObservers, srcObservers) {
+		if n := o.MaxTransfer(); n > 0 {
+			chunk = min(chunk, n)
+		}
+	}
+
+	var spliced int64
+	for {
+		r := &io.LimitedReader{R: src, N: int64(chunk)}
+		n, err := dst.ReadFrom(r)
+		spliced += n
+
+		if n > 0 {
+			if err := reportTransfer(srcObservers, int(n), 0); err != nil {
+				return spliced, err
+			}
+			if err := reportTransfer(dstObservers, 0, int(n)); err != nil {
+				return spliced, err
+			}
+		}
+
+		// Less than a full chunk is only transferred at the end of data
+		if err != nil || r.N > 0 {
+			return spliced, err
+		}
+	}
+}
+
+func reportTransfer(observers []TransferObserver, read, written int) error {
+	for _, o := range observers {
+		if err := o.Transferred(read, written); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tcpConnOf finds the TCP connection underlying the connection, if any, along with the wrappers observing transfers over it.
+func tcpConnOf(conn net.Conn) (*net.TCPConn, []TransferObserver, bool) {
+	var observers []TransferObserver
+	for {
+		if o, ok := conn.(TransferObserver); ok {
+			observers = append(observers, o)
+		}
+
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, observers, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, nil, false
+		}
+	}
+}
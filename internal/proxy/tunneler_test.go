@@ -4,6 +4,8 @@ import (
 	"context"
 	"io"
 	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -70,7 +72,267 @@ func (t *TunnelerTest) TestTunnel() {
 	})
 }
 
+func (t *TunnelerTest) TestTunnel_HalfClose() {
+	t.Run("half-closed source still receives the response", func() {
+		srcClientConn, srcProxyConn := t.tcpConnPair()
+		dstServerConn, dstProxyConn := t.tcpConnPair()
+		tunnelDone := t.startTunnel(proxy.DefaultTunneler, srcProxyConn, dstProxyConn)
+
+		t.writeString(srcClientConn, "request")
+		t.Require().NoError(proxy.CloseWrite(srcClientConn))
+
+		// The destination only responds after seeing the end of the request
+		req, err := io.ReadAll(dstServerConn)
+		t.Require().NoError(err)
+		t.Equal("request", string(req))
+
+		t.writeString(dstServerConn, "response")
+		dstServerConn.Close()
+
+		resp, err := io.ReadAll(srcClientConn)
+		t.Require().NoError(err)
+		t.Equal("response", string(resp))
+
+		t.assertTunnelClosed(tunnelDone)
+	})
+
+	t.Run("half-closed destination still receives data from the source", func() {
+		srcClientConn, srcProxyConn := t.tcpConnPair()
+		dstServerConn, dstProxyConn := t.tcpConnPair()
+		tunnelDone := t.startTunnel(proxy.DefaultTunneler, srcProxyConn, dstProxyConn)
+
+		t.Require().NoError(proxy.CloseWrite(dstServerConn))
+		_, err := io.ReadAll(srcClientConn)
+		t.Require().NoError(err)
+
+		t.writeString(srcClientConn, "data")
+		srcClientConn.Close()
+
+		data, err := io.ReadAll(dstServerConn)
+		t.Require().NoError(err)
+		t.Equal("data", string(data))
+
+		t.assertTunnelClosed(tunnelDone)
+	})
+
+	t.Run("tunnels are closed if the other side does not support half-closing", func() {
+		srcClientConn, srcProxyConn := t.tcpConnPair()
+		_, dstProxyConn := net.Pipe()
+		tunnelDone := t.startTunnel(proxy.DefaultTunneler, srcProxyConn, dstProxyConn)
+
+		t.Require().NoError(proxy.CloseWrite(srcClientConn))
+		t.assertTunnelClosed(tunnelDone)
+	})
+
+	t.Run("half-closed tunnels are closed after idle timeout", func() {
+		srcClientConn, srcProxyConn := t.tcpConnPair()
+		_, dstProxyConn := t.tcpConnPair()
+		tunnelDone := t.startTunnel(proxy.NewTunneler(50*time.Millisecond), srcProxyConn, dstProxyConn)
+
+		t.Require().NoError(proxy.CloseWrite(srcClientConn))
+		t.assertTunnelClosedWith(tunnelDone, proxy.ErrIdleTimeout)
+	})
+}
+
+func (t *TunnelerTest) TestSpliceTunneler() {
+	tests := map[string]struct {
+		connPair func() (clientConn, proxyConn net.Conn)
+
+		// copied tells whether the data is expected to be copied through wrappers of the proxy connections, if any
+		copied bool
+	}{
+		"TCP connections": {
+			connPair: t.tcpConnPair,
+		},
+		"wrapped TCP connections": {
+			connPair: t.wrappedTCPConnPair(newWrappedConn),
+		},
+		"opaque TCP connections": {
+			connPair: t.wrappedTCPConnPair(newOpaqueConn),
+			copied:   true,
+		},
+		"observed TCP connections": {
+			connPair: t.wrappedTCPConnPair(newObservedConn),
+		},
+		"pipes": {
+			connPair: func() (net.Conn, net.Conn) {
+				clientConn, proxyConn := net.Pipe()
+				t.T().Cleanup(func() {
+					clientConn.Close()
+					proxyConn.Close()
+				})
+				return clientConn, proxyConn
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run("tunnels data in both directions between "+name, func() {
+			srcClientConn, srcProxyConn := test.connPair()
+			dstServerConn, dstProxyConn := test.connPair()
+			tunnelDone := t.startTunnel(proxy.NewSpliceTunneler(0), srcProxyConn, dstProxyConn)
+
+			want := strings.Repeat("abcd", 64*1024)
+			go func() {
+				_, _ = dstServerConn.Write([]byte(want))
+			}()
+			t.Equal(want, t.readString(srcClientConn, len(want)))
+
+			go func() {
+				_, _ = srcClientConn.Write([]byte(want))
+			}()
+			t.Equal(want, t.readString(dstServerConn, len(want)))
+
+			srcClientConn.Close()
+			dstServerConn.Close()
+			t.assertTunnelClosed(tunnelDone)
+
+			for _, conn := range []net.Conn{srcProxyConn, dstProxyConn} {
+				if c, ok := conn.(interface{ Reads() int64 }); ok {
+					t.Equal(test.copied, c.Reads() != 0)
+				}
+				if c, ok := conn.(interface{ Observed() (int64, int64) }); ok {
+					read, written := c.Observed()
+					t.Equal(int64(len(want)), read)
+					t.Equal(int64(len(want)), written)
+				}
+			}
+		})
+	}
+
+	t.Run("keeps throttled TCP connections within the bandwidth", func() {
+		srcClientConn, srcProxyConn := t.tcpConnPair()
+		dstServerConn, dstProxyConn := t.tcpConnPair()
+
+		throttle := proxy.NewThrottle(&proxy.Bandwidth{Download: 1000, DownloadBurst: 100})
+		srcProxyConn = proxy.Throttled(context.Background(), srcProxyConn, throttle)
+		t.startTunnel(proxy.NewSpliceTunneler(0), srcProxyConn, dstProxyConn)
+
+		// Spliced chunks are only waited for once delivered, so the first two are available right away, and the rest takes 200ms
+		start := time.Now()
+		go io.WriteString(dstServerConn, strings.Repeat("a", 400))
+		t.readString(srcClientConn, 400)
+		t.GreaterOrEqual(time.Since(start), 150*time.Millisecond)
+	})
+}
+
+func (t *TunnelerTest) TestTunnel_Context() {
+	t.Run("canceling the context closes the tunnel", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		tunnelDone, _, _ := t.openTunnelContext(ctx, proxy.DefaultTunneler, nil)
+
+		cancel()
+		t.assertTunnelClosedWith(tunnelDone, context.Canceled)
+	})
+}
+
+func (t *TunnelerTest) TestTunnel_IdleTimeout() {
+	t.Run("idle tunnels are closed", func() {
+		tunnelDone, _, _ := t.openTunnelWith(proxy.NewTunneler(50*time.Millisecond), nil)
+		t.assertTunnelClosedWith(tunnelDone, proxy.ErrIdleTimeout)
+	})
+
+	t.Run("data sent in one direction keeps the tunnel open", func() {
+		tunnelDone, srcConn, dstConn := t.openTunnelWith(proxy.NewTunneler(100*time.Millisecond), nil)
+
+		for range 5 {
+			t.writeString(srcConn, "a")
+			t.readString(dstConn, 1)
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		select {
+		case err := <-tunnelDone:
+			t.Fail("tunnel was closed", "tunnel was expected to stay open, but it closed with %v", err)
+		default:
+		}
+		t.assertTunnelClosedWith(tunnelDone, proxy.ErrIdleTimeout)
+	})
+
+	t.Run("idle timeout can be overridden by the destination connection", func() {
+		withIdleTimeout := func(c net.Conn) net.Conn {
+			return proxy.WithIdleTimeout(c, 50*time.Millisecond)
+		}
+
+		tunnelDone, _, _ := t.openTunnelWith(proxy.DefaultTunneler, withIdleTimeout)
+		t.assertTunnelClosedWith(tunnelDone, proxy.ErrIdleTimeout)
+	})
+}
+
+func (t *TunnelerTest) TestTunnel_Stats() {
+	t.Run("reports bytes transferred in each direction", func() {
+		srcClientConn, srcProxyConn := t.tcpConnPair()
+		dstServerConn, dstProxyConn := t.tcpConnPair()
+
+		statsChan := make(chan proxy.TunnelStats, 1)
+		go func() {
+			stats, _ := proxy.DefaultTunneler.Tunnel(context.Background(), srcProxyConn, dstProxyConn)
+			statsChan <- stats
+		}()
+
+		t.writeString(srcClientConn, "request")
+		t.readString(dstServerConn, len("request"))
+		t.writeString(dstServerConn, "long response")
+		t.readString(srcClientConn, len("long response"))
+
+		srcClientConn.Close()
+		_, err := io.ReadAll(dstServerConn)
+		t.Require().NoError(err)
+		dstServerConn.Close()
+
+		stats := <-statsChan
+		t.Equal(int64(len("request")), stats.BytesSent)
+		t.Equal(int64(len("long response")), stats.BytesReceived)
+		t.Equal(proxy.CloseReasonSource, stats.CloseReason)
+		t.Positive(stats.Duration)
+	})
+
+	t.Run("reports the destination closing the tunnel", func() {
+		srcClientConn, srcProxyConn := t.tcpConnPair()
+		dstServerConn, dstProxyConn := t.tcpConnPair()
+
+		dstServerConn.Close()
+		go func() {
+			io.ReadAll(srcClientConn)
+			srcClientConn.Close()
+		}()
+
+		stats, err := proxy.DefaultTunneler.Tunnel(context.Background(), srcProxyConn, dstProxyConn)
+		t.Require().NoError(err)
+		t.Equal(proxy.CloseReasonDestination, stats.CloseReason)
+	})
+
+	t.Run("reports idle timeouts", func() {
+		_, srcProxyConn := t.tcpConnPair()
+		_, dstProxyConn := t.tcpConnPair()
+
+		stats, err := proxy.NewTunneler(50*time.Millisecond).Tunnel(context.Background(), srcProxyConn, dstProxyConn)
+		t.Require().ErrorIs(err, proxy.ErrIdleTimeout)
+		t.Equal(proxy.CloseReasonIdle, stats.CloseReason)
+	})
+
+	t.Run("reports canceled tunnels", func() {
+		_, srcProxyConn := t.tcpConnPair()
+		_, dstProxyConn := t.tcpConnPair()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		stats, err := proxy.DefaultTunneler.Tunnel(ctx, srcProxyConn, dstProxyConn)
+		t.Require().ErrorIs(err, context.Canceled)
+		t.Equal(proxy.CloseReasonCanceled, stats.CloseReason)
+	})
+}
+
 func (t *TunnelerTest) openTunnel() (tunnelDone <-chan error, srcConn, dstConn net.Conn) {
+	return t.openTunnelWith(proxy.DefaultTunneler, nil)
+}
+
+func (t *TunnelerTest) openTunnelWith(tunneler proxy.Tunneler, wrapDst func(net.Conn) net.Conn) (tunnelDone <-chan error, srcConn, dstConn net.Conn) {
+	return t.openTunnelContext(context.Background(), tunneler, wrapDst)
+}
+
+func (t *TunnelerTest) openTunnelContext(ctx context.Context, tunneler proxy.Tunneler, wrapDst func(net.Conn) net.Conn) (tunnelDone <-chan error, srcConn, dstConn net.Conn) {
 	srcClientConn, srcProxyConn := net.Pipe()
 	dstServerConn, dstProxyConn := net.Pipe()
 
@@ -84,19 +346,77 @@ func (t *TunnelerTest) openTunnel() (tunnelDone <-chan error, srcConn, dstConn n
 		goleak.VerifyNone(t.T())
 	})
 
+	var dstTunnelConn net.Conn = dstProxyConn
+	if wrapDst != nil {
+		dstTunnelConn = wrapDst(dstProxyConn)
+	}
+
 	tunnelErr := make(chan error, 1)
 	go func() {
-		tunneler := proxy.DefaultTunneler
-		tunnelErr <- tunneler.Tunnel(context.Background(), srcProxyConn, dstProxyConn)
+		_, err := tunneler.Tunnel(ctx, srcProxyConn, dstTunnelConn)
+		tunnelErr <- err
 	}()
 
 	return tunnelErr, srcClientConn, dstServerConn
 }
 
+// startTunnel runs a tunnel between the connections, which are closed when the test ends.
+func (t *TunnelerTest) startTunnel(tunneler proxy.Tunneler, srcConn, dstConn net.Conn) <-chan error {
+	tunnelErr := make(chan error, 1)
+	tunnelDone := make(chan struct{})
+	go func() {
+		defer close(tunnelDone)
+		_, err := tunneler.Tunnel(context.Background(), srcConn, dstConn)
+		tunnelErr <- err
+	}()
+
+	t.T().Cleanup(func() {
+		srcConn.Close()
+		dstConn.Close()
+		<-tunnelDone
+	})
+	return tunnelErr
+}
+
+// tcpConnPair returns both ends of a TCP connection.
+func (t *TunnelerTest) tcpConnPair() (clientConn, serverConn net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Require().NoError(err)
+	defer l.Close()
+
+	clientConn, err = net.Dial("tcp", l.Addr().String())
+	t.Require().NoError(err)
+
+	serverConn, err = l.Accept()
+	t.Require().NoError(err)
+
+	t.T().Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	return clientConn, serverConn
+}
+
+// wrappedTCPConnPair creates a pair of TCP connections, with the proxy side wrapped.
+func (t *TunnelerTest) wrappedTCPConnPair(wrap func(net.Conn) net.Conn) func() (clientConn, proxyConn net.Conn) {
+	return func() (net.Conn, net.Conn) {
+		clientConn, proxyConn := t.tcpConnPair()
+		return clientConn, wrap(proxyConn)
+	}
+}
+
 func (t *TunnelerTest) assertTunnelClosed(tunnelDone <-chan error) {
+	t.assertTunnelClosedWith(tunnelDone, nil)
+}
+
+func (t *TunnelerTest) assertTunnelClosedWith(tunnelDone <-chan error, want error) {
 	select {
 	case err := <-tunnelDone:
-		t.NoError(err)
+		if want == nil {
+			t.NoError(err)
+		} else {
+			t.ErrorIs(err, want)
+		}
 	case <-time.After(TunnelCloseTimeout):
 		t.Fail("tunnel wasn't closed", "tunnel was expected to close in %v, but it didn't", TunnelCloseTimeout)
 	}
@@ -106,7 +426,7 @@ func (t *TunnelerTest) readString(r io.Reader, n int) string {
 	t.T().Helper()
 
 	buf := make([]byte, n)
-	_, err := r.Read(buf)
+	_, err := io.ReadFull(r, buf)
 	t.Require().NoError(err)
 
 	return string(buf)
@@ -118,3 +438,148 @@ func (t *TunnelerTest) writeString(w io.Writer, s string) {
 	_, err := w.Write([]byte(s))
 	t.Require().NoError(err)
 }
+
+func BenchmarkTunneler(b *testing.B) {
+	tunnelers := map[string]proxy.Tunneler{
+		"default": proxy.DefaultTunneler,
+		"splice":  proxy.NewSpliceTunneler(0),
+	}
+	wrappers := map[string]func(net.Conn) net.Conn{
+		"TCP": func(c net.Conn) net.Conn {
+			return c
+		},
+		"wrapped TCP": newWrappedConn,
+		"opaque TCP":  newOpaqueConn,
+	}
+
+	for tunnelerName, tunneler := range tunnelers {
+		for connName, wrap := range wrappers {
+			b.Run(tunnelerName+"/"+connName, func(b *testing.B) {
+				benchmarkTunnel(b, tunneler, wrap)
+			})
+		}
+	}
+}
+
+func benchmarkTunnel(b *testing.B, tunneler proxy.Tunneler, wrap func(net.Conn) net.Conn) {
+	srcClientConn, srcProxyConn := benchTCPConnPair(b)
+	dstServerConn, dstProxyConn := benchTCPConnPair(b)
+
+	tunnelErr := make(chan error, 1)
+	go func() {
+		_, err := tunneler.Tunnel(context.Background(), wrap(srcProxyConn), wrap(dstProxyConn))
+		tunnelErr <- err
+	}()
+
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for range b.N {
+			if _, err := srcClientConn.Write(chunk); err != nil {
+				break
+			}
+		}
+		_ = proxy.CloseWrite(srcClientConn)
+	}()
+
+	if _, err := io.Copy(io.Discard, dstServerConn); err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+
+	dstServerConn.Close()
+	if err := <-tunnelErr; err != nil {
+		b.Fatal(err)
+	}
+}
+
+func benchTCPConnPair(b *testing.B) (clientConn, serverConn net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	clientConn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	serverConn, err = l.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	return clientConn, serverConn
+}
+
+// countingConn counts reads made through it, to tell whether tunnels bypass it.
+type countingConn struct {
+	net.Conn
+	reads *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	c.reads.Add(1)
+	return c.Conn.Read(p)
+}
+
+func (c countingConn) Reads() int64 {
+	return c.reads.Load()
+}
+
+func (c countingConn) CloseWrite() error {
+	return proxy.CloseWrite(c.Conn)
+}
+
+// wrappedConn hides the type of a connection, like the wrappers used by dialers do.
+type wrappedConn struct {
+	countingConn
+}
+
+func newWrappedConn(c net.Conn) net.Conn {
+	return wrappedConn{countingConn{c, new(atomic.Int64)}}
+}
+
+func (c wrappedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// observedConn counts the bytes reported to it by tunnels transferring data past it.
+type observedConn struct {
+	wrappedConn
+	read, written *atomic.Int64
+}
+
+func newObservedConn(c net.Conn) net.Conn {
+	return observedConn{wrappedConn{countingConn{c, new(atomic.Int64)}}, new(atomic.Int64), new(atomic.Int64)}
+}
+
+func (c observedConn) MaxTransfer() int {
+	return 1000
+}
+
+func (c observedConn) Transferred(read, written int) error {
+	c.read.Add(int64(read))
+	c.written.Add(int64(written))
+	return nil
+}
+
+func (c observedConn) Observed() (read, written int64) {
+	return c.read.Load(), c.written.Load()
+}
+
+// opaqueConn hides the type of a connection, with no means to get to the connection.
+type opaqueConn struct {
+	countingConn
+}
+
+func newOpaqueConn(c net.Conn) net.Conn {
+	return opaqueConn{countingConn{c, new(atomic.Int64)}}
+}
@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 
+	"github.com/cerfical/socks2http/internal/admin"
 	"github.com/cerfical/socks2http/internal/config"
 	"github.com/cerfical/socks2http/internal/log"
+	"github.com/cerfical/socks2http/internal/metrics"
+	"github.com/cerfical/socks2http/internal/proxy"
+	"github.com/cerfical/socks2http/internal/proxy/addr"
+	"github.com/cerfical/socks2http/internal/proxy/auth"
 	"github.com/cerfical/socks2http/internal/proxy/router"
 	"github.com/cerfical/socks2http/internal/proxy/server"
 )
@@ -15,27 +23,64 @@ import (
 func main() {
 	config := config.Load(os.Args)
 	log := log.New(log.WithLevel(config.Log.Level))
+	for _, w := range config.Warnings {
+		log.Info(w)
+	}
 
-	log.Info("Using a proxy", "proxy_url", &config.Proxy)
+	log.Info("Using a proxy", "proxy_chain", redactURLs(config.Proxy))
 
-	router := router.New(
-		router.WithRoutes(config.Routes),
-		router.WithDefaultRoute(&router.Route{
-			Proxy: config.Proxy,
-		}),
-	)
+	users, err := loadUsers(config)
+	if err != nil {
+		log.Error("Failed to load users", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	metrics, err := startMetrics(ctx, config, log)
+	if err != nil {
+		log.Error("Failed to start metrics", "error", err)
+		return
+	}
+	registry, err := startAdmin(ctx, config, log)
+	if err != nil {
+		log.Error("Failed to start admin API", "error", err)
+		return
+	}
+
+	r, err := newRouter(config, log, metrics)
+	if err != nil {
+		log.Error("Failed to set up routes", "error", err)
+		return
+	}
+	routes := router.NewSwitch(r)
+
+	if config.Timeout.Idle > 0 {
+		log.Info("Tunnels are copied through user space rather than spliced, to detect idle ones", "idle_timeout", config.Timeout.Idle)
+	}
 
 	server := server.New(
-		server.WithDialer(router),
+		server.WithDialer(routes),
+		server.WithPacketDialer(routes),
+		server.WithTunneler(proxy.NewSpliceTunneler(config.Timeout.Idle)),
+		server.WithHandshakeTimeout(config.Timeout.Handshake),
+		server.WithDrainTimeout(config.Timeout.Drain),
 		server.WithLogger(log),
+		server.WithMetrics(metrics),
+		server.WithRegistry(registry),
+		server.WithLimits(config.Limits),
+		server.WithThrottling(config.Throttling),
+		server.WithAuth(users),
 	)
 
-	ctx, cancel := context.WithCancel(context.Background())
 	done := make(chan struct{})
 
+	stopHealthChecks := startHealthChecks(ctx, r)
+
 	go func() {
 		defer close(done)
-		if err := server.ListenAndServe(ctx, &config.Server); err != nil {
+		if err := server.ListenAndServe(ctx, config.Servers...); err != nil {
 			log.Error("Server terminated abnormally", "error", err)
 		}
 	}()
@@ -43,14 +88,45 @@ func main() {
 	stop := make(chan os.Signal, 2)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
-	select {
-	case <-stop:
-		// Wait for interrupts, and if one occurs, shut down the server
-		log.Info("Shutting down the server")
-		cancel()
-	case <-done:
-		// Server terminated abnormally
-		return
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	if err := watchConfig(ctx, config, reload); err != nil {
+		log.Error("Failed to watch the configuration file", "error", err)
+	}
+
+wait:
+	for {
+		select {
+		case <-reload:
+			// Replace the routes for new connections, leaving the existing tunnels alone
+			c, r, newUsers, err := reloadConfig(log, metrics)
+			if err != nil {
+				log.Error("Failed to reload configuration, keeping the current one", "error", err)
+				continue
+			}
+			stopHealthChecks()
+			stopHealthChecks = startHealthChecks(ctx, r)
+			routes.Store(r)
+
+			// Users can only be replaced if the servers were started with authentication enabled
+			if users != nil && newUsers != nil {
+				users.Replace(newUsers)
+			}
+			log.SetLevel(c.Log.Level)
+
+			log.Info("Configuration reloaded")
+			if changed := restartRequired(config, c); len(changed) != 0 {
+				log.Info("Some of the changed settings require a restart to take effect", "settings", changed)
+			}
+		case <-stop:
+			// Wait for interrupts, and if one occurs, shut down the server
+			log.Info("Shutting down the server")
+			cancel()
+			break wait
+		case <-done:
+			// Server terminated abnormally
+			return
+		}
 	}
 
 	select {
@@ -62,3 +138,173 @@ func main() {
 		log.Info("Server is down")
 	}
 }
+
+func newRouter(c *config.Config, log proxy.Logger, metrics proxy.Metrics) (*router.Router, error) {
+	ops := []router.Option{
+		router.WithRoutes(c.Routes),
+		router.WithDefaultRoute(&router.Route{
+			Proxy: c.Proxy,
+		}),
+		router.WithHealthCheck(&c.HealthCheck),
+		router.WithDialTimeout(c.Timeout.Dial),
+		router.WithLogger(log),
+		router.WithMetrics(metrics),
+	}
+	if c.PAC.File != "" {
+		pac, err := router.LoadPACFile(c.PAC.File)
+		if err != nil {
+			return nil, fmt.Errorf("load PAC file: %w", err)
+		}
+		ops = append(ops, router.WithPAC(pac))
+	}
+	return router.New(ops...)
+}
+
+// reloadConfig loads the configuration again, along with the routes and users it specifies.
+func reloadConfig(log proxy.Logger, metrics proxy.Metrics) (*config.Config, *router.Router, *auth.Store, error) {
+	c, err := config.Reload(os.Args)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	r, err := newRouter(c, log, metrics)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	users, err := loadUsers(c)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("load users: %w", err)
+	}
+	return c, r, users, nil
+}
+
+// restartRequired lists the settings changed by the reloaded configuration that cannot be applied to running servers.
+//
+// Routes, users and the log level are applied on reload, as long as authentication is neither enabled nor disabled.
+func restartRequired(running, reloaded *config.Config) []string {
+	var changed []string
+	check := func(name string, equal bool) {
+		if !equal {
+			changed = append(changed, name)
+		}
+	}
+
+	check("server", slices.Equal(running.Servers, reloaded.Servers))
+	check("auth", authEnabled(running) == authEnabled(reloaded))
+	check("timeout.handshake", running.Timeout.Handshake == reloaded.Timeout.Handshake)
+	check("timeout.idle", running.Timeout.Idle == reloaded.Timeout.Idle)
+	check("timeout.drain", running.Timeout.Drain == reloaded.Timeout.Drain)
+	check("limit", running.Limits == reloaded.Limits)
+	check("bandwidth", running.Throttling == reloaded.Throttling)
+	check("metrics", running.Metrics == reloaded.Metrics)
+	check("admin", running.Admin == reloaded.Admin)
+	check("watch", running.Watch == reloaded.Watch)
+	return changed
+}
+
+func watchConfig(ctx context.Context, c *config.Config, reload chan<- os.Signal) error {
+	if !c.Watch || c.File == "" {
+		return nil
+	}
+
+	return config.WatchFile(ctx, c.File, func() {
+		// Coalesce bursts of file events into a single reload
+		select {
+		case reload <- syscall.SIGHUP:
+		default:
+		}
+	})
+}
+
+// startMetrics serves metrics until the context is canceled, if a listen address is configured.
+func startMetrics(ctx context.Context, c *config.Config, log proxy.Logger) (proxy.Metrics, error) {
+	if c.Metrics.Listen == "" {
+		return proxy.DiscardMetrics, nil
+	}
+
+	// Bind up front, so that an unavailable address fails the startup
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "tcp", c.Metrics.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %v: %w", c.Metrics.Listen, err)
+	}
+
+	m := metrics.New()
+	go func() {
+		if err := m.Serve(ctx, l); err != nil {
+			log.Error("Metrics listener terminated abnormally", "error", err)
+		}
+	}()
+
+	log.Info("Serving metrics", "metrics_addr", l.Addr())
+	return m, nil
+}
+
+// startAdmin serves the admin API until the context is canceled, if a listen address is configured.
+func startAdmin(ctx context.Context, c *config.Config, log proxy.Logger) (*server.Registry, error) {
+	if c.Admin.Listen == "" {
+		return nil, nil
+	}
+
+	registry := server.NewRegistry()
+	api := admin.New(registry, admin.WithToken(c.Admin.Token))
+
+	// Bind up front, so that a misconfigured API fails the startup
+	l, err := api.Listen(ctx, c.Admin.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := api.Serve(ctx, l); err != nil {
+			log.Error("Admin API listener terminated abnormally", "error", err)
+		}
+	}()
+
+	log.Info("Serving admin API", "admin_addr", l.Addr())
+	return registry, nil
+}
+
+// startHealthChecks runs the health checks of the router until stopped, with stopping waiting for the probes in flight.
+func startHealthChecks(ctx context.Context, r *router.Router) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.RunHealthChecks(ctx)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// redactURLs formats URLs for logging, without their passwords.
+func redactURLs(urls []addr.URL) []string {
+	redacted := make([]string, len(urls))
+	for i := range urls {
+		redacted[i] = urls[i].String()
+	}
+	return redacted
+}
+
+func loadUsers(c *config.Config) (*auth.Store, error) {
+	// Leave the proxy open if no users are configured
+	if !authEnabled(c) {
+		return nil, nil
+	}
+
+	users := auth.NewStore(c.Auth.Users...)
+	if c.Auth.File != "" {
+		if err := users.LoadFile(c.Auth.File); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+func authEnabled(c *config.Config) bool {
+	return len(c.Auth.Users) != 0 || c.Auth.File != ""
+}